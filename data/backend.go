@@ -0,0 +1,94 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hellgate75/rebind/log"
+	"github.com/hellgate75/rebind/store"
+	"path/filepath"
+	"strings"
+)
+
+// Type of storage backend
+type BackendType string
+
+const (
+	// Gob files for the records of the groups and a YAML groups index
+	FileBackend BackendType = "file"
+	// Embedded transactional key-value store, in a single file
+	BoltBackend BackendType = "bolt"
+	// Memory only, data is lost on exit
+	MemoryBackend BackendType = "memory"
+	// Name of the bolt backend file in the data folder
+	BOLT_FILE_NAME = "rebind.db"
+)
+
+// Backend persists the groups and the records of the groups
+type Backend interface {
+	// Reports whether the groups were ever saved, false on first start
+	Exists() bool
+	// Lists the saved groups by name
+	ListGroups() (map[string]Group, error)
+	// Gets a saved group
+	GetGroup(groupName string) (Group, error)
+	// Gets the records of a group
+	GetRecords(group Group) (store.GroupStorePersistent, error)
+	// Executes the changes of fn in a transaction, saved only when fn returns no
+	// error: either all the changes are saved or, on error or crash, none is
+	Update(fn func(tx BackendTx) error) error
+	// Releases the backend resources
+	Close() error
+}
+
+// BackendTx collects the changes of a transaction
+type BackendTx interface {
+	// Saves a group
+	PutGroup(group Group) error
+	// Deletes a group and its records
+	DeleteGroup(groupName string) error
+	// Saves the records of a group
+	PutRecords(group Group, records store.GroupStorePersistent) error
+	// Deletes the records of a group
+	DeleteRecords(group Group) error
+}
+
+// ParseBackendType returns the backend type of a name, file when empty
+func ParseBackendType(name string) (BackendType, bool) {
+	switch BackendType(strings.ToLower(name)) {
+	case "", FileBackend:
+		return FileBackend, true
+	case BoltBackend:
+		return BoltBackend, true
+	case MemoryBackend:
+		return MemoryBackend, true
+	}
+	return FileBackend, false
+}
+
+// NewBackend creates a backend of a type keeping the data in a folder
+func NewBackend(backendType BackendType, folder string, logger log.Logger) (Backend, error) {
+	switch backendType {
+	case "", FileBackend:
+		return NewFileBackend(folder, logger), nil
+	case BoltBackend:
+		return NewBoltBackend(filepath.Join(folder, BOLT_FILE_NAME), logger)
+	case MemoryBackend:
+		return NewMemoryBackend(), nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown storage backend: %s", backendType))
+}
+
+// CopyRecords copies the records of a group, so that changes of the copy don't
+// affect the original
+func CopyRecords(records store.GroupStorePersistent) store.GroupStorePersistent {
+	cp := records
+	cp.Store = make(map[string][]store.DNSRecord)
+	for key, recs := range records.Store {
+		cp.Store[key] = append([]store.DNSRecord{}, recs...)
+	}
+	return cp
+}
+
+func groupNotFound(groupName string) error {
+	return errors.New(fmt.Sprintf("Unable to find group by id: %s", groupName))
+}
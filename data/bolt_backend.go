@@ -0,0 +1,151 @@
+package data
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hellgate75/rebind/log"
+	"github.com/hellgate75/rebind/store"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+var (
+	boltMetaBucket    = []byte("meta")
+	boltGroupsBucket  = []byte("groups")
+	boltRecordsBucket = []byte("records")
+	boltSavedKey      = []byte("saved")
+)
+
+// Time waiting for the lock of a bolt file used by another process
+const BOLT_OPEN_TIMEOUT = 5 * time.Second
+
+// NewBoltBackend creates a backend keeping the data in a bolt key-value store
+// file: groups as JSON and records of the groups as gob, in separate buckets.
+// The file is locked, only one process at a time can use it.
+func NewBoltBackend(fileName string, logger log.Logger) (Backend, error) {
+	db, err := bolt.Open(fileName, 0666, &bolt.Options{Timeout: BOLT_OPEN_TIMEOUT})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to open bolt file %s, Error: %v", fileName, err))
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltMetaBucket, boltGroupsBucket, boltRecordsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if logger != nil {
+		logger.Infof("GroupsBucket:: [INFO] Using bolt storage at: %s", fileName)
+	}
+	return &boltBackend{
+		db:  db,
+		log: logger,
+	}, nil
+}
+
+type boltBackend struct {
+	db  *bolt.DB
+	log log.Logger
+}
+
+func (b *boltBackend) Exists() bool {
+	exists := false
+	_ = b.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(boltMetaBucket).Get(boltSavedKey) != nil
+		return nil
+	})
+	return exists
+}
+
+func (b *boltBackend) ListGroups() (map[string]Group, error) {
+	var groups = make(map[string]Group)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltGroupsBucket).ForEach(func(k, v []byte) error {
+			var group Group
+			if err := json.Unmarshal(v, &group); err != nil {
+				return err
+			}
+			groups[string(k)] = group
+			return nil
+		})
+	})
+	return groups, err
+}
+
+func (b *boltBackend) GetGroup(groupName string) (Group, error) {
+	var group Group
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltGroupsBucket).Get([]byte(groupName))
+		if v == nil {
+			return groupNotFound(groupName)
+		}
+		return json.Unmarshal(v, &group)
+	})
+	return group, err
+}
+
+func (b *boltBackend) GetRecords(group Group) (store.GroupStorePersistent, error) {
+	var records store.GroupStorePersistent
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltRecordsBucket).Get([]byte(group.Name))
+		if v == nil {
+			return errors.New(fmt.Sprintf("Unable to find records of group: %s", group.Name))
+		}
+		// values are valid only in the transaction, gob copies them
+		return gob.NewDecoder(bytes.NewReader(v)).Decode(&records)
+	})
+	return records, err
+}
+
+func (b *boltBackend) Update(fn func(tx BackendTx) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := fn(&boltTx{tx: tx}); err != nil {
+			return err
+		}
+		return tx.Bucket(boltMetaBucket).Put(boltSavedKey, []byte(time.Now().UTC().Format(time.RFC3339)))
+	})
+}
+
+func (b *boltBackend) Close() error {
+	return b.db.Close()
+}
+
+// boltTx changes the buckets in a bolt read-write transaction
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t *boltTx) PutGroup(group Group) error {
+	v, err := json.Marshal(&group)
+	if err != nil {
+		return err
+	}
+	return t.tx.Bucket(boltGroupsBucket).Put([]byte(group.Name), v)
+}
+
+func (t *boltTx) DeleteGroup(groupName string) error {
+	if err := t.tx.Bucket(boltGroupsBucket).Delete([]byte(groupName)); err != nil {
+		return err
+	}
+	return t.tx.Bucket(boltRecordsBucket).Delete([]byte(groupName))
+}
+
+func (t *boltTx) PutRecords(group Group, records store.GroupStorePersistent) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&records); err != nil {
+		return err
+	}
+	return t.tx.Bucket(boltRecordsBucket).Put([]byte(group.Name), buf.Bytes())
+}
+
+func (t *boltTx) DeleteRecords(group Group) error {
+	return t.tx.Bucket(boltRecordsBucket).Delete([]byte(group.Name))
+}
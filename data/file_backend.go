@@ -0,0 +1,321 @@
+package data
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/hellgate75/rebind/log"
+	"github.com/hellgate75/rebind/store"
+	"gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewFileBackend creates a backend keeping the records of each group in a gob
+// file and the groups index in the groups.yaml file of a folder. Files are
+// replaced atomically, see writeDataFile, and the groups index commits the
+// transactions, see Update.
+func NewFileBackend(folder string, logger log.Logger) Backend {
+	b := &fileBackend{
+		folder: folder,
+		log:    logger,
+	}
+	b.removeTempFiles()
+	b.removeStaleRecords()
+	return b
+}
+
+type fileBackend struct {
+	sync.Mutex
+	folder string
+	log    log.Logger
+}
+
+func (b *fileBackend) indexFile() string {
+	return fmt.Sprintf("%s%sgroups.yaml", b.folder, __sepPath)
+}
+
+// recordsFile returns the records file of a generation of a group, generation
+// 0 is the file written before the generations were introduced
+func (b *fileBackend) recordsFile(group Group, generation uint64) string {
+	file := group.File
+	if file == "" {
+		file = fmt.Sprintf("gob-%s.dat", group.Name)
+	}
+	if generation > 0 {
+		file = fmt.Sprintf("%s.%d", file, generation)
+	}
+	return fmt.Sprintf("%s%s%s", b.folder, __sepPath, file)
+}
+
+func (b *fileBackend) Exists() bool {
+	return dataFileExists(b.indexFile())
+}
+
+func (b *fileBackend) ListGroups() (map[string]Group, error) {
+	b.Lock()
+	defer b.Unlock()
+	index, err := b.readIndex()
+	return index.Groups, err
+}
+
+// readIndex reads the groups index, empty when it was never saved
+func (b *fileBackend) readIndex() (groupBucketPersitence, error) {
+	fileName := b.indexFile()
+	var bucket groupBucketPersitence
+	if dataFileExists(fileName) {
+		err := b.loadDataFile(fileName, func(content []byte) error {
+			bucket = groupBucketPersitence{}
+			return yaml.Unmarshal(content, &bucket)
+		})
+		if err != nil {
+			return bucket, err
+		}
+	}
+	if bucket.Groups == nil {
+		bucket.Groups = make(map[string]Group)
+	}
+	if bucket.Generations == nil {
+		bucket.Generations = make(map[string]uint64)
+	}
+	return bucket, nil
+}
+
+func (b *fileBackend) GetGroup(groupName string) (Group, error) {
+	groups, err := b.ListGroups()
+	if err != nil {
+		return Group{}, err
+	}
+	if group, ok := groups[groupName]; ok {
+		return group, nil
+	}
+	return Group{}, groupNotFound(groupName)
+}
+
+func (b *fileBackend) GetRecords(group Group) (store.GroupStorePersistent, error) {
+	b.Lock()
+	defer b.Unlock()
+	var records store.GroupStorePersistent
+	// the committed generation is in the index, which another process may have saved
+	index, err := b.readIndex()
+	if err != nil {
+		return records, err
+	}
+	generation := index.Generations[group.Name]
+	fileName := b.recordsFile(group, generation)
+	decode := func(content []byte) error {
+		records = store.GroupStorePersistent{}
+		return gob.NewDecoder(bytes.NewReader(content)).Decode(&records)
+	}
+	if dataFileExists(fileName) {
+		if err = b.loadDataFile(fileName, decode); err == nil || generation == 0 {
+			return records, err
+		}
+	} else if generation == 0 {
+		return records, errors.New(fmt.Sprintf("Error loading group groupStore file at: %s, File doesn't exist", fileName))
+	}
+	// the previous generation is the backup of the records
+	previous := b.recordsFile(group, generation-1)
+	if pErr := b.loadDataFile(previous, decode); pErr != nil {
+		if err == nil {
+			err = errors.New(fmt.Sprintf("Error loading group groupStore file at: %s, File doesn't exist", fileName))
+		}
+		return records, err
+	}
+	if b.log != nil {
+		b.log.Warnf("GroupsBucket:: [WARN] Data file %s not readable (Error: %v), recovered from previous generation %s", fileName, err, previous)
+	} else {
+		fmt.Printf("[WARN ] GroupsBucket:: Data file %s not readable (Error: %v), recovered from previous generation %s\n", fileName, err, previous)
+	}
+	return records, nil
+}
+
+// Update writes the records of the groups to files of a new generation, then
+// the groups index with the new generations: the rename of the index commits
+// the transaction, before it the index refers to the previous files. Files of
+// the older generations and of the deleted groups are removed after the commit,
+// the previous generation is kept for the backup of the index.
+func (b *fileBackend) Update(fn func(tx BackendTx) error) (err error) {
+	b.Lock()
+	defer b.Unlock()
+	tx := &fileTx{
+		b:       b,
+		puts:    make(map[string]filePut),
+		drops:   make(map[string]bool),
+		deletes: make(map[string]bool),
+	}
+	if err = fn(tx); err != nil {
+		return err
+	}
+	if tx.index == nil {
+		return nil
+	}
+	var written = make([]string, 0)
+	defer func() {
+		if err != nil {
+			// not committed, the index refers to the previous files
+			for _, fileName := range written {
+				_ = removeDataFile(fileName)
+			}
+		}
+	}()
+	for groupName, put := range tx.puts {
+		fileName := b.recordsFile(put.group, put.generation)
+		if err = writeDataFile(fileName, put.content, false); err != nil {
+			return err
+		}
+		written = append(written, fileName)
+		tx.index.Generations[groupName] = put.generation
+		if put.generation > 1 {
+			tx.deletes[b.recordsFile(put.group, put.generation-2)] = true
+		}
+	}
+	for groupName := range tx.drops {
+		delete(tx.index.Generations, groupName)
+	}
+	arr, err := yaml.Marshal(tx.index)
+	if err != nil {
+		return err
+	}
+	// a failure from here may follow the rename, the new files are left to removeStaleRecords
+	written = nil
+	if err = writeDataFile(b.indexFile(), arr, true); err != nil {
+		return err
+	}
+	for _, put := range tx.puts {
+		delete(tx.deletes, b.recordsFile(put.group, put.generation))
+	}
+	for fileName := range tx.deletes {
+		if rErr := removeDataFile(fileName); rErr != nil && b.log != nil {
+			// left to removeStaleRecords
+			b.log.Warnf("GroupsBucket:: [WARN] Unable to remove data file %s, Error: %v", fileName, rErr)
+		}
+	}
+	return nil
+}
+
+func (b *fileBackend) Close() error {
+	return nil
+}
+
+// removeStaleRecords removes the records files not referred by the groups index,
+// left by a crash during a transaction or before the removal of the old files
+func (b *fileBackend) removeStaleRecords() {
+	if !b.Exists() {
+		return
+	}
+	index, err := b.readIndex()
+	if err != nil {
+		return
+	}
+	var referred = make(map[string]bool)
+	for name, group := range index.Groups {
+		generation := index.Generations[name]
+		referred[b.recordsFile(group, generation)] = true
+		if generation > 0 {
+			referred[b.recordsFile(group, generation-1)] = true
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(b.folder, "*.dat.*"))
+	for _, file := range files {
+		if strings.Contains(file, TEMP_FILE_SUFFIX) || strings.HasSuffix(file, BACKUP_FILE_SUFFIX) ||
+			referred[strings.TrimSuffix(file, BACKUP_FILE_SUFFIX)] {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil || time.Since(info.ModTime()) < STALE_TEMP_FILE_AGE {
+			// may be written by another process sharing the folder
+			continue
+		}
+		if err = removeDataFile(file); err == nil && b.log != nil {
+			b.log.Warnf("GroupsBucket:: [WARN] Removed stale data file %s", file)
+		}
+	}
+}
+
+// filePut is the records file of a new generation of a group
+type filePut struct {
+	group      Group
+	generation uint64
+	content    []byte
+}
+
+// fileTx collects the files to write, the groups index is read on the first change
+type fileTx struct {
+	b       *fileBackend
+	index   *groupBucketPersitence
+	puts    map[string]filePut
+	drops   map[string]bool
+	deletes map[string]bool
+}
+
+func (tx *fileTx) readIndex() (*groupBucketPersitence, error) {
+	if tx.index == nil {
+		index, err := tx.b.readIndex()
+		if err != nil {
+			return nil, err
+		}
+		tx.index = &index
+	}
+	return tx.index, nil
+}
+
+func (tx *fileTx) PutGroup(group Group) error {
+	index, err := tx.readIndex()
+	if err != nil {
+		return err
+	}
+	index.Groups[group.Name] = group
+	return nil
+}
+
+func (tx *fileTx) DeleteGroup(groupName string) error {
+	index, err := tx.readIndex()
+	if err != nil {
+		return err
+	}
+	if group, ok := index.Groups[groupName]; ok {
+		delete(index.Groups, groupName)
+		return tx.DeleteRecords(group)
+	}
+	return nil
+}
+
+func (tx *fileTx) PutRecords(group Group, records store.GroupStorePersistent) error {
+	index, err := tx.readIndex()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&records); err != nil {
+		return err
+	}
+	delete(tx.drops, group.Name)
+	tx.puts[group.Name] = filePut{
+		group:      group,
+		generation: index.Generations[group.Name] + 1,
+		content:    buf.Bytes(),
+	}
+	return nil
+}
+
+func (tx *fileTx) DeleteRecords(group Group) error {
+	index, err := tx.readIndex()
+	if err != nil {
+		return err
+	}
+	delete(tx.puts, group.Name)
+	// the generation is dropped at the commit, unless new records follow
+	tx.drops[group.Name] = true
+	generation := index.Generations[group.Name]
+	tx.deletes[tx.b.recordsFile(group, 0)] = true
+	if generation > 0 {
+		tx.deletes[tx.b.recordsFile(group, generation)] = true
+		tx.deletes[tx.b.recordsFile(group, generation-1)] = true
+	}
+	return nil
+}
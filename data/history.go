@@ -0,0 +1,295 @@
+package data
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/hellgate75/rebind/log"
+	"github.com/hellgate75/rebind/store"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type HistoryOp string
+
+const (
+	// Record added to a host name
+	HistorySetOp HistoryOp = "set"
+	// Records of a host name replaced
+	HistoryReplaceOp HistoryOp = "replace"
+	// Records removed from a host name
+	HistoryRemoveOp HistoryOp = "remove"
+	// Records of a group changed through the Rest services
+	HistoryUpdateOp HistoryOp = "update"
+	// Records of a group changed by a batch of operations
+	HistoryBatchOp HistoryOp = "batch"
+	// Records of a group rolled back to a previous version
+	HistoryRollbackOp HistoryOp = "rollback"
+	// Records of a group restored by a point-in-time recovery
+	HistoryRecoverOp HistoryOp = "recover"
+)
+
+// History files folder, in the data folder
+const HISTORY_FOLDER = "history"
+
+// Actor of the changes not requested by a client
+const SYSTEM_ACTOR = "system"
+
+const historySuffix = ".history"
+
+// RecordChange is the change of the records of a host name, no records before
+// when they were added and no records after when they were removed
+type RecordChange struct {
+	Key    string            `yaml:"key" json:"key" xml:"key"`
+	Before []store.DNSRecord `yaml:"before,omitempty" json:"before,omitempty" xml:"before,omitempty"`
+	After  []store.DNSRecord `yaml:"after,omitempty" json:"after,omitempty" xml:"after,omitempty"`
+}
+
+// HistoryEntry is a version of the records of a group, with the changes from the previous one
+type HistoryEntry struct {
+	Version uint64         `yaml:"version" json:"version" xml:"version"`
+	Time    time.Time      `yaml:"time" json:"time" xml:"time"`
+	Actor   string         `yaml:"actor" json:"actor" xml:"actor"`
+	Op      HistoryOp      `yaml:"operation" json:"operation" xml:"operation"`
+	Changes []RecordChange `yaml:"changes" json:"changes" xml:"changes"`
+}
+
+// History keeps the versions of the records of the groups, a file per group
+// where the entries are appended with their length and checksum
+type History struct {
+	sync.Mutex
+	folder   string
+	log      log.Logger
+	versions map[string]uint64
+}
+
+// NewHistory creates the history of the groups kept in a folder
+func NewHistory(folder string, logger log.Logger) *History {
+	return &History{
+		folder:   folder,
+		log:      logger,
+		versions: make(map[string]uint64),
+	}
+}
+
+func (h *History) fileName(groupName string) string {
+	return filepath.Join(h.folder, groupName+historySuffix)
+}
+
+// Append records a new version of a group, numbering and dating the entry
+func (h *History) Append(groupName string, entry *HistoryEntry) error {
+	h.Lock()
+	defer h.Unlock()
+	version, err := h.lastVersion(groupName)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(h.folder, 0755); err != nil {
+		return err
+	}
+	entry.Version = version + 1
+	entry.Time = time.Now()
+	frame, err := encodeFrame(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(h.fileName(groupName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.Write(frame); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	h.versions[groupName] = entry.Version
+	return nil
+}
+
+// List returns the versions of a group, oldest first
+func (h *History) List(groupName string) ([]HistoryEntry, error) {
+	h.Lock()
+	defer h.Unlock()
+	entries, _, err := h.read(groupName)
+	if err == ErrTornWrite {
+		// cut from the history at the next version
+		err = nil
+	}
+	return entries, err
+}
+
+// StateAt returns the records of a group at a version, undoing on the current
+// records the changes of the following versions. Version 0 is the state before
+// the first recorded change.
+func (h *History) StateAt(groupName string, current map[string][]store.DNSRecord, version uint64) (map[string][]store.DNSRecord, error) {
+	entries, err := h.List(groupName)
+	if err != nil {
+		return nil, err
+	}
+	var last uint64
+	if len(entries) > 0 {
+		last = entries[len(entries)-1].Version
+	}
+	if version > last {
+		return nil, errors.New(fmt.Sprintf("Unknown version %d of group %s, last version is %d", version, groupName, last))
+	}
+	var state = make(map[string][]store.DNSRecord)
+	for key, recs := range current {
+		state[key] = recs
+	}
+	for idx := len(entries) - 1; idx >= 0 && entries[idx].Version > version; idx-- {
+		for _, change := range entries[idx].Changes {
+			if len(change.Before) == 0 {
+				delete(state, change.Key)
+			} else {
+				state[change.Key] = change.Before
+			}
+		}
+	}
+	return state, nil
+}
+
+// Archive moves apart the history of a deleted group, so that a new group with
+// the same name starts a new history
+func (h *History) Archive(groupName string) error {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.versions, groupName)
+	fileName := h.fileName(groupName)
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return nil
+	}
+	return os.Rename(fileName, fmt.Sprintf("%s.%d", fileName, time.Now().UnixNano()))
+}
+
+// RecordStates records for each group the changes between two states of the
+// groups records, archiving the history of the groups no longer existing
+func (h *History) RecordStates(actor string, op HistoryOp, before map[string]store.GroupStorePersistent, after map[string]store.GroupStorePersistent) error {
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			if err := h.Archive(name); err != nil {
+				return err
+			}
+		}
+	}
+	for name, persistent := range after {
+		changes := DiffRecords(before[name].Store, persistent.Store)
+		if len(changes) == 0 {
+			continue
+		}
+		if err := h.Append(name, &HistoryEntry{Actor: actor, Op: op, Changes: changes}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastVersion returns the last version of a group, cutting an incomplete entry
+// from the end of its history
+func (h *History) lastVersion(groupName string) (uint64, error) {
+	if version, ok := h.versions[groupName]; ok {
+		return version, nil
+	}
+	entries, end, err := h.read(groupName)
+	if err == ErrTornWrite {
+		if h.log != nil {
+			h.log.Warnf("History:: [WARN] Incomplete entry cut from history of group %s", groupName)
+		}
+		err = os.Truncate(h.fileName(groupName), end)
+	}
+	if err != nil {
+		return 0, err
+	}
+	var version uint64
+	if len(entries) > 0 {
+		version = entries[len(entries)-1].Version
+	}
+	h.versions[groupName] = version
+	return version, nil
+}
+
+// read returns the complete entries of the history of a group and their length,
+// an incomplete entry following them is reported as ErrTornWrite
+func (h *History) read(groupName string) ([]HistoryEntry, int64, error) {
+	var entries = make([]HistoryEntry, 0)
+	end, err := readFrames(h.fileName(groupName), func(content []byte) error {
+		var entry HistoryEntry
+		if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&entry); err != nil {
+			return ErrTornWrite
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return entries, 0, nil
+	}
+	return entries, end, err
+}
+
+// DiffRecords returns the changes between two states of the records of a group,
+// of the given host names or of all of them, sorted by host name
+func DiffRecords(before map[string][]store.DNSRecord, after map[string][]store.DNSRecord, keys ...string) []RecordChange {
+	if len(keys) == 0 {
+		var all = make(map[string]bool)
+		for key := range before {
+			all[key] = true
+		}
+		for key := range after {
+			all[key] = true
+		}
+		for key := range all {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var changes = make([]RecordChange, 0)
+	for _, key := range keys {
+		if !sameRecords(before[key], after[key]) {
+			changes = append(changes, RecordChange{
+				Key:    key,
+				Before: before[key],
+				After:  after[key],
+			})
+		}
+	}
+	return changes
+}
+
+// sameRecords reports whether two lists of records have the same resources and data
+func sameRecords(a []store.DNSRecord, b []store.DNSRecord) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx].Data != b[idx].Data || resourceString(a[idx]) != resourceString(b[idx]) {
+			return false
+		}
+	}
+	return true
+}
+
+func resourceString(rec store.DNSRecord) string {
+	if rec.Resource.Body == nil {
+		return rec.Resource.Header.GoString()
+	}
+	return rec.Resource.GoString()
+}
+
+// Records returns a copy of the records of all the groups
+func (i *GroupsBucket) Records() (map[string]store.GroupStorePersistent, error) {
+	var records = make(map[string]store.GroupStorePersistent)
+	for name, group := range i.Groups {
+		groupStore, err := i.GetGroupStore(group)
+		if err != nil {
+			return nil, err
+		}
+		records[name] = CopyRecords(groupStore.PersistentData())
+	}
+	return records, nil
+}
@@ -0,0 +1,398 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/hellgate75/rebind/log"
+	"github.com/hellgate75/rebind/store"
+	"golang.org/x/net/dns/dnsmessage"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operation of a journal entry
+type JournalOp string
+
+const (
+	// Adds records to a key of a group
+	JournalSetOp JournalOp = "set"
+	// Replaces the records of a key of a group
+	JournalReplaceOp JournalOp = "replace"
+	// Removes the records of a key of a group matching a resource
+	JournalRemoveOp JournalOp = "remove"
+	// Replaces all the records of a group
+	JournalStoreOp JournalOp = "store"
+	// Saves a group
+	JournalPutGroupOp JournalOp = "put-group"
+	// Deletes a group and its records
+	JournalDeleteGroupOp JournalOp = "delete-group"
+)
+
+const (
+	// Folder of the journal in the data folder
+	JOURNAL_FOLDER       = "journal"
+	journalSegmentPrefix = "journal-"
+	journalSegmentSuffix = ".log"
+	snapshotPrefix       = "snapshot-"
+	snapshotSuffix       = ".dat"
+	// Entries are framed by the length and the checksum of their content
+	journalFrameHeaderLen = 8
+)
+
+// JournalEntry is a change of a group or of its records
+type JournalEntry struct {
+	Seq      uint64
+	Time     time.Time
+	Op       JournalOp
+	Group    string
+	Key      string
+	Records  []store.DNSRecord
+	Resource *dnsmessage.Resource
+	Store    *store.GroupStorePersistent
+	Meta     *Group
+}
+
+// Apply applies a records change to a group store, group changes are ignored
+func (e JournalEntry) Apply(groupStore *store.GroupStoreData) {
+	switch e.Op {
+	case JournalSetOp:
+		for _, record := range e.Records {
+			groupStore.Set(e.Key, record)
+		}
+	case JournalReplaceOp:
+		groupStore.Replace(e.Key, append([]store.DNSRecord{}, e.Records...))
+	case JournalRemoveOp:
+		groupStore.RemoveResource(e.Key, e.Resource)
+	case JournalStoreOp:
+		if e.Store != nil {
+			groupStore.FromPersistentData(CopyRecords(*e.Store))
+		}
+	}
+}
+
+// Snapshot is the state of all the groups at a journal sequence
+type Snapshot struct {
+	Seq     uint64
+	Time    time.Time
+	Groups  map[string]Group
+	Records map[string]store.GroupStorePersistent
+}
+
+// Journal is the append-only log of the changes of the groups, in segment files
+// named by the sequence of their first entry. Snapshots of all the groups start
+// new segments, older segments are removed with the snapshots they follow.
+type Journal struct {
+	sync.Mutex
+	folder  string
+	log     log.Logger
+	file    *os.File
+	lastSeq uint64
+	pending int
+}
+
+type journalFile struct {
+	seq  uint64
+	name string
+}
+
+// OpenJournal opens the journal in a folder, created when missing. An entry
+// not completely written by a crash is cut from the last segment.
+func OpenJournal(folder string, logger log.Logger) (*Journal, error) {
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return nil, err
+	}
+	j := &Journal{
+		folder: folder,
+		log:    logger,
+	}
+	segments, err := j.files(journalSegmentPrefix, journalSegmentSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		last := segments[len(segments)-1]
+		j.lastSeq = last.seq - 1
+		end, rErr := readSegment(last.name, func(entry JournalEntry) error {
+			j.lastSeq = entry.Seq
+			return nil
+		})
+		if rErr == ErrTornWrite {
+			if logger != nil {
+				logger.Warnf("Journal:: [WARN] Incomplete entry cut from journal segment %s", last.name)
+			}
+			if err = os.Truncate(last.name, end); err != nil {
+				return nil, err
+			}
+		} else if rErr != nil {
+			return nil, rErr
+		}
+	}
+	snapshots, err := j.files(snapshotPrefix, snapshotSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) > 0 {
+		if snapSeq := snapshots[len(snapshots)-1].seq; snapSeq > j.lastSeq {
+			j.lastSeq = snapSeq
+		} else {
+			j.pending = int(j.lastSeq - snapSeq)
+		}
+	} else {
+		j.pending = int(j.lastSeq)
+	}
+	return j, nil
+}
+
+// LastSeq returns the sequence of the last entry
+func (j *Journal) LastSeq() uint64 {
+	j.Lock()
+	defer j.Unlock()
+	return j.lastSeq
+}
+
+// Pending returns the number of entries since the last snapshot
+func (j *Journal) Pending() int {
+	j.Lock()
+	defer j.Unlock()
+	return j.pending
+}
+
+// Append assigns the next sequence and the time to an entry and appends it,
+// the entry is synced to disk before returning
+func (j *Journal) Append(entry *JournalEntry) error {
+	j.Lock()
+	defer j.Unlock()
+	if j.file == nil {
+		if err := j.openSegment(); err != nil {
+			return err
+		}
+	}
+	entry.Seq = j.lastSeq + 1
+	entry.Time = time.Now()
+	frame, err := encodeFrame(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(frame); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.lastSeq = entry.Seq
+	j.pending++
+	return nil
+}
+
+// Replay calls fn for the entries following a sequence, up to a time when not zero
+func (j *Journal) Replay(afterSeq uint64, until time.Time, fn func(entry JournalEntry) error) error {
+	j.Lock()
+	defer j.Unlock()
+	segments, err := j.files(journalSegmentPrefix, journalSegmentSuffix)
+	if err != nil {
+		return err
+	}
+	for idx, segment := range segments {
+		if idx+1 < len(segments) && segments[idx+1].seq <= afterSeq+1 {
+			// all the entries of the segment precede the next one
+			continue
+		}
+		_, err = readSegment(segment.name, func(entry JournalEntry) error {
+			if entry.Seq <= afterSeq || (!until.IsZero() && entry.Time.After(until)) {
+				return nil
+			}
+			return fn(entry)
+		})
+		if err == ErrTornWrite {
+			if j.log != nil {
+				j.log.Warnf("Journal:: [WARN] Journal segment %s ends with an incomplete entry", segment.name)
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteSnapshot writes a snapshot and starts a new segment, then removes the
+// snapshots exceeding the kept ones and the segments preceding the oldest one
+func (j *Journal) WriteSnapshot(snapshot Snapshot, keep int) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&snapshot); err != nil {
+		return err
+	}
+	j.Lock()
+	defer j.Unlock()
+	fileName := filepath.Join(j.folder, fmt.Sprintf("%s%020d%s", snapshotPrefix, snapshot.Seq, snapshotSuffix))
+	if err := writeDataFile(fileName, buf.Bytes(), false); err != nil {
+		return err
+	}
+	if j.file != nil {
+		_ = j.file.Close()
+		j.file = nil
+	}
+	if err := j.openSegment(); err != nil {
+		return err
+	}
+	j.pending = int(j.lastSeq - snapshot.Seq)
+	if keep < 1 {
+		keep = 1
+	}
+	snapshots, err := j.files(snapshotPrefix, snapshotSuffix)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) <= keep {
+		return nil
+	}
+	for _, old := range snapshots[:len(snapshots)-keep] {
+		if err := os.Remove(old.name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	oldest := snapshots[len(snapshots)-keep].seq
+	segments, err := j.files(journalSegmentPrefix, journalSegmentSuffix)
+	if err != nil {
+		return err
+	}
+	for idx := 0; idx+1 < len(segments) && segments[idx+1].seq <= oldest+1; idx++ {
+		if err := os.Remove(segments[idx].name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// SnapshotAt returns the last snapshot taken at or before a time
+func (j *Journal) SnapshotAt(t time.Time) (Snapshot, error) {
+	j.Lock()
+	defer j.Unlock()
+	snapshots, err := j.files(snapshotPrefix, snapshotSuffix)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	for idx := len(snapshots) - 1; idx >= 0; idx-- {
+		content, err := readDataFile(snapshots[idx].name)
+		if err != nil {
+			return Snapshot{}, err
+		}
+		var snapshot Snapshot
+		if err = gob.NewDecoder(bytes.NewReader(content)).Decode(&snapshot); err != nil {
+			return Snapshot{}, err
+		}
+		if !snapshot.Time.After(t) {
+			return snapshot, nil
+		}
+	}
+	return Snapshot{}, errors.New(fmt.Sprintf("No journal snapshot taken before: %s", t.Format(time.RFC3339)))
+}
+
+// Close closes the current segment
+func (j *Journal) Close() error {
+	j.Lock()
+	defer j.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// openSegment opens for appending the segment starting after the last entry
+func (j *Journal) openSegment() error {
+	fileName := filepath.Join(j.folder, fmt.Sprintf("%s%020d%s", journalSegmentPrefix, j.lastSeq+1, journalSegmentSuffix))
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if err = syncDir(j.folder); err != nil {
+		_ = f.Close()
+		return err
+	}
+	j.file = f
+	return nil
+}
+
+// files lists the journal files of a kind, ordered by sequence
+func (j *Journal) files(prefix, suffix string) ([]journalFile, error) {
+	names, err := filepath.Glob(filepath.Join(j.folder, prefix+"*"+suffix))
+	if err != nil {
+		return nil, err
+	}
+	var files = make([]journalFile, 0)
+	for _, name := range names {
+		base := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), prefix), suffix)
+		seq, err := strconv.ParseUint(base, 10, 64)
+		if err != nil {
+			continue
+		}
+		files = append(files, journalFile{seq: seq, name: name})
+	}
+	sort.Slice(files, func(a, b int) bool {
+		return files[a].seq < files[b].seq
+	})
+	return files, nil
+}
+
+// readSegment calls fn for the entries of a segment, returning the length of
+// the complete entries and ErrTornWrite when an incomplete entry follows them
+func readSegment(fileName string, fn func(entry JournalEntry) error) (int64, error) {
+	return readFrames(fileName, func(content []byte) error {
+		var entry JournalEntry
+		if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&entry); err != nil {
+			return ErrTornWrite
+		}
+		return fn(entry)
+	})
+}
+
+// encodeFrame gob encodes a value preceded by the length and the checksum of its content
+func encodeFrame(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, journalFrameHeaderLen))
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	frame := buf.Bytes()
+	content := frame[journalFrameHeaderLen:]
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(content)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(content))
+	return frame, nil
+}
+
+// readFrames calls fn for the content of the frames of a file, returning the
+// length of the complete frames and ErrTornWrite when an incomplete frame follows them
+func readFrames(fileName string, fn func(content []byte) error) (int64, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+	var offset int
+	for offset < len(content) {
+		if len(content)-offset < journalFrameHeaderLen {
+			return int64(offset), ErrTornWrite
+		}
+		length := int(binary.BigEndian.Uint32(content[offset : offset+4]))
+		sum := binary.BigEndian.Uint32(content[offset+4 : offset+8])
+		start := offset + journalFrameHeaderLen
+		if length > len(content)-start || crc32.ChecksumIEEE(content[start:start+length]) != sum {
+			return int64(offset), ErrTornWrite
+		}
+		if err = fn(content[start : start+length]); err != nil {
+			return int64(offset), err
+		}
+		offset = start + length
+	}
+	return int64(offset), nil
+}
@@ -0,0 +1,257 @@
+package data
+
+import (
+	"errors"
+	"github.com/hellgate75/rebind/store"
+	"time"
+)
+
+// UseJournal journals the changes of the groups: group stores changed through
+// SaveGroupChange are saved at the next snapshot, and the journal entries
+// following the saved ones are replayed when a group store is loaded
+func (i *GroupsBucket) UseJournal(journal *Journal) {
+	i.journal = journal
+}
+
+// PendingChanges returns the number of journal entries since the last snapshot
+func (i *GroupsBucket) PendingChanges() int {
+	if i.journal == nil {
+		return 0
+	}
+	return i.journal.Pending()
+}
+
+// SaveGroupChange persists a change of a group store, described by a journal
+// entry: with a journal the entry is appended to it and the group store is
+// saved at the next snapshot, otherwise the group store is saved right away
+func (i *GroupsBucket) SaveGroupChange(groupStore *store.GroupStoreData, group Group, entry JournalEntry) (Group, error) {
+	if i.journal == nil {
+		return i.saveGroup(groupStore, group)
+	}
+	entry.Group = group.Name
+	if err := i.journal.Append(&entry); err != nil {
+		return group, err
+	}
+	i.storeMutex.Lock()
+	if i.stores == nil {
+		i.stores = make(map[string]GroupBlock)
+	}
+	i.stores[group.Name] = GroupBlock{
+		Group: group,
+		Data:  store.NewGroupStoreData(groupStore.PersistentData()),
+	}
+	i.storeMutex.Unlock()
+	i.setDirty(group.Name, true)
+	return group, nil
+}
+
+// LogGroupChange journals a change of a group, for point-in-time recovery
+func (i *GroupsBucket) LogGroupChange(group Group) error {
+	if i.journal == nil {
+		return nil
+	}
+	return i.journal.Append(&JournalEntry{
+		Op:    JournalPutGroupOp,
+		Group: group.Name,
+		Meta:  &group,
+	})
+}
+
+// Snapshot saves the group stores changed since the last snapshot and writes a
+// snapshot of all the groups to the journal, keeping the given number of snapshots
+func (i *GroupsBucket) Snapshot(keep int) error {
+	if i.journal == nil {
+		return nil
+	}
+	var groups = make(map[string]Group)
+	var records = make(map[string]store.GroupStorePersistent)
+	for name, group := range i.Groups {
+		// loading replays the pending entries of the group
+		groupStore, err := i.GetGroupStore(group)
+		if err != nil {
+			return err
+		}
+		groups[name] = group
+		records[name] = CopyRecords(groupStore.PersistentData())
+	}
+	for _, name := range i.dirtyGroups() {
+		group, ok := groups[name]
+		if !ok {
+			i.setDirty(name, false)
+			continue
+		}
+		groupStore := store.NewGroupStoreData(records[name])
+		if _, err := i.saveGroup(&groupStore, group); err != nil {
+			return err
+		}
+	}
+	return i.journal.WriteSnapshot(Snapshot{
+		Seq:     i.journal.LastSeq(),
+		Time:    time.Now(),
+		Groups:  groups,
+		Records: records,
+	}, keep)
+}
+
+// RecoverTo restores the groups and their records as they were at a time, from
+// the last snapshot taken before it and the journal entries up to it. The
+// recovery is journaled too and followed by a new snapshot.
+func (i *GroupsBucket) RecoverTo(t time.Time, keep int) error {
+	if i.journal == nil {
+		return errors.New("Point-in-time recovery requires the journal")
+	}
+	snapshot, err := i.journal.SnapshotAt(t)
+	if err != nil {
+		return err
+	}
+	var groups = make(map[string]Group)
+	for name, group := range snapshot.Groups {
+		groups[name] = group
+	}
+	var stores = make(map[string]*store.GroupStoreData)
+	for name, records := range snapshot.Records {
+		groupStore := store.NewGroupStoreData(CopyRecords(records))
+		stores[name] = &groupStore
+	}
+	err = i.journal.Replay(snapshot.Seq, t, func(entry JournalEntry) error {
+		switch entry.Op {
+		case JournalPutGroupOp:
+			if entry.Meta != nil {
+				groups[entry.Group] = *entry.Meta
+				if _, ok := stores[entry.Group]; !ok {
+					groupStore := store.NewGroupStoreData(store.GroupStorePersistent{
+						GroupName:  entry.Meta.Name,
+						Domains:    entry.Meta.Domains,
+						Forwarders: entry.Meta.Forwarders,
+					})
+					stores[entry.Group] = &groupStore
+				}
+			}
+		case JournalDeleteGroupOp:
+			delete(groups, entry.Group)
+			delete(stores, entry.Group)
+		default:
+			if groupStore, ok := stores[entry.Group]; ok {
+				entry.Apply(groupStore)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	current, err := i.storage().ListGroups()
+	if err != nil {
+		return err
+	}
+	for name := range current {
+		if _, ok := groups[name]; !ok {
+			if err = i.journal.Append(&JournalEntry{Op: JournalDeleteGroupOp, Group: name}); err != nil {
+				return err
+			}
+		}
+	}
+	var records = make(map[string]store.GroupStorePersistent)
+	for name, group := range groups {
+		var persistent store.GroupStorePersistent
+		if groupStore, ok := stores[name]; ok {
+			persistent = CopyRecords(groupStore.PersistentData())
+		} else {
+			persistent = CopyRecords(store.GroupStorePersistent{GroupName: name})
+		}
+		group.NumRecs = countPersistentRecords(persistent)
+		groups[name] = group
+		if err = i.LogGroupChange(group); err != nil {
+			return err
+		}
+		if err = i.journal.Append(&JournalEntry{Op: JournalStoreOp, Group: name, Store: &persistent}); err != nil {
+			return err
+		}
+		records[name] = persistent
+	}
+	seq := i.journal.LastSeq()
+	err = i.storage().Update(func(tx BackendTx) error {
+		for name := range current {
+			if _, ok := groups[name]; !ok {
+				if err := tx.DeleteGroup(name); err != nil {
+					return err
+				}
+			}
+		}
+		for name, group := range groups {
+			persistent := records[name]
+			persistent.JournalSeq = seq
+			if err := tx.PutRecords(group, persistent); err != nil {
+				return err
+			}
+			if err := tx.PutGroup(group); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	i.Groups = groups
+	i.InvalidateAll()
+	for _, name := range i.dirtyGroups() {
+		i.setDirty(name, false)
+	}
+	return i.Snapshot(keep)
+}
+
+// replayJournal applies to a group store loaded from the backend the journal
+// entries following the ones included in it, returns whether any was applied
+func (i *GroupsBucket) replayJournal(groupStore *store.GroupStoreData, group Group, afterSeq uint64) (bool, error) {
+	applied := false
+	err := i.journal.Replay(afterSeq, time.Time{}, func(entry JournalEntry) error {
+		if entry.Group != group.Name || entry.Op == JournalPutGroupOp || entry.Op == JournalDeleteGroupOp {
+			return nil
+		}
+		entry.Apply(groupStore)
+		applied = true
+		return nil
+	})
+	return applied, err
+}
+
+// journalSeq returns the sequence of the last journal entry, zero without journal
+func (i *GroupsBucket) journalSeq() uint64 {
+	if i.journal == nil {
+		return 0
+	}
+	return i.journal.LastSeq()
+}
+
+func (i *GroupsBucket) setDirty(groupName string, dirty bool) {
+	i.dirtyMutex.Lock()
+	defer i.dirtyMutex.Unlock()
+	if i.dirty == nil {
+		i.dirty = make(map[string]bool)
+	}
+	if dirty {
+		i.dirty[groupName] = true
+	} else {
+		delete(i.dirty, groupName)
+	}
+}
+
+func (i *GroupsBucket) dirtyGroups() []string {
+	i.dirtyMutex.Lock()
+	defer i.dirtyMutex.Unlock()
+	var names = make([]string, 0)
+	for name := range i.dirty {
+		names = append(names, name)
+	}
+	return names
+}
+
+// countPersistentRecords returns the number of records of a group store
+func countPersistentRecords(persistent store.GroupStorePersistent) int64 {
+	var numRecs int64
+	for _, recs := range persistent.Store {
+		numRecs += int64(len(recs))
+	}
+	return numRecs
+}
@@ -0,0 +1,111 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hellgate75/rebind/store"
+	"sync"
+)
+
+// NewMemoryBackend creates a backend keeping the data in memory, for tests
+// and throwaway servers
+func NewMemoryBackend() Backend {
+	return &memoryBackend{
+		groups:  make(map[string]Group),
+		records: make(map[string]store.GroupStorePersistent),
+	}
+}
+
+type memoryBackend struct {
+	sync.RWMutex
+	saved   bool
+	groups  map[string]Group
+	records map[string]store.GroupStorePersistent
+}
+
+func (b *memoryBackend) Exists() bool {
+	b.RLock()
+	defer b.RUnlock()
+	return b.saved
+}
+
+func (b *memoryBackend) ListGroups() (map[string]Group, error) {
+	b.RLock()
+	defer b.RUnlock()
+	var groups = make(map[string]Group)
+	for name, group := range b.groups {
+		groups[name] = group
+	}
+	return groups, nil
+}
+
+func (b *memoryBackend) GetGroup(groupName string) (Group, error) {
+	b.RLock()
+	defer b.RUnlock()
+	if group, ok := b.groups[groupName]; ok {
+		return group, nil
+	}
+	return Group{}, groupNotFound(groupName)
+}
+
+func (b *memoryBackend) GetRecords(group Group) (store.GroupStorePersistent, error) {
+	b.RLock()
+	defer b.RUnlock()
+	if records, ok := b.records[group.Name]; ok {
+		return CopyRecords(records), nil
+	}
+	return store.GroupStorePersistent{}, errors.New(fmt.Sprintf("Unable to find records of group: %s", group.Name))
+}
+
+func (b *memoryBackend) Update(fn func(tx BackendTx) error) error {
+	b.Lock()
+	defer b.Unlock()
+	tx := &memoryTx{
+		groups:  make(map[string]Group),
+		records: make(map[string]store.GroupStorePersistent),
+	}
+	for name, group := range b.groups {
+		tx.groups[name] = group
+	}
+	for name, records := range b.records {
+		tx.records[name] = records
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	b.groups = tx.groups
+	b.records = tx.records
+	b.saved = true
+	return nil
+}
+
+func (b *memoryBackend) Close() error {
+	return nil
+}
+
+// memoryTx changes copies of the backend maps, which replace them on commit
+type memoryTx struct {
+	groups  map[string]Group
+	records map[string]store.GroupStorePersistent
+}
+
+func (tx *memoryTx) PutGroup(group Group) error {
+	tx.groups[group.Name] = group
+	return nil
+}
+
+func (tx *memoryTx) DeleteGroup(groupName string) error {
+	delete(tx.groups, groupName)
+	delete(tx.records, groupName)
+	return nil
+}
+
+func (tx *memoryTx) PutRecords(group Group, records store.GroupStorePersistent) error {
+	tx.records[group.Name] = CopyRecords(records)
+	return nil
+}
+
+func (tx *memoryTx) DeleteRecords(group Group) error {
+	delete(tx.records, group.Name)
+	return nil
+}
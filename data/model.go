@@ -3,20 +3,57 @@ package data
 import (
 	"github.com/hellgate75/rebind/log"
 	"net"
+	"strings"
 	"sync"
 )
 
+type ForwardPolicy string
+
+const (
+	// Forwarders are tried in list order, the next one on failure
+	SequentialPolicy ForwardPolicy = "sequential"
+	// Forwarders are tried starting from the next one at each query
+	RoundRobinPolicy ForwardPolicy = "round-robin"
+	// Forwarders are tried in random order
+	RandomPolicy ForwardPolicy = "random"
+	// Forwarders are tried from the fastest one
+	LowestLatencyPolicy ForwardPolicy = "lowest-latency"
+)
+
+// ParseForwardPolicy returns the policy matching the given name, empty name is the sequential policy
+func ParseForwardPolicy(name string) (ForwardPolicy, bool) {
+	switch ForwardPolicy(strings.ToLower(strings.TrimSpace(name))) {
+	case "", SequentialPolicy:
+		return SequentialPolicy, true
+	case RoundRobinPolicy:
+		return RoundRobinPolicy, true
+	case RandomPolicy:
+		return RandomPolicy, true
+	case LowestLatencyPolicy:
+		return LowestLatencyPolicy, true
+	}
+	return SequentialPolicy, false
+}
+
 type Group struct {
 	Name       string        `yaml:"name" json:"name" xml:"name"`
 	File       string        `yaml:"file" json:"file" xml:"file"`
 	NumRecs    int64         `yaml:"numberOfRecords" json:"numberOfRecords" xml:"number-of-records"`
 	Domains    []string      `yaml:"domains,omitempty" json:"domains,omitempty" xml:"domains,omitempty"`
 	Forwarders []net.UDPAddr `yaml:"forwarders,omitempty" json:"forwarders,omitempty" xml:"forwarders,omitempty"`
+	Policy     ForwardPolicy `yaml:"policy,omitempty" json:"policy,omitempty" xml:"policy,omitempty"`
+	ServeStale *bool         `yaml:"serveStale,omitempty" json:"serveStale,omitempty" xml:"serve-stale,omitempty"`
+	Prefetch   *bool         `yaml:"prefetch,omitempty" json:"prefetch,omitempty" xml:"prefetch,omitempty"`
 }
 
 type GroupsBucket struct {
 	sync.Mutex
 	storeMutex sync.Mutex
+	stores     map[string]GroupBlock
+	backend    Backend
+	journal    *Journal
+	dirtyMutex sync.Mutex
+	dirty      map[string]bool
 	log        log.Logger
 	Folder     string           `yaml:"dataFolder" json:"dataFolder" xml:"data-folder"`
 	Groups     map[string]Group `yaml:"groups" json:"groups" xml:"groups"`
@@ -24,12 +61,21 @@ type GroupsBucket struct {
 
 type groupBucketPersitence struct {
 	Groups map[string]Group `yaml:"groups" json:"groups" xml:"groups"`
+	// Current generation of the records file of each group, saved by the file backend
+	Generations map[string]uint64 `yaml:"generations,omitempty" json:"generations,omitempty" xml:"generations,omitempty"`
 }
 
 func NewGroupsBucket(folder string, log log.Logger) GroupsBucket {
+	return NewGroupsBucketWith(folder, NewFileBackend(folder, log), log)
+}
+
+// NewGroupsBucketWith creates a groups bucket persisted by a storage backend
+func NewGroupsBucketWith(folder string, backend Backend, log log.Logger) GroupsBucket {
 	return GroupsBucket{
-		Folder: folder,
-		log:    log,
-		Groups: make(map[string]Group),
+		Folder:  folder,
+		backend: backend,
+		log:     log,
+		Groups:  make(map[string]Group),
+		stores:  make(map[string]GroupBlock),
 	}
 }
@@ -0,0 +1,200 @@
+package data
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	// Suffix of the previous generation of a data file
+	BACKUP_FILE_SUFFIX = ".bak"
+	// Suffix of the data files being written, left only by a crash
+	TEMP_FILE_SUFFIX = ".tmp-"
+	// Age of the temporary files considered left by a crash
+	STALE_TEMP_FILE_AGE = time.Minute
+	// First line of the data files, with the checksum and the length of the content
+	checksumHeader = "# rebind-crc32: "
+)
+
+// Data file content doesn't match its checksum, the file was not completely written
+var ErrTornWrite = errors.New("data file is incomplete or corrupted")
+
+// writeDataFile replaces a data file atomically: the content, preceded by its
+// checksum, goes to a temporary file which is synced and renamed over the data
+// file, then the folder is synced. With backup the previous generation of the
+// data file is kept with BACKUP_FILE_SUFFIX.
+func writeDataFile(fileName string, content []byte, backup bool) error {
+	dir, base := filepath.Split(fileName)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, base+TEMP_FILE_SUFFIX)
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmpName)
+		}
+	}()
+	header := fmt.Sprintf("%s%08x length: %d\n", checksumHeader, crc32.ChecksumIEEE(content), len(content))
+	if _, err = f.WriteString(header); err == nil {
+		_, err = f.Write(content)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(tmpName, 0666); err != nil {
+		return err
+	}
+	if backup {
+		if err = backupDataFile(fileName); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(tmpName, fileName); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// backupDataFile keeps the current generation of a data file as backup, the
+// data file stays in place until the new generation replaces it
+func backupDataFile(fileName string) error {
+	if _, err := os.Stat(fileName); err != nil {
+		return nil
+	}
+	backupName := fileName + BACKUP_FILE_SUFFIX
+	if err := os.Remove(backupName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(fileName, backupName); err != nil {
+		// no hard links on this file system, the loader
+		// reads the backup while the data file is missing
+		return os.Rename(fileName, backupName)
+	}
+	return nil
+}
+
+// syncDir makes the renames in a folder durable
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		// folders can't be opened for syncing
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// readDataFile reads the content of a data file, checking its checksum. Files
+// written before the checksums were introduced are read as they are.
+func readDataFile(fileName string) ([]byte, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, []byte(checksumHeader)) {
+		if len(b) == 0 || strings.HasPrefix(checksumHeader, string(b)) {
+			return nil, ErrTornWrite
+		}
+		return b, nil
+	}
+	end := bytes.IndexByte(b, '\n')
+	if end < 0 {
+		return nil, ErrTornWrite
+	}
+	var sum uint32
+	var length int
+	if _, err = fmt.Sscanf(string(b[len(checksumHeader):end]), "%08x length: %d", &sum, &length); err != nil {
+		return nil, ErrTornWrite
+	}
+	content := b[end+1:]
+	if len(content) != length || crc32.ChecksumIEEE(content) != sum {
+		return nil, ErrTornWrite
+	}
+	return content, nil
+}
+
+// dataFileExists reports whether a data file or its backup exists
+func dataFileExists(fileName string) bool {
+	if _, err := os.Stat(fileName); err == nil {
+		return true
+	}
+	_, err := os.Stat(fileName + BACKUP_FILE_SUFFIX)
+	return err == nil
+}
+
+// removeDataFile removes a data file and its backup
+func removeDataFile(fileName string) error {
+	err := os.Remove(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(fileName + BACKUP_FILE_SUFFIX)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// loadDataFile reads and decodes a data file. When the data file is missing,
+// torn or not decodable it falls back to the backup, which replaces the data file.
+func (b *fileBackend) loadDataFile(fileName string, decode func(content []byte) error) error {
+	content, err := readDataFile(fileName)
+	if err == nil {
+		if err = decode(content); err == nil {
+			return nil
+		}
+	}
+	backupName := fileName + BACKUP_FILE_SUFFIX
+	backupContent, bErr := readDataFile(backupName)
+	if bErr != nil {
+		return err
+	}
+	if bErr = decode(backupContent); bErr != nil {
+		return err
+	}
+	if b.log != nil {
+		b.log.Warnf("GroupsBucket:: [WARN] Data file %s not readable (Error: %v), recovered from backup %s", fileName, err, backupName)
+	} else {
+		fmt.Printf("[WARN ] GroupsBucket:: Data file %s not readable (Error: %v), recovered from backup %s\n", fileName, err, backupName)
+	}
+	if wErr := writeDataFile(fileName, backupContent, false); wErr != nil && b.log != nil {
+		b.log.Errorf("GroupsBucket:: [ERROR] Error restoring data file %s from backup, Error: %v", fileName, wErr)
+	}
+	return nil
+}
+
+// removeTempFiles removes the temporary files left by a crash while saving,
+// recent ones may be written by another process sharing the folder
+func (b *fileBackend) removeTempFiles() {
+	files, _ := filepath.Glob(filepath.Join(b.folder, "*"+TEMP_FILE_SUFFIX+"*"))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil || time.Since(info.ModTime()) < STALE_TEMP_FILE_AGE {
+			continue
+		}
+		if err = os.Remove(file); err == nil && b.log != nil {
+			b.log.Warnf("GroupsBucket:: [WARN] Removed incomplete data file %s", file)
+		}
+	}
+}
@@ -7,8 +7,6 @@ import (
 	"github.com/hellgate75/rebind/store"
 	"github.com/hellgate75/rebind/utils"
 	"golang.org/x/net/dns/dnsmessage"
-	"gopkg.in/yaml.v2"
-	"io/ioutil"
 	"net"
 	"os"
 )
@@ -58,12 +56,11 @@ func (i *GroupsBucket) Load(defaultForwarders []net.UDPAddr) error {
 			err = errors.New(fmt.Sprintf("%v", r))
 		}
 	}()
-	fileName := fmt.Sprintf("%s%sgroups.yaml", i.Folder, __sepPath)
-	if _, err := os.Stat(fileName); err != nil {
+	if !i.storage().Exists() {
 		if i.log != nil {
-			i.log.Infof("Missing default group storage: Creating file: %s", fileName)
+			i.log.Infof("Missing default group storage: Creating default group in folder: %s", i.Folder)
 		} else {
-			fmt.Printf("[info ] Missing default group storage: Creating file: %s\n", fileName)
+			fmt.Printf("[info ] Missing default group storage: Creating default group in folder: %s\n", i.Folder)
 		}
 		_, _, err = i.CreateAndPersistGroupAndStore("default", []string{}, defaultForwarders)
 		if err == nil {
@@ -76,33 +73,31 @@ func (i *GroupsBucket) Load(defaultForwarders []net.UDPAddr) error {
 }
 
 func (i *GroupsBucket) ReLoad() error {
-	fileName := fmt.Sprintf("%s%sgroups.yaml", i.Folder, __sepPath)
-	if _, err := os.Stat(fileName); err != nil {
-		return errors.New(fmt.Sprintf("Unable to find file: %s", fileName))
+	if !i.storage().Exists() {
+		return errors.New(fmt.Sprintf("Unable to find groups in folder: %s", i.Folder))
 	}
-	arr, rErr := ioutil.ReadFile(fileName)
+	groups, rErr := i.storage().ListGroups()
 	if rErr != nil {
 		if i.log != nil {
-			i.log.Errorf("GroupsBucket:: [ERROR] Error reading groups main index at: %s, Error: %v", fileName, rErr)
+			i.log.Errorf("GroupsBucket:: [ERROR] Error reading groups main index in: %s, Error: %v", i.Folder, rErr)
 		} else {
-			fmt.Sprintf("GroupsBucket:: [ERROR] Error reading groups main index at: %s, Error: %v", fileName, rErr)
+			fmt.Printf("[ERROR] GroupsBucket:: Error reading groups main index in: %s, Error: %v\n", i.Folder, rErr)
 		}
 		return rErr
 	}
-	var bucket groupBucketPersitence
-	mErr := yaml.Unmarshal(arr, &bucket)
-	if mErr != nil {
-		if i.log != nil {
-			i.log.Errorf("GroupsBucket:: [ERROR] Error converting groups main index, Error: %v", mErr)
-		} else {
-			fmt.Sprintf("GroupsBucket:: [ERROR] Error converting groups main index, Error: %v", mErr)
-		}
-		return mErr
-	}
-	i.Groups = bucket.Groups
+	i.Groups = groups
+	i.InvalidateAll()
 	return nil
 }
 
+// storage returns the storage backend, the file backend when none was given
+func (i *GroupsBucket) storage() Backend {
+	if i.backend == nil {
+		i.backend = NewFileBackend(i.Folder, i.log)
+	}
+	return i.backend
+}
+
 func (i *GroupsBucket) Contains(group string) bool {
 	if _, ok := i.Groups[utils.ConvertKeyToId(group)]; ok {
 		return true
@@ -122,25 +117,28 @@ func (i *GroupsBucket) CreateAndPersistGroupAndStore(key string, domains []strin
 	groupRef := i.CreateUnboundGroup(key, domains, forwarders)
 	groupStore := store.NewGroupStore(groupRef.Name, domains, forwarders)
 	var gsd = *(groupStore.(*store.GroupStoreData))
-	groupRef, err := i.SaveGroup(gsd, groupRef)
-	if err != nil {
-		if i.log != nil {
-			i.log.Errorf("GroupsBucket:: [ERROR] Error creating and persisting store: %s, Error: %v", key, err)
-		} else {
-			fmt.Sprintf("GroupsBucket:: [ERROR] Error creating and persisting store: %s, Error: %v", key, err)
+	// group and its records are saved together
+	var save = gsd.PersistentData()
+	// journal entries of a deleted group with the same name are not replayed
+	save.JournalSeq = i.journalSeq()
+	err := i.storage().Update(func(tx BackendTx) error {
+		if err := tx.PutRecords(groupRef, save); err != nil {
+			return err
 		}
-		return Group{}, store.GroupStoreData{}, err
-	}
-	i.Groups[groupRef.Name] = groupRef
-	err = i.SaveMeta()
+		return tx.PutGroup(groupRef)
+	})
 	if err != nil {
 		if i.log != nil {
 			i.log.Errorf("GroupsBucket:: [ERROR] Error creating and persisting group: %s, Error: %v", key, err)
 		} else {
-			fmt.Sprintf("GroupsBucket:: [ERROR] Error creating and persisting group: %s, Error: %v", key, err)
+			fmt.Printf("[ERROR] GroupsBucket:: Error creating and persisting group: %s, Error: %v\n", key, err)
 		}
 		return Group{}, store.GroupStoreData{}, err
 	}
+	i.Groups[groupRef.Name] = groupRef
+	if jErr := i.LogGroupChange(groupRef); jErr != nil && i.log != nil {
+		i.log.Errorf("GroupsBucket:: [ERROR] Error journaling group: %s, Error: %v", key, jErr)
+	}
 	return groupRef,
 		gsd,
 		err
@@ -153,39 +151,31 @@ func (i *GroupsBucket) SaveMeta() error {
 			if i.log != nil {
 				i.log.Errorf("GroupsBucket:: [ERROR] Runtime Error saving groups main index, Error: %v", r)
 			} else {
-				fmt.Sprintf("GroupsBucket:: [ERROR] Runtime Error saving groups main index, Error: %v", r)
+				fmt.Printf("[ERROR] GroupsBucket:: Runtime Error saving groups main index, Error: %v\n", r)
 			}
 			err = errors.New(fmt.Sprintf("Runtime Error saving groups main index, Error: %v", r))
 		}
 		i.Unlock()
 	}()
 	i.Lock()
-	persistence := groupBucketPersitence{
-		Groups: i.Groups,
-	}
-	arr, mErr := yaml.Marshal(&persistence)
-	if mErr != nil {
-		if i.log != nil {
-			i.log.Errorf("GroupsBucket:: [ERROR] Error converting groups main index, Error: %v", mErr)
-		} else {
-			fmt.Sprintf("GroupsBucket:: [ERROR] Error converting groups main index, Error: %v", mErr)
+	sErr := i.storage().Update(func(tx BackendTx) error {
+		for _, group := range i.Groups {
+			if err := tx.PutGroup(group); err != nil {
+				return err
+			}
 		}
-		return mErr
-	}
-	fileName := fmt.Sprintf("%s%sgroups.yaml", i.Folder, __sepPath)
-	sErr := ioutil.WriteFile(fileName, arr, 0666)
+		return nil
+	})
 	if sErr != nil {
 		if i.log != nil {
-			i.log.Errorf("GroupsBucket:: [ERROR] Error saving groups main index at: %s, Error: %v", fileName, sErr)
+			i.log.Errorf("GroupsBucket:: [ERROR] Error saving groups main index in: %s, Error: %v", i.Folder, sErr)
 		} else {
-			fmt.Sprintf("GroupsBucket:: [ERROR] Error saving groups main index at: %s, Error: %v", fileName, sErr)
+			fmt.Printf("[ERROR] GroupsBucket:: Error saving groups main index in: %s, Error: %v\n", i.Folder, sErr)
 		}
 		return sErr
 	}
 	if i.log != nil {
-		i.log.Infof("GroupsBucket:: [INFO] Successfully saved groups main index at: %s", fileName)
-	} else {
-		fmt.Sprintf("GroupsBucket:: [INFO] Successfully saved groups main index at: %s", fileName)
+		i.log.Infof("GroupsBucket:: [INFO] Successfully saved groups main index in: %s", i.Folder)
 	}
 	return err
 }
@@ -206,15 +196,19 @@ func (i *GroupsBucket) CreateUnboundGroup(key string, domains []string,
 
 func (i *GroupsBucket) Delete(groupName string) bool {
 	if g, ok := i.Groups[groupName]; ok {
-		fileName := fmt.Sprintf("%s%s%s", i.Folder, __sepPath, g.File)
-		err := os.Remove(fileName)
+		err := i.storage().Update(func(tx BackendTx) error {
+			return tx.DeleteGroup(g.Name)
+		})
 		if err != nil {
 			return false
 		}
 		delete(i.Groups, groupName)
-		err = i.SaveMeta()
-		if err != nil {
-			return false
+		i.Invalidate(groupName)
+		i.setDirty(groupName, false)
+		if i.journal != nil {
+			if err = i.journal.Append(&JournalEntry{Op: JournalDeleteGroupOp, Group: groupName}); err != nil && i.log != nil {
+				i.log.Errorf("GroupsBucket:: [ERROR] Error journaling deletion of group: %s, Error: %v", groupName, err)
+			}
 		}
 	}
 	return true
@@ -256,12 +250,21 @@ type GroupBlock struct {
 	Data  store.GroupStoreData
 }
 
-var cache = make(map[string]GroupBlock)
+// Invalidate drops the loaded store of a group, next access reads it from file
+func (i *GroupsBucket) Invalidate(groupName string) {
+	i.storeMutex.Lock()
+	defer i.storeMutex.Unlock()
+	delete(i.stores, groupName)
+}
+
+// InvalidateAll drops the loaded stores of all groups
+func (i *GroupsBucket) InvalidateAll() {
+	i.storeMutex.Lock()
+	defer i.storeMutex.Unlock()
+	i.stores = make(map[string]GroupBlock)
+}
 
 func (i *GroupsBucket) GetGroupStore(group Group) (store.GroupStoreData, error) {
-	if gs, ok := cache[group.Name]; ok {
-		return gs.Data, nil
-	}
 	var err error
 	defer func() {
 		if r := recover(); r != nil {
@@ -276,42 +279,44 @@ func (i *GroupsBucket) GetGroupStore(group Group) (store.GroupStoreData, error)
 		i.storeMutex.Unlock()
 	}()
 	i.storeMutex.Lock()
-	fileName := fmt.Sprintf("%s%s%s", i.Folder, __sepPath, group.File)
-	if _, err = os.Stat(fileName); err != nil {
-		message := fmt.Sprintf("Error loading group groupStore file at: %s, File doesn't exist", fileName)
-		if i.log != nil {
-			i.log.Errorf("GroupsBucket:: [ERROR]", message)
-		} else {
-			fmt.Sprintf("GroupsBucket:: [ERROR] %s", message)
-		}
-		return store.GroupStoreData{}, errors.New(message)
-	}
-	f, cErr := os.OpenFile(fileName, os.O_RDONLY, 0666)
-	if cErr != nil {
-		if i.log != nil {
-			i.log.Errorf("GroupsBucket:: [ERROR] Error reading group groupStore file at: %s, Error: %v", fileName, cErr)
-		} else {
-			fmt.Sprintf("GroupsBucket:: [ERROR] Error reading group groupStore file at: %s, Error: %v", fileName, cErr)
-		}
-		return store.GroupStoreData{}, cErr
+	if gs, ok := i.stores[group.Name]; ok {
+		return gs.Data, nil
 	}
-	defer f.Close()
 	groupStore := store.GroupStoreData{}
-	var load store.GroupStorePersistent
-	err = gob.NewDecoder(f).Decode(&load)
-	groupStore.FromPersistentData(load)
+	load, err := i.storage().GetRecords(group)
 	if err != nil {
 		if i.log != nil {
-			i.log.Errorf("GroupsBucket:: [ERROR] Error loading group groupStore file at: %s, Error: %v", fileName, err)
+			i.log.Errorf("GroupsBucket:: [ERROR] Error loading group %s store, Error: %v", group.Name, err)
 		} else {
-			fmt.Sprintf("GroupsBucket:: [ERROR] Error loading group groupStore file at: %s, Error: %v", fileName, err)
+			fmt.Printf("[ERROR] GroupsBucket:: Error loading group %s store, Error: %v\n", group.Name, err)
 		}
 		return store.GroupStoreData{}, err
 	}
+	if i.journal != nil {
+		if load.Store == nil {
+			load.Store = make(map[string][]store.DNSRecord)
+		}
+		groupStore.FromPersistentData(load)
+		applied, rErr := i.replayJournal(&groupStore, group, load.JournalSeq)
+		if rErr != nil {
+			if i.log != nil {
+				i.log.Errorf("GroupsBucket:: [ERROR] Error replaying journal of group %s, Error: %v", group.Name, rErr)
+			}
+			return store.GroupStoreData{}, rErr
+		}
+		if applied {
+			i.setDirty(group.Name, true)
+		}
+	} else {
+		groupStore.FromPersistentData(load)
+	}
 	groupStore.Forwarders = group.Forwarders
 	groupStore.Domains = group.Domains
 	groupStore.GroupName = group.Name
-	cache[group.Name] = GroupBlock{
+	if i.stores == nil {
+		i.stores = make(map[string]GroupBlock)
+	}
+	i.stores[group.Name] = GroupBlock{
 		Group: group,
 		Data:  groupStore,
 	}
@@ -351,7 +356,7 @@ func (i *GroupsBucket) SaveGroups(groupsStore store.GroupsStoreData) error {
 				if i.log != nil {
 					i.log.Errorf("GroupsBucket:: [ERROR] Error retriving group groupsStore for key: %s, Error: %v", key, err.Error())
 				} else {
-					fmt.Sprintf("GroupsBucket:: [ERROR] Error retriving group groupsStore for key: %s, Error: %v", key, err.Error())
+					fmt.Printf("[ERROR] GroupsBucket:: Error retriving group groupsStore for key: %s, Error: %v\n", key, err.Error())
 				}
 				return err.Error()
 			}
@@ -360,7 +365,7 @@ func (i *GroupsBucket) SaveGroups(groupsStore store.GroupsStoreData) error {
 				if i.log != nil {
 					i.log.Errorf("GroupsBucket:: [ERROR] Error saving group groupsStore for key: %s, Error: %v", key, err.Error())
 				} else {
-					fmt.Sprintf("GroupsBucket:: [ERROR] Error saving group groupsStore for key: %s, Error: %v", key, err.Error())
+					fmt.Printf("[ERROR] GroupsBucket:: Error saving group groupsStore for key: %s, Error: %v\n", key, err.Error())
 				}
 				return err.Error()
 			}
@@ -369,7 +374,7 @@ func (i *GroupsBucket) SaveGroups(groupsStore store.GroupsStoreData) error {
 			if i.log != nil {
 				i.log.Errorf("GroupsBucket:: [WARN ] Unable to find config for group: %s", key)
 			} else {
-				fmt.Sprintf("GroupsBucket:: [WARN ] Unable to find config for group: %s", key)
+				fmt.Printf("[WARN ] GroupsBucket:: Unable to find config for group: %s\n", key)
 			}
 		}
 	}
@@ -393,6 +398,12 @@ func (i *GroupsBucket) ListGroups() []Group {
 }
 
 func (i *GroupsBucket) SaveGroup(groupStore store.GroupStoreData, group Group) (Group, error) {
+	return i.saveGroup(&groupStore, group)
+}
+
+// saveGroup saves a group store with the sequence of the last journal entry,
+// which the group store includes
+func (i *GroupsBucket) saveGroup(groupStore *store.GroupStoreData, group Group) (Group, error) {
 	var err error
 	//if group == nil {
 	//	return nil, rerrors.New("Unable to save nil group ...")
@@ -415,41 +426,83 @@ func (i *GroupsBucket) SaveGroup(groupStore store.GroupStoreData, group Group) (
 	}()
 	i.Lock()
 	i.storeMutex.Lock()
-	fileName := fmt.Sprintf("%s%s%s", i.Folder, __sepPath, group.File)
-	if _, err = os.Stat(fileName); err == nil {
-		rErr := os.Remove(fileName)
-		if rErr != nil {
-			if i.log != nil {
-				i.log.Errorf("GroupsBucket:: [ERROR] Error saving removing old group file at: %s, Error: %v", fileName, rErr)
-			} else {
-				fmt.Sprintf("GroupsBucket:: [ERROR] Error saving removing old group file at: %s, Error: %v", fileName, rErr)
-			}
-			return Group{}, rErr
-		}
-	}
-	f, err := os.OpenFile(fileName, os.O_RDWR+os.O_CREATE, 0666)
+	var save = groupStore.PersistentData()
+	save.JournalSeq = i.journalSeq()
+	err = i.storage().Update(func(tx BackendTx) error {
+		return tx.PutRecords(group, save)
+	})
 	if err != nil {
 		if i.log != nil {
-			i.log.Errorf("GroupsBucket:: [ERROR] Error creating new group file at: %s, Error: %v", fileName, err)
+			i.log.Errorf("GroupsBucket:: [ERROR] Error saving group %s store, Error: %v", group.Name, err)
 		} else {
-			fmt.Sprintf("GroupsBucket:: [ERROR] Error creating new group file at: %s, Error: %v", fileName, err)
+			fmt.Printf("[ERROR] GroupsBucket:: Error saving group %s store, Error: %v\n", group.Name, err)
 		}
 		return Group{}, err
 	}
-	defer f.Close()
+	if i.stores == nil {
+		i.stores = make(map[string]GroupBlock)
+	}
+	i.stores[group.Name] = GroupBlock{
+		Group: group,
+		Data:  store.NewGroupStoreData(save),
+	}
+	i.setDirty(group.Name, false)
+	return group, err
+}
+
+// SaveGroupAndStore saves an existing group and its store in a single backend
+// transaction, both or none of them are saved. With a journal the change is
+// journaled after it, for point-in-time recovery: replaying it again is
+// harmless, it carries the whole group store.
+func (i *GroupsBucket) SaveGroupAndStore(groupStore *store.GroupStoreData, group Group) (Group, error) {
+	var err error
+	defer func() {
+		if r := recover(); r != nil {
+			message := fmt.Sprintf("Runtime Error saving group and store, Error: %v", r)
+			if i.log != nil {
+				i.log.Errorf("GroupsBucket:: [ERROR] %s", message)
+			}
+			err = errors.New(message)
+		}
+		i.Unlock()
+		i.storeMutex.Unlock()
+	}()
+	i.Lock()
+	i.storeMutex.Lock()
+	if _, ok := i.Groups[group.Name]; !ok {
+		return group, groupNotFound(group.Name)
+	}
 	var save = groupStore.PersistentData()
-	err = gob.NewEncoder(f).Encode(&save)
+	save.JournalSeq = i.journalSeq()
+	err = i.storage().Update(func(tx BackendTx) error {
+		if err := tx.PutRecords(group, save); err != nil {
+			return err
+		}
+		return tx.PutGroup(group)
+	})
 	if err != nil {
 		if i.log != nil {
-			i.log.Errorf("GroupsBucket:: [ERROR] Error saving new group file at: %s, Error: %v", fileName, err)
-		} else {
-			fmt.Sprintf("GroupsBucket:: [ERROR] Error saving new group file at: %s, Error: %v", fileName, err)
+			i.log.Errorf("GroupsBucket:: [ERROR] Error saving group %s and its store, Error: %v", group.Name, err)
 		}
-		return Group{}, err
+		return group, err
 	}
-	cache[group.Name] = GroupBlock{
+	i.Groups[group.Name] = group
+	if i.stores == nil {
+		i.stores = make(map[string]GroupBlock)
+	}
+	i.stores[group.Name] = GroupBlock{
 		Group: group,
-		Data:  groupStore,
+		Data:  store.NewGroupStoreData(save),
+	}
+	i.setDirty(group.Name, false)
+	if i.journal != nil {
+		jErr := i.LogGroupChange(group)
+		if jErr == nil {
+			jErr = i.journal.Append(&JournalEntry{Op: JournalStoreOp, Group: group.Name, Store: &save})
+		}
+		if jErr != nil && i.log != nil {
+			i.log.Errorf("GroupsBucket:: [ERROR] Error journaling group %s and its store, Error: %v", group.Name, jErr)
+		}
 	}
 	return group, err
 }
@@ -0,0 +1,688 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hellgate75/rebind/data"
+	"github.com/hellgate75/rebind/store"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Scenario checks a behavior in a temporary data folder
+type scenario struct {
+	name string
+	run  func(folder string) error
+}
+
+// Storage backends contract, crash recovery of the file backend, journal replay,
+// compaction and point-in-time recovery. Exits with status 1 when a scenario fails.
+func main() {
+	var scenarios = make([]scenario, 0)
+	for _, backendType := range []data.BackendType{data.MemoryBackend, data.FileBackend, data.BoltBackend} {
+		backendType := backendType
+		scenarios = append(scenarios,
+			scenario{fmt.Sprintf("%s backend saves groups and records", backendType), func(folder string) error {
+				return backendSaves(backendType, folder)
+			}},
+			scenario{fmt.Sprintf("%s backend discards failed transactions", backendType), func(folder string) error {
+				return backendDiscards(backendType, folder)
+			}},
+			scenario{fmt.Sprintf("%s backend deletes groups", backendType), func(folder string) error {
+				return backendDeletes(backendType, folder)
+			}},
+		)
+		if backendType != data.MemoryBackend {
+			scenarios = append(scenarios, scenario{fmt.Sprintf("%s backend keeps the data on reopen", backendType), func(folder string) error {
+				return backendReopens(backendType, folder)
+			}})
+		}
+	}
+	scenarios = append(scenarios,
+		scenario{"file backend commits with the groups index", fileCommitsWithIndex},
+		scenario{"file backend ignores and removes uncommitted records", fileIgnoresUncommitted},
+		scenario{"file backend recovers torn records files", fileRecoversTornRecords},
+		scenario{"file backend recovers the groups index from backup", fileRecoversIndexBackup},
+		scenario{"journal cuts a torn tail on open", journalCutsTornTail},
+		scenario{"journal replays the entries following a sequence", journalReplays},
+		scenario{"journal snapshots remove old snapshots and segments", journalCompacts},
+		scenario{"groups bucket recovers to a point in time", bucketRecoversTo},
+	)
+	failed := 0
+	for _, s := range scenarios {
+		folder, err := ioutil.TempDir("", "rebind-data-test")
+		if err == nil {
+			err = s.run(folder)
+			_ = os.RemoveAll(folder)
+		}
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", s.name, err)
+		} else {
+			fmt.Printf("PASS %s\n", s.name)
+		}
+	}
+	fmt.Printf("%d scenarios, %d failed\n", len(scenarios), failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func group(name string) data.Group {
+	return data.Group{
+		Name:    name,
+		File:    fmt.Sprintf("gob-%s.dat", name),
+		Domains: []string{name + ".com"},
+	}
+}
+
+func records(name string, addresses ...string) store.GroupStorePersistent {
+	var recs = make([]store.DNSRecord, 0)
+	for _, address := range addresses {
+		recs = append(recs, store.DNSRecord{
+			NodeName: "www." + name + ".com",
+			Type:     "A",
+			Data:     address,
+			Created:  time.Now(),
+		})
+	}
+	return store.GroupStorePersistent{
+		GroupName: name,
+		Store:     map[string][]store.DNSRecord{"www." + name + ".com": recs},
+	}
+}
+
+// hasRecords checks the addresses of the records of a group
+func hasRecords(backend data.Backend, name string, addresses ...string) error {
+	saved, err := backend.GetRecords(group(name))
+	if err != nil {
+		return err
+	}
+	recs := saved.Store["www."+name+".com"]
+	var found = make([]string, 0)
+	for _, rec := range recs {
+		found = append(found, rec.Data)
+	}
+	if strings.Join(found, ",") != strings.Join(addresses, ",") {
+		return errors.New(fmt.Sprintf("group %s records are [%s], expected [%s]", name, strings.Join(found, ","), strings.Join(addresses, ",")))
+	}
+	return nil
+}
+
+func put(backend data.Backend, name string, addresses ...string) error {
+	return backend.Update(func(tx data.BackendTx) error {
+		if err := tx.PutRecords(group(name), records(name, addresses...)); err != nil {
+			return err
+		}
+		return tx.PutGroup(group(name))
+	})
+}
+
+func backendSaves(backendType data.BackendType, folder string) error {
+	backend, err := data.NewBackend(backendType, folder, nil)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	if backend.Exists() {
+		return errors.New("new backend reports saved groups")
+	}
+	if err = put(backend, "one", "10.0.0.1"); err != nil {
+		return err
+	}
+	if err = put(backend, "one", "10.0.0.2", "10.0.0.3"); err != nil {
+		return err
+	}
+	if !backend.Exists() {
+		return errors.New("saved groups not reported")
+	}
+	groups, err := backend.ListGroups()
+	if err != nil {
+		return err
+	}
+	if _, ok := groups["one"]; !ok || len(groups) != 1 {
+		return errors.New(fmt.Sprintf("listed groups: %v", groups))
+	}
+	if g, err := backend.GetGroup("one"); err != nil || g.Domains[0] != "one.com" {
+		return errors.New(fmt.Sprintf("group: %v, Error: %v", g, err))
+	}
+	if _, err = backend.GetGroup("two"); err == nil {
+		return errors.New("unknown group found")
+	}
+	// records read are copies
+	saved, _ := backend.GetRecords(group("one"))
+	saved.Store["www.one.com"][0].Data = "changed"
+	return hasRecords(backend, "one", "10.0.0.2", "10.0.0.3")
+}
+
+func backendDiscards(backendType data.BackendType, folder string) error {
+	backend, err := data.NewBackend(backendType, folder, nil)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	if err = put(backend, "one", "10.0.0.1"); err != nil {
+		return err
+	}
+	failure := errors.New("failed")
+	err = backend.Update(func(tx data.BackendTx) error {
+		if err := tx.PutRecords(group("one"), records("one", "10.0.0.9")); err != nil {
+			return err
+		}
+		if err := tx.PutGroup(group("two")); err != nil {
+			return err
+		}
+		if err := tx.PutRecords(group("two"), records("two", "10.0.0.2")); err != nil {
+			return err
+		}
+		return failure
+	})
+	if err != failure {
+		return errors.New(fmt.Sprintf("transaction error: %v", err))
+	}
+	if _, err = backend.GetGroup("two"); err == nil {
+		return errors.New("group of a failed transaction saved")
+	}
+	return hasRecords(backend, "one", "10.0.0.1")
+}
+
+func backendDeletes(backendType data.BackendType, folder string) error {
+	backend, err := data.NewBackend(backendType, folder, nil)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	if err = put(backend, "one", "10.0.0.1"); err != nil {
+		return err
+	}
+	if err = put(backend, "two", "10.0.0.2"); err != nil {
+		return err
+	}
+	err = backend.Update(func(tx data.BackendTx) error {
+		return tx.DeleteGroup("one")
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = backend.GetGroup("one"); err == nil {
+		return errors.New("deleted group found")
+	}
+	if _, err = backend.GetRecords(group("one")); err == nil {
+		return errors.New("records of deleted group found")
+	}
+	// a group created again with the same name starts empty
+	if err = put(backend, "one", "10.0.0.3"); err != nil {
+		return err
+	}
+	if err = hasRecords(backend, "one", "10.0.0.3"); err != nil {
+		return err
+	}
+	return hasRecords(backend, "two", "10.0.0.2")
+}
+
+func backendReopens(backendType data.BackendType, folder string) error {
+	backend, err := data.NewBackend(backendType, folder, nil)
+	if err != nil {
+		return err
+	}
+	if err = put(backend, "one", "10.0.0.1"); err != nil {
+		return err
+	}
+	if err = put(backend, "one", "10.0.0.2"); err != nil {
+		return err
+	}
+	if err = backend.Close(); err != nil {
+		return err
+	}
+	backend, err = data.NewBackend(backendType, folder, nil)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	if !backend.Exists() {
+		return errors.New("saved groups not reported")
+	}
+	return hasRecords(backend, "one", "10.0.0.2")
+}
+
+// recordsFiles lists the files of the records generations of a group
+func recordsFiles(folder string, name string) []string {
+	files, _ := filepath.Glob(filepath.Join(folder, fmt.Sprintf("gob-%s.dat.*", name)))
+	return files
+}
+
+func fileCommitsWithIndex(folder string) error {
+	backend := data.NewFileBackend(folder, nil)
+	if err := put(backend, "one", "10.0.0.1"); err != nil {
+		return err
+	}
+	before := recordsFiles(folder, "one")
+	// the second records file can't be written, after the first one was
+	broken := group("two")
+	broken.File = filepath.Join("missing", "gob-two.dat")
+	err := backend.Update(func(tx data.BackendTx) error {
+		if err := tx.PutRecords(group("one"), records("one", "10.0.0.9")); err != nil {
+			return err
+		}
+		if err := tx.PutGroup(broken); err != nil {
+			return err
+		}
+		return tx.PutRecords(broken, records("two", "10.0.0.2"))
+	})
+	if err == nil {
+		return errors.New("transaction writing in a missing folder committed")
+	}
+	if err = hasRecords(backend, "one", "10.0.0.1"); err != nil {
+		return err
+	}
+	if _, err = backend.GetGroup("two"); err == nil {
+		return errors.New("group of a failed transaction saved")
+	}
+	if after := recordsFiles(folder, "one"); strings.Join(after, ",") != strings.Join(before, ",") {
+		return errors.New(fmt.Sprintf("records files left by the failed transaction: %v", after))
+	}
+	// previous generation kept, older ones removed
+	for _, addr := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		if err = put(backend, "one", addr); err != nil {
+			return err
+		}
+	}
+	if files := recordsFiles(folder, "one"); len(files) != 2 {
+		return errors.New(fmt.Sprintf("records files: %v", files))
+	}
+	return hasRecords(backend, "one", "10.0.0.4")
+}
+
+func fileIgnoresUncommitted(folder string) error {
+	backend := data.NewFileBackend(folder, nil)
+	if err := put(backend, "one", "10.0.0.1"); err != nil {
+		return err
+	}
+	// crash after writing the records of the next generation, before the index
+	uncommitted := filepath.Join(folder, "gob-one.dat.2")
+	if err := ioutil.WriteFile(uncommitted, []byte("uncommitted"), 0666); err != nil {
+		return err
+	}
+	if err := hasRecords(data.NewFileBackend(folder, nil), "one", "10.0.0.1"); err != nil {
+		return err
+	}
+	if _, err := os.Stat(uncommitted); err != nil {
+		return errors.New("recent records file removed, it may belong to another process")
+	}
+	old := time.Now().Add(-2 * data.STALE_TEMP_FILE_AGE)
+	if err := os.Chtimes(uncommitted, old, old); err != nil {
+		return err
+	}
+	backend = data.NewFileBackend(folder, nil)
+	if _, err := os.Stat(uncommitted); err == nil {
+		return errors.New("stale uncommitted records file not removed")
+	}
+	if err := put(backend, "one", "10.0.0.2"); err != nil {
+		return err
+	}
+	return hasRecords(backend, "one", "10.0.0.2")
+}
+
+// tear cuts a file, as an interrupted write
+func tear(fileName string, length int) error {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	if length > len(content) {
+		length = len(content)
+	}
+	return ioutil.WriteFile(fileName, content[:length], 0666)
+}
+
+func fileRecoversTornRecords(folder string) error {
+	backend := data.NewFileBackend(folder, nil)
+	if err := put(backend, "one", "10.0.0.1"); err != nil {
+		return err
+	}
+	var good string
+	// torn in the checksum header, then in the content
+	for _, length := range []int{10, 60} {
+		for idx := 0; idx < 2; idx++ {
+			if err := put(backend, "one", "10.0.0.2"); err != nil {
+				return err
+			}
+		}
+		files := recordsFiles(folder, "one")
+		good = files[len(files)-2]
+		if err := tear(files[len(files)-1], length); err != nil {
+			return err
+		}
+		if err := hasRecords(data.NewFileBackend(folder, nil), "one", "10.0.0.2"); err != nil {
+			return errors.New(fmt.Sprintf("torn at %d bytes: %v", length, err))
+		}
+	}
+	// legacy records file, without generations, recovered from its backup
+	legacy := filepath.Join(folder, "legacy")
+	if err := os.MkdirAll(legacy, 0755); err != nil {
+		return err
+	}
+	legacyFile := filepath.Join(legacy, "gob-one.dat")
+	for _, suffix := range []string{data.BACKUP_FILE_SUFFIX, ""} {
+		if err := copyFile(good, legacyFile+suffix); err != nil {
+			return err
+		}
+	}
+	index := "groups:\n  one:\n    name: one\n    file: gob-one.dat\n"
+	if err := ioutil.WriteFile(filepath.Join(legacy, "groups.yaml"), []byte(index), 0666); err != nil {
+		return err
+	}
+	if err := tear(legacyFile, 10); err != nil {
+		return err
+	}
+	return hasRecords(data.NewFileBackend(legacy, nil), "one", "10.0.0.2")
+}
+
+func copyFile(from string, to string) error {
+	content, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(to, content, 0666)
+}
+
+func fileRecoversIndexBackup(folder string) error {
+	backend := data.NewFileBackend(folder, nil)
+	if err := put(backend, "one", "10.0.0.1"); err != nil {
+		return err
+	}
+	if err := put(backend, "two", "10.0.0.2"); err != nil {
+		return err
+	}
+	if err := tear(filepath.Join(folder, "groups.yaml"), 20); err != nil {
+		return err
+	}
+	backend = data.NewFileBackend(folder, nil)
+	groups, err := backend.ListGroups()
+	if err != nil {
+		return err
+	}
+	// the backup is the index before the last transaction
+	if _, ok := groups["one"]; !ok || len(groups) != 1 {
+		return errors.New(fmt.Sprintf("groups recovered from backup: %v", groups))
+	}
+	return hasRecords(backend, "one", "10.0.0.1")
+}
+
+func appendEntries(journal *data.Journal, count int) error {
+	for idx := 0; idx < count; idx++ {
+		err := journal.Append(&data.JournalEntry{
+			Op:      data.JournalSetOp,
+			Group:   "one",
+			Key:     "www.one.com",
+			Records: records("one", fmt.Sprintf("10.0.0.%d", idx)).Store["www.one.com"],
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayed returns the sequences of the entries replayed after a sequence
+func replayed(journal *data.Journal, afterSeq uint64, until time.Time) ([]uint64, error) {
+	var seqs = make([]uint64, 0)
+	err := journal.Replay(afterSeq, until, func(entry data.JournalEntry) error {
+		seqs = append(seqs, entry.Seq)
+		return nil
+	})
+	return seqs, err
+}
+
+func journalCutsTornTail(folder string) error {
+	journal, err := data.OpenJournal(folder, nil)
+	if err != nil {
+		return err
+	}
+	if err = appendEntries(journal, 3); err != nil {
+		return err
+	}
+	journal.Close()
+	segments, _ := filepath.Glob(filepath.Join(folder, "journal-*"))
+	info, err := os.Stat(segments[0])
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	_, _ = f.Write([]byte{0, 0, 1, 0, 7})
+	f.Close()
+	journal, err = data.OpenJournal(folder, nil)
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+	if journal.LastSeq() != 3 {
+		return errors.New(fmt.Sprintf("last sequence after torn tail: %d", journal.LastSeq()))
+	}
+	if cut, _ := os.Stat(segments[0]); cut.Size() != info.Size() {
+		return errors.New(fmt.Sprintf("segment of %d bytes, expected %d", cut.Size(), info.Size()))
+	}
+	if err = appendEntries(journal, 1); err != nil {
+		return err
+	}
+	seqs, err := replayed(journal, 0, time.Time{})
+	if err != nil {
+		return err
+	}
+	if fmt.Sprint(seqs) != "[1 2 3 4]" {
+		return errors.New(fmt.Sprintf("replayed entries: %v", seqs))
+	}
+	return nil
+}
+
+func snapshot(journal *data.Journal, keep int) error {
+	return journal.WriteSnapshot(data.Snapshot{
+		Seq:     journal.LastSeq(),
+		Time:    time.Now(),
+		Groups:  map[string]data.Group{"one": group("one")},
+		Records: map[string]store.GroupStorePersistent{"one": records("one")},
+	}, keep)
+}
+
+func journalReplays(folder string) error {
+	journal, err := data.OpenJournal(folder, nil)
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+	if err = appendEntries(journal, 3); err != nil {
+		return err
+	}
+	if err = snapshot(journal, 5); err != nil {
+		return err
+	}
+	if err = appendEntries(journal, 2); err != nil {
+		return err
+	}
+	time.Sleep(10 * time.Millisecond)
+	until := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	if err = appendEntries(journal, 1); err != nil {
+		return err
+	}
+	for _, check := range []struct {
+		afterSeq uint64
+		until    time.Time
+		expected string
+	}{
+		{0, time.Time{}, "[1 2 3 4 5 6]"},
+		{2, time.Time{}, "[3 4 5 6]"},
+		// the first segment is skipped
+		{3, time.Time{}, "[4 5 6]"},
+		{3, until, "[4 5]"},
+		{6, time.Time{}, "[]"},
+	} {
+		seqs, err := replayed(journal, check.afterSeq, check.until)
+		if err != nil {
+			return err
+		}
+		if fmt.Sprint(seqs) != check.expected {
+			return errors.New(fmt.Sprintf("replayed after %d: %v, expected %s", check.afterSeq, seqs, check.expected))
+		}
+	}
+	return nil
+}
+
+func journalCompacts(folder string) error {
+	journal, err := data.OpenJournal(folder, nil)
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+	for idx := 0; idx < 4; idx++ {
+		if err = appendEntries(journal, 2); err != nil {
+			return err
+		}
+		if err = snapshot(journal, 2); err != nil {
+			return err
+		}
+	}
+	if err = appendEntries(journal, 1); err != nil {
+		return err
+	}
+	snapshots, _ := filepath.Glob(filepath.Join(folder, "snapshot-*"))
+	if len(snapshots) != 2 {
+		return errors.New(fmt.Sprintf("snapshots kept: %v", snapshots))
+	}
+	if journal.Pending() != 1 {
+		return errors.New(fmt.Sprintf("pending entries: %d", journal.Pending()))
+	}
+	// the oldest kept snapshot is at sequence 6, the entries following it are kept
+	seqs, err := replayed(journal, 6, time.Time{})
+	if err != nil {
+		return err
+	}
+	if fmt.Sprint(seqs) != "[7 8 9]" {
+		return errors.New(fmt.Sprintf("entries after the oldest snapshot: %v", seqs))
+	}
+	if seqs, err = replayed(journal, 0, time.Time{}); err != nil || len(seqs) > 5 {
+		return errors.New(fmt.Sprintf("entries before the oldest snapshot kept: %v, Error: %v", seqs, err))
+	}
+	return nil
+}
+
+func openBucket(folder string) (*data.GroupsBucket, *data.Journal, error) {
+	journal, err := data.OpenJournal(filepath.Join(folder, data.JOURNAL_FOLDER), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	bucket := data.NewGroupsBucketWith(folder, data.NewFileBackend(folder, nil), nil)
+	bucket.UseJournal(journal)
+	if err = bucket.Load([]net.UDPAddr{}); err != nil {
+		return nil, nil, err
+	}
+	return &bucket, journal, nil
+}
+
+// setAddress journals a change of the records of the default group
+func setAddress(bucket *data.GroupsBucket, address string) error {
+	g, err := bucket.GetGroupById("default")
+	if err != nil {
+		return err
+	}
+	groupStore, err := bucket.GetGroupStore(g)
+	if err != nil {
+		return err
+	}
+	recs := records("default", address).Store["www.default.com"]
+	groupStore.Replace("www.default.com", recs)
+	_, err = bucket.SaveGroupChange(&groupStore, g, data.JournalEntry{
+		Op:      data.JournalReplaceOp,
+		Key:     "www.default.com",
+		Records: recs,
+	})
+	return err
+}
+
+// hasAddress checks the address of the default group records
+func hasAddress(bucket *data.GroupsBucket, address string) error {
+	g, err := bucket.GetGroupById("default")
+	if err != nil {
+		return err
+	}
+	groupStore, err := bucket.GetGroupStore(g)
+	if err != nil {
+		return err
+	}
+	recs, gErr := groupStore.Get("www.default.com")
+	if gErr != nil || len(recs) != 1 || recs[0].Data != address {
+		return errors.New(fmt.Sprintf("records %v, expected %s", recs, address))
+	}
+	return nil
+}
+
+func bucketRecoversTo(folder string) error {
+	bucket, journal, err := openBucket(folder)
+	if err != nil {
+		return err
+	}
+	if err = setAddress(bucket, "10.0.0.1"); err != nil {
+		return err
+	}
+	if err = bucket.Snapshot(3); err != nil {
+		return err
+	}
+	if err = setAddress(bucket, "10.0.0.2"); err != nil {
+		return err
+	}
+	time.Sleep(10 * time.Millisecond)
+	point := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	if err = setAddress(bucket, "10.0.0.3"); err != nil {
+		return err
+	}
+	if _, _, err = bucket.CreateAndPersistGroupAndStore("other", []string{}, []net.UDPAddr{}); err != nil {
+		return err
+	}
+	if err = bucket.SaveMeta(); err != nil {
+		return err
+	}
+	// journaled changes are replayed after a crash
+	journal.Close()
+	if bucket, journal, err = openBucket(folder); err != nil {
+		return err
+	}
+	if err = hasAddress(bucket, "10.0.0.3"); err != nil {
+		return errors.New(fmt.Sprintf("replay after reopen: %v", err))
+	}
+	if err = bucket.RecoverTo(point, 3); err != nil {
+		return err
+	}
+	if err = hasAddress(bucket, "10.0.0.2"); err != nil {
+		return errors.New(fmt.Sprintf("recovered: %v", err))
+	}
+	if bucket.Contains("other") {
+		return errors.New("group created after the recovery point kept")
+	}
+	journal.Close()
+	if bucket, journal, err = openBucket(folder); err != nil {
+		return err
+	}
+	defer journal.Close()
+	if bucket.Contains("other") {
+		return errors.New("group created after the recovery point kept on reopen")
+	}
+	if err = hasAddress(bucket, "10.0.0.2"); err != nil {
+		return errors.New(fmt.Sprintf("recovered on reopen: %v", err))
+	}
+	if err = bucket.RecoverTo(time.Now().Add(-time.Hour), 3); err == nil {
+		return errors.New("recovery before the first snapshot succeeded")
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"github.com/hellgate75/rebind/registry"
+	"github.com/hellgate75/rebind/utils"
+	"net"
+	"strings"
+)
+
+// applyChange evicts the cached answers affected by a change of the records,
+// answers of changed host names or all of them when any record may have changed
+func (s *dnsService) applyChange(event registry.ChangeEvent) {
+	if len(event.Groups) > 0 || event.All() {
+		// the settings and the forwarders of the groups may have changed
+		s.updateServeStale()
+		s.pruneForwarders()
+	}
+	if event.All() {
+		s.Answers.Flush()
+		s.log.Debugf("DNSServer: Records changed in groups %v, answers cache flushed", event.Groups)
+		return
+	}
+	for _, hostname := range event.Hostnames {
+		name := strings.TrimSpace(strings.ToLower(hostname))
+		if name == "" || name == "." {
+			continue
+		}
+		name, _ = utils.ReplaceQuestionUnrelated(name)
+		removed := s.Answers.RemoveName(name)
+		s.log.Debugf("DNSServer: Records of %s changed, %v cached answers evicted", name, removed)
+	}
+}
+
+// updateServeStale keeps the expired answers for the stale window only when
+// serve-stale is enabled for the server or for any group
+func (s *dnsService) updateServeStale() {
+	enabled := s.Cache.ServeStale
+	for _, group := range s.Store.ListGroups() {
+		enabled = enabled || (group.ServeStale != nil && *group.ServeStale)
+	}
+	s.Answers.SetServeStale(enabled)
+}
+
+// pruneForwarders forgets the health of the forwarders no longer configured
+func (s *dnsService) pruneForwarders() {
+	var fwds = append([]net.UDPAddr{}, s.Forwarders...)
+	for _, group := range s.Store.ListGroups() {
+		fwds = append(fwds, group.Forwarders...)
+	}
+	s.Upstream.Health.Prune(fwds)
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"fmt"
+	"github.com/hellgate75/rebind/model"
+	"golang.org/x/net/dns/dnsmessage"
+	"sync"
+)
+
+// coalescedCall is an upstream query in progress, shared by the clients asking the same question
+type coalescedCall struct {
+	sync.WaitGroup
+	answer  dnsmessage.Message
+	err     error
+	waiters int
+}
+
+// queryCoalescer runs a single upstream query for identical concurrent questions
+type queryCoalescer struct {
+	sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// Do runs the exchange for the key, unless another one for the same key is in progress:
+// in such case it waits for that one and returns the same answer. The shared flag
+// reports whether the answer was shared with other clients.
+func (c *queryCoalescer) Do(key string, exchange func() (dnsmessage.Message, error)) (dnsmessage.Message, error, bool) {
+	c.Lock()
+	if call, ok := c.calls[key]; ok {
+		call.waiters++
+		c.Unlock()
+		call.Wait()
+		return call.answer, call.err, true
+	}
+	call := &coalescedCall{}
+	call.Add(1)
+	c.calls[key] = call
+	c.Unlock()
+	defer func() {
+		c.Lock()
+		delete(c.calls, key)
+		c.Unlock()
+		call.Done()
+	}()
+	call.answer, call.err = exchange()
+	c.Lock()
+	shared := call.waiters > 0
+	c.Unlock()
+	return call.answer, call.err, shared
+}
+
+// coalesceKey returns the key of identical questions: name, type, class and DNSSEC OK bit
+func coalesceKey(p model.Packet) string {
+	return fmt.Sprintf("%s|%v", questionKey(p.Message.Questions[0]), p.EDNS.DNSSECOk)
+}
+
+// newQueryCoalescer creates an empty upstream queries coalescer
+func newQueryCoalescer() *queryCoalescer {
+	return &queryCoalescer{
+		calls: make(map[string]*coalescedCall),
+	}
+}
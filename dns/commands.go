@@ -0,0 +1,101 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	errs "errors"
+	pnet "github.com/hellgate75/rebind/net"
+	"github.com/hellgate75/rebind/registry"
+	"os"
+	"time"
+)
+
+const (
+	// Time left to the shutdown reply before exiting
+	shutdownDelay time.Duration = 500 * time.Millisecond
+)
+
+// registerCommands registers the handlers of the net pipe commands
+func (s *dnsService) registerCommands(pipe pnet.NetPipe) {
+	pipe.Handle(pnet.ReloadCommand, s.reloadCommand)
+	pipe.Handle(pnet.LoadCommand, s.loadCommand)
+	pipe.Handle(pnet.ShutdownCommand, s.shutdownCommand)
+	// remote stores of the Rest server
+	registry.RegisterStoreCommands(pipe, s.Store)
+}
+
+func (s *dnsService) reloadCommand(ctx context.Context, request pnet.Request) (interface{}, error) {
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return pnet.ReloadReply{
+		Groups: s.Store.GetGroupBucket().Keys(),
+	}, nil
+}
+
+func (s *dnsService) loadCommand(ctx context.Context, request pnet.Request) (interface{}, error) {
+	var payload pnet.LoadPayload
+	if err := request.Decode(&payload); err != nil {
+		return nil, err
+	}
+	if payload.Group == "" {
+		return nil, errs.New("missing group name")
+	}
+	numRecs, err := s.load(payload.Group)
+	if err != nil {
+		return nil, err
+	}
+	return pnet.LoadReply{
+		Group:   payload.Group,
+		Records: numRecs,
+	}, nil
+}
+
+func (s *dnsService) shutdownCommand(ctx context.Context, request pnet.Request) (interface{}, error) {
+	s.log.Warnf("DNSServer: Shutdown requested over the net pipe, request: %s", request.ID)
+	go func() {
+		time.Sleep(shutdownDelay)
+		os.Exit(0)
+	}()
+	return nil, nil
+}
+
+// reload reads again the groups index, dropping the loaded group stores
+func (s *dnsService) reload() error {
+	err := s.Store.Invalidate("")
+	if err != nil {
+		s.log.Errorf("DNSServer: Unable to reload groups -> Error: %v", err)
+	}
+	return err
+}
+
+// load reads again the store of a group, and the groups index when the group is unknown.
+// It returns the number of records of the group.
+func (s *dnsService) load(groupId string) (int64, error) {
+	var numRecs int64
+	err := s.Store.Invalidate(groupId)
+	if err == nil {
+		bucket := s.Store.GetGroupBucket()
+		g, gErr := bucket.GetGroupById(groupId)
+		if gErr != nil {
+			if err = s.Store.Invalidate(""); err == nil {
+				g, err = bucket.GetGroupById(groupId)
+			}
+		}
+		if err == nil {
+			gsd, sErr := bucket.GetGroupStore(g)
+			for _, key := range gsd.Keys() {
+				recs, _ := gsd.Get(key)
+				numRecs += int64(len(recs))
+			}
+			err = sErr
+		}
+	}
+	if err != nil {
+		s.log.Errorf("DNSServer: Unable to load group %s -> Error: %v", groupId, err)
+	}
+	return numRecs, err
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	errs "errors"
 	"fmt"
+	"github.com/hellgate75/rebind/data"
 	"github.com/hellgate75/rebind/log"
 	"github.com/hellgate75/rebind/model"
 	pnet "github.com/hellgate75/rebind/net"
@@ -17,7 +18,6 @@ import (
 	"golang.org/x/net/dns/dnsmessage"
 	"net"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -25,87 +25,172 @@ import (
 const (
 	// DNS server default port
 	udpPort int = 53
-	// DNS model.Packet max length
+	// DNS model.Packet max length, without EDNS(0)
 	packetLen int = 512
+	// DNS UDP read buffer length, large enough for any EDNS(0) payload
+	udpReadBufferLen int = 65535
+	// Interval between two expired answers evictions
+	cacheJanitorInterval time.Duration = 30 * time.Second
 )
 
 // DNSService is an implementation of DNSServer interface.
 type dnsService struct {
-	Conn       *net.UDPConn
-	Store      registry.Store
-	Bucket     store.RequestsCacheStore
-	Answers    store.AnswersCacheStore
-	Forwarders []net.UDPAddr
-	log        log.Logger
-	pipe       pnet.NetPipe
-	_started   bool
+	Conns             []*net.UDPConn
+	Listeners         []net.Listener
+	TCPIdleTimeout    time.Duration
+	TCPMaxConnections int
+	Store             registry.Store
+	Upstream          *upstreamClient
+	Coalescer         *queryCoalescer
+	Answers           store.AnswersCacheStore
+	Cache             model.CacheConfig
+	Forwarders        []net.UDPAddr
+	// Unix socket of the net pipe, when empty the pipe uses TCP
+	PipeSocket   string
+	PipeSecurity pnet.PipeSecurity
+	// Store shared with the REST server in the same process, no net pipe is needed
+	SharedStore bool
+	log         log.Logger
+	pipe        pnet.NetPipe
+	_started    bool
 }
 
+// pipeHandler discards raw data messages, the DNS server only executes commands
 func (s *dnsService) pipeHandler(message string) {
-	tokens := strings.Split(message, " ")
-	if "reload" == tokens[0] {
-		s.Store.GetGroupBucket().ReLoad()
-		s.pipe.Write([]byte(fmt.Sprintf("reponse %s %s", "ok", tokens[1])))
-	} else if "load" == tokens[0] {
-		groupId := strings.TrimSpace(tokens[1])
-		g, _ := s.Store.GetGroupBucket().GetGroupById(groupId)
-		s.Store.GetGroupBucket().GetGroupStore(g)
-		s.pipe.Write([]byte(fmt.Sprintf("reponse %s %s", "ok", tokens[2])))
-	} else if "shutdown" == tokens[0] {
-		s.pipe.Write([]byte(fmt.Sprintf("reponse %s %s", "ok", tokens[1])))
-		os.Exit(0)
-	}
+	s.log.Warnf("DNSServer: Discarded unsupported net pipe message of %v bytes", len(message))
 }
 
-// Listen starts a DNS server on port 53
-func (s *dnsService) Listen(ipAddress string, port int, pipeAddress string, pipePort int, pipeResponsePort int) error {
+// Listen starts a DNS server on port 53, with an UDP and a TCP socket for
+// each of the given IPv4 / IPv6 addresses
+func (s *dnsService) Listen(ipAddresses []string, port int, pipeAddress string, pipePort int, pipeResponsePort int) error {
 	var err error
-	ipTokens := strings.Split(ipAddress, ".")
-	if len(ipTokens) < 4 {
-		return errs.New(fmt.Sprintf("DNSServer: Invalid ip address: %s", ipAddress))
+	if len(ipAddresses) == 0 {
+		return errs.New("DNSServer: No listen ip address provided")
 	}
-	s.pipe, err = pnet.NewInputOutputPipeWith(pipeAddress, pipePort, pipeAddress, pipeResponsePort, pnet.PipeHandler(s.pipeHandler), s.log)
-	if err == nil {
-		err := s.pipe.Start()
+	var addresses = make([]net.UDPAddr, 0)
+	for _, ipAddress := range ipAddresses {
+		addr, err := parseListenAddress(ipAddress, port)
 		if err != nil {
-			s.log.Error("Unable to start net pipe on %s:%v", pipeAddress, pipePort)
-			os.Exit(1)
+			return err
 		}
+		addresses = append(addresses, addr)
+	}
+	if s.SharedStore {
+		s.log.Info("DNSServer: Store shared with the REST server, no net pipe started")
 	} else {
-		s.log.Error("Unable to create net pipe on %s:%v", pipeAddress, pipePort)
-		os.Exit(1)
+		s.startPipe(pipeAddress, pipePort, pipeResponsePort)
+		defer s.pipe.Stop()
+	}
+	defer func() {
+		for _, conn := range s.Conns {
+			_ = conn.Close()
+		}
+		for _, listener := range s.Listeners {
+			_ = listener.Close()
+		}
+	}()
+	for _, addr := range addresses {
+		s.log.Debugf("Ip address: %s, Port: %v", addr.IP.String(), addr.Port)
+		udpNetwork, tcpNetwork := "udp6", "tcp6"
+		if addr.IP.To4() != nil {
+			udpNetwork, tcpNetwork = "udp4", "tcp4"
+		}
+		conn, err := net.ListenUDP(udpNetwork, &addr)
+		if err != nil {
+			s.log.Errorf("DNSServer: Unable to listen on udp %s -> Error: %v", addr.String(), err)
+			return err
+		}
+		s.Conns = append(s.Conns, conn)
+		listener, err := net.ListenTCP(tcpNetwork, &net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone})
+		if err != nil {
+			s.log.Errorf("DNSServer: Unable to listen on tcp %s -> Error: %v", addr.String(), err)
+			return err
+		}
+		s.Listeners = append(s.Listeners, listener)
+	}
+	s._started = true
+	go s.cacheJanitor()
+	for _, listener := range s.Listeners {
+		go s.serveTCP(listener)
+	}
+	for _, conn := range s.Conns {
+		go s.serveUDP(conn)
+	}
+	for s._started {
+		time.Sleep(1 * time.Second)
+	}
+	return err
+}
+
+// startPipe starts the net pipe receiving the commands of the REST server, it exits on failure
+func (s *dnsService) startPipe(pipeAddress string, pipePort int, pipeResponsePort int) {
+	var err error
+	if s.PipeSocket != "" {
+		s.pipe, err = pnet.NewSocketPipe(s.PipeSocket, true, pnet.PipeHandler(s.pipeHandler), s.log)
+	} else {
+		s.pipe, err = pnet.NewInputOutputPipeWith(pipeAddress, pipePort, pipeAddress, pipeResponsePort, pnet.PipeHandler(s.pipeHandler), s.log)
 	}
-	defer s.pipe.Stop()
-	var token1, token2, token3, token4 byte
-	intV, _ := strconv.Atoi(ipTokens[0])
-	token1 = byte(intV)
-	intV, _ = strconv.Atoi(ipTokens[1])
-	token2 = byte(intV)
-	intV, _ = strconv.Atoi(ipTokens[2])
-	token3 = byte(intV)
-	intV, _ = strconv.Atoi(ipTokens[3])
-	token4 = byte(intV)
-	var ip net.IP = net.IPv4(token1, token2, token3, token4)
-	s.log.Debugf("Ip address: %s, Port: %v", ip.String(), port)
-	s.Conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
 	if err != nil {
-		s.log.Fatal(err)
+		s.log.Errorf("Unable to create net pipe on %s:%v -> Error: %v", pipeAddress, pipePort, err)
+		os.Exit(1)
 	}
-	if s.Conn == nil {
-		return errs.New(fmt.Sprintf("Nil Connection from dialing %s:%v", ip.String(), port))
+	s.registerCommands(s.pipe)
+	s.pipe.Secure(s.PipeSecurity)
+	if !s.PipeSecurity.Enabled() && s.PipeSocket == "" && !isLoopback(pipeAddress) {
+		s.log.Warnf("DNSServer: Net pipe on %s:%v accepts not authenticated commands", pipeAddress, pipePort)
 	}
-	defer s.Conn.Close()
-	s._started = true
+	if err = s.pipe.Start(); err != nil {
+		s.log.Errorf("Unable to start net pipe on %s:%v (socket: %s) -> Error: %v", pipeAddress, pipePort, s.PipeSocket, err)
+		os.Exit(1)
+	}
+}
+
+// cacheJanitor periodically evicts the expired answers from the cache
+func (s *dnsService) cacheJanitor() {
+	for s._started {
+		time.Sleep(cacheJanitorInterval)
+		if err := s.Answers.Trim(); err != nil {
+			s.log.Errorf("DNSServer: Error evicting expired answers -> Error: %v", err)
+		}
+	}
+}
+
+// isLoopback checks if an address is a loopback ip address
+func isLoopback(address string) bool {
+	ip := net.ParseIP(address)
+	return ip != nil && ip.IsLoopback()
+}
+
+// parseListenAddress parses an IPv4 or IPv6 listen address, the latter
+// optionally with brackets and zone (e.g. [fe80::1%eth0])
+func parseListenAddress(ipAddress string, port int) (net.UDPAddr, error) {
+	host := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(ipAddress), "["), "]")
+	zone := ""
+	if i := strings.LastIndex(host, "%"); i > 0 {
+		zone = host[i+1:]
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return net.UDPAddr{}, errs.New(fmt.Sprintf("DNSServer: Invalid ip address: %s", ipAddress))
+	}
+	return net.UDPAddr{IP: ip, Port: port, Zone: zone}, nil
+}
+
+// serveUDP reads DNS queries from an UDP socket
+func (s *dnsService) serveUDP(conn *net.UDPConn) {
 	for s._started {
-		buf := make([]byte, packetLen)
+		buf := make([]byte, udpReadBufferLen)
 		s.log.Debug("Reading Network packets ...")
-		_, addr, err := s.Conn.ReadFromUDP(buf)
+		n, addr, err := conn.ReadFromUDP(buf)
 		if err != nil {
-			s.log.Errorf("DNSServer: Error reading the request -> Error: %v", err)
+			if s._started {
+				s.log.Errorf("DNSServer: Error reading the request -> Error: %v", err)
+			}
 			continue
 		}
 		var m dnsmessage.Message
-		err = m.Unpack(buf)
+		err = m.Unpack(buf[:n])
 		if err != nil {
 			s.log.Errorf("DNSServer: Error unpacking the request -> Error: %v", err)
 			continue
@@ -114,26 +199,46 @@ func (s *dnsService) Listen(ipAddress string, port int, pipeAddress string, pipe
 		if len(m.Questions) == 0 {
 			continue
 		}
-		go s.Query(model.Packet{*addr, m})
+		go s.Query(model.Packet{
+			Addr:    *addr,
+			Message: m,
+			Writer:  &udpWriter{conn: conn, addr: *addr},
+		})
 	}
-	return err
+}
+
+// forwardConn returns the UDP socket of the same address family of the forwarder
+func (s *dnsService) forwardConn(addr net.UDPAddr) *net.UDPConn {
+	isIPv4 := addr.IP.To4() != nil
+	for _, conn := range s.Conns {
+		if local, ok := conn.LocalAddr().(*net.UDPAddr); ok && (local.IP.To4() != nil) == isIPv4 {
+			return conn
+		}
+	}
+	if len(s.Conns) > 0 {
+		return s.Conns[0]
+	}
+	return nil
 }
 
 // Query lookup answers for DNS Message.
 func (s *dnsService) Query(p model.Packet) {
-	// got response from forwarder, send it back to client
-	// got response from forwarder, send it back to client
+	// answers are read by the upstream client, anything else is unexpected
 	if p.Message.Header.Response {
-		pKey := utils.PToString(p)
-		if addresses, err := s.Bucket.Get(pKey); err != nil {
-			for _, address := range addresses {
-				go sendPacket(s.Conn, p.Message, address)
-			}
-			s.Bucket.Remove(pKey)
-			qRep, _ := utils.ReplaceQuestionUnrelated(utils.QToString(p.Message.Questions[0]))
-			go s.SaveBulk(qRep, p.Message.Answers)
-			s.Answers.Set(qRep, p.Message.Answers...)
-		}
+		s.log.Debugf("DNSServer: Discarded unexpected answer from %s", p.Addr.String())
+		return
+	}
+	edns, err := parseEDNS(p.Message)
+	if err != nil {
+		s.log.Warnf("DNSServer: Invalid EDNS(0) data from %s -> Error: %v", p.Addr.String(), err)
+		p.Message.Header.RCode = dnsmessage.RCodeFormatError
+		s.reply(p)
+		return
+	}
+	p.EDNS = edns
+	if p.EDNS.Enabled && p.EDNS.Version > ednsVersion {
+		p.Message.Header.RCode = rCodeBadVersion
+		s.reply(p)
 		return
 	}
 	s.log.Debugf("Ip: %v", p.Addr.IP.String())
@@ -149,42 +254,110 @@ func (s *dnsService) Query(p model.Packet) {
 	s.log.Debugf("pKey: %s", utils.PToString(p))
 	s.log.Debugf("Questions: %v", len(p.Message.Questions))
 	for idx, q := range p.Message.Questions {
-		qRep, _ := utils.ReplaceQuestionUnrelated(utils.QToString(q))
+		qRep := questionKey(q)
 		s.log.Debugf("Question n. %v: %s", idx, qRep)
 	}
 	q1 := p.Message.Questions[0]
-	qRep, _ := utils.ReplaceQuestionUnrelated(utils.QToString(q1))
-	s.log.Debugf("qKey: %s", qRep)
-	questionType := q1.Type.String()[4:]
-	s.log.Debugf("qType: %s", questionType)
+	// the type is part of the cache key only, the store looks up names
+	qRep := questionName(q1)
+	qKey := questionKey(q1)
+	s.log.Debugf("qKey: %s", qKey)
+	s.log.Debugf("qType: %s", q1.Type.String())
 	s.log.Debugf("UDPADDR->_zone: %s", p.Addr.Zone)
 	s.log.Debugf("UDPADDR->IP: %s", p.Addr.IP.String())
 	s.log.Debugf("UDPADDR->Port: %v", p.Addr.Port)
 
 	//Recover by zone, the by question
 	// was checked before entering this routine
-	if dnsRes, err := s.Answers.Get(qRep); err == nil {
-		//Taking from cache
-		p.Message.Answers = append(p.Message.Answers, dnsRes...)
-		go sendPacket(s.Conn, p.Message, p.Addr)
-	} else {
-		// answer the question
-		// seeking into the store
-		val, fwds, ok := s.Store.Get(qRep)
-		if ok && len(val) > 0 {
-			s.Answers.Set(qRep, val...)
-			p.Message.Answers = append(p.Message.Answers, val...)
-			go sendPacket(s.Conn, p.Message, p.Addr)
-		} else if len(fwds) > 0 {
-			// forwarding
-			for i := 0; i < len(fwds); i++ {
-				s.Bucket.Set(utils.PToString(p), p.Addr)
-				go sendPacket(s.Conn, p.Message, s.Forwarders[i])
-			}
-		} else {
-			s.log.Warnf("Request: %s has 0 records")
+	if cached, err := s.Answers.GetBlock(qKey); err == nil {
+		//Taking from cache, negative answers come with the zone SOA
+		p.Message.Header.RCode = cached.RCode
+		p.Message.Answers = append(p.Message.Answers, cached.Answer...)
+		p.Message.Authorities = cached.Authority
+		s.reply(p)
+		if needsPrefetch(cached) {
+			go s.prefetch(p, qRep)
+		}
+		return
+	}
+	// answer the question
+	// seeking into the store
+	result := s.Store.Lookup(qRep)
+	answers := filterAnswers(result.Records, q1.Type)
+	authoritative := len(result.Groups) > 0
+	switch {
+	case len(answers) > 0:
+		s.Answers.Set(qKey, answers...)
+		p.Message.Header.Authoritative = authoritative
+		p.Message.Answers = append(p.Message.Answers, answers...)
+		s.reply(p)
+	case authoritative && len(result.Records) > 0:
+		// name exists with other types only
+		s.log.Debugf("DNSServer: No %s records for %s, answering NODATA", q1.Type.String(), qRep)
+		s.replyNegative(p, dnsmessage.RCodeSuccess, result.Authority)
+	case authoritative && len(result.Forwarders) == 0:
+		s.log.Debugf("DNSServer: Name %s doesn't exist, answering NXDOMAIN", qRep)
+		s.replyNegative(p, dnsmessage.RCodeNameError, result.Authority)
+	case len(result.Forwarders) > 0:
+		s.forward(p, result)
+	default:
+		s.log.Warnf("DNSServer: Name %s is out of any group and forwarding is disabled, answering REFUSED", qRep)
+		s.replyNegative(p, dnsmessage.RCodeRefused, nil)
+	}
+}
+
+// forward sends the query to the forwarders and the answer back to the client.
+// When no forwarder answers, it answers from the expired cached answers,
+// if serve-stale is enabled, or SERVFAIL.
+func (s *dnsService) forward(p model.Packet, result registry.LookupResult) {
+	answer, err, shared := s.resolve(p, result.Forwarders, result.Policy)
+	if shared {
+		s.log.Debugf("DNSServer: Answer to %s shared with identical in-flight queries", p.Addr.String())
+	}
+	if (err != nil || answer.Header.RCode == dnsmessage.RCodeServerFailure) &&
+		isEnabled(result.ServeStale, s.Cache.ServeStale) && s.replyStale(p) {
+		return
+	}
+	if err != nil {
+		s.log.Warnf("DNSServer: No answer from forwarders for %s, answering SERVFAIL -> Error: %v", p.Addr.String(), err)
+		s.replyNegative(p, dnsmessage.RCodeServerFailure, nil)
+		return
+	}
+	rCode := answer.Header.RCode
+	for _, r := range answer.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			rCode = r.Header.ExtendedRCode(rCode)
 		}
 	}
+	p.Message.Header.RCode = rCode
+	p.Message.Header.RecursionAvailable = answer.Header.RecursionAvailable
+	p.Message.Header.Authoritative = answer.Header.Authoritative
+	p.Message.Answers = answer.Answers
+	p.Message.Authorities = answer.Authorities
+	p.Message.Additionals = answer.Additionals
+	s.reply(p)
+}
+
+// resolve queries the forwarders once for identical concurrent questions, and
+// caches positive and negative answers
+func (s *dnsService) resolve(p model.Packet, fwds []net.UDPAddr, policy data.ForwardPolicy) (dnsmessage.Message, error, bool) {
+	qKey := questionKey(p.Message.Questions[0])
+	return s.Coalescer.Do(coalesceKey(p), func() (dnsmessage.Message, error) {
+		answer, err := s.Upstream.Exchange(p.Message, fwds, policy)
+		if err != nil {
+			return answer, err
+		}
+		if answer.Header.RCode == dnsmessage.RCodeNameError ||
+			(answer.Header.RCode == dnsmessage.RCodeSuccess && len(filterAnswers(answer.Answers, p.Message.Questions[0].Type)) == 0) {
+			// NXDOMAIN or NODATA (RFC 2308 - 2)
+			if err := s.Answers.SetNegative(qKey, answer.Header.RCode, answer.Answers, answer.Authorities); err != nil {
+				s.log.Debugf("DNSServer: Negative answer for %s not cached -> Reason: %v", qKey, err)
+			}
+		} else if answer.Header.RCode == dnsmessage.RCodeSuccess {
+			s.Answers.Set(qKey, answer.Answers...)
+		}
+		return answer, nil
+	})
 }
 
 func (s *dnsService) Wait() {
@@ -199,35 +372,117 @@ func (s *dnsService) GetService() model.DNSService {
 	return s
 }
 
-func sendPacket(conn *net.UDPConn, message dnsmessage.Message, addr net.UDPAddr) {
-	packed, err := message.Pack()
+// reply sends the packet message back to the client, over the transport it used,
+// sized to the client limits
+func (s *dnsService) reply(p model.Packet) {
+	message := responseMessage(p)
+	if p.Writer == nil {
+		if err := sendPacket(s.forwardConn(p.Addr), message, p.Addr); err != nil {
+			s.log.Errorf("DNSServer: Error sending answer to %s -> Error: %v", p.Addr.String(), err)
+		}
+		return
+	}
+	limit := tcpMaxMessageLen
+	if p.Writer.Network() == "udp" {
+		limit = udpPayloadLimit(p.EDNS)
+	}
+	packed, err := packWithinLimit(&message, limit)
 	if err != nil {
-		//log.Println(err)
+		s.log.Errorf("DNSServer: Error packing answer for %s -> Error: %v", p.Addr.String(), err)
 		return
 	}
+	if message.Header.Truncated {
+		s.log.Debugf("DNSServer: Answer for %s truncated to %v bytes", p.Addr.String(), limit)
+	}
+	if err := p.Writer.Write(packed); err != nil {
+		s.log.Errorf("DNSServer: Error sending %s answer to %s -> Error: %v", p.Writer.Network(), p.Addr.String(), err)
+	}
+}
 
-	_, err = conn.WriteToUDP(packed, &addr)
+// udpWriter answers to a client over the UDP listener socket
+type udpWriter struct {
+	conn *net.UDPConn
+	addr net.UDPAddr
+}
+
+func (w *udpWriter) Write(packed []byte) error {
+	_, err := w.conn.WriteToUDP(packed, &w.addr)
+	return err
+}
+
+func (w *udpWriter) Network() string {
+	return "udp"
+}
+
+func sendPacket(conn *net.UDPConn, message dnsmessage.Message, addr net.UDPAddr) error {
+	if conn == nil {
+		return errs.New("no UDP socket available")
+	}
+	packed, err := message.Pack()
 	if err != nil {
-		//log.Println(err)
+		return err
 	}
+	_, err = conn.WriteToUDP(packed, &addr)
+	return err
 }
 
 // New setups a DNSService, rwDirPath is read-writable directory path for storing dns records.
-func New(rwDirPath string, logger log.Logger, forwarders []net.UDPAddr) model.DNSServer {
-	return &dnsService{
-		Store:      registry.NewStore(logger, rwDirPath, forwarders),
-		Bucket:     store.NewRequestsCacheStore(),
-		Answers:    store.NewAnswersCacheStore(),
-		Forwarders: forwarders,
-		log:        logger,
+func New(rwDirPath string, logger log.Logger, forwarders []net.UDPAddr, cache model.CacheConfig) model.DNSServer {
+	return NewWithStore(registry.NewStore(logger, rwDirPath, forwarders), logger, forwarders, cache)
+}
+
+// NewWithStore setups a DNSService on the given registry store.
+func NewWithStore(registryStore registry.Store, logger log.Logger, forwarders []net.UDPAddr, cache model.CacheConfig) model.DNSServer {
+	s := &dnsService{
+		Store:             registryStore,
+		Upstream:          newUpstreamClient(logger),
+		Coalescer:         newQueryCoalescer(),
+		Answers:           store.NewAnswersCacheStoreWith(cache),
+		Cache:             cache,
+		Forwarders:        forwarders,
+		TCPIdleTimeout:    tcpIdleTimeout,
+		TCPMaxConnections: tcpMaxConnections,
+		log:               logger,
 	}
+	s.Store.AddListener(s.applyChange)
+	return s
 }
 
 // Start conveniently init every parts of DNS service.
-func Start(rwDirPath string, ip string, port int, pipeIP string, pipePort int, pipeResponsePort int, logger log.Logger, forwarders []net.UDPAddr) model.DNSServer {
-	s := New(rwDirPath, logger, forwarders)
+// A not empty pipeSocket selects the Unix socket net pipe, instead of the TCP one.
+func Start(rwDirPath string, ips []string, port int, pipeIP string, pipePort int, pipeResponsePort int, pipeSocket string, pipeSecurity pnet.PipeSecurity, logger log.Logger, forwarders []net.UDPAddr, cache model.CacheConfig) model.DNSServer {
+	return StartWithPipe(registry.NewStore(logger, rwDirPath, forwarders), ips, port, pipeIP, pipePort, pipeResponsePort, pipeSocket, pipeSecurity, logger, forwarders, cache)
+}
+
+// StartWithPipe init every parts of DNS service on the given registry store,
+// serving the net pipe for the REST server. The store is loaded here.
+func StartWithPipe(registryStore registry.Store, ips []string, port int, pipeIP string, pipePort int, pipeResponsePort int, pipeSocket string, pipeSecurity pnet.PipeSecurity, logger log.Logger, forwarders []net.UDPAddr, cache model.CacheConfig) model.DNSServer {
+	s := NewWithStore(registryStore, logger, forwarders, cache)
+	s.(*dnsService).PipeSocket = pipeSocket
+	s.(*dnsService).PipeSecurity = pipeSecurity
 	s.(*dnsService).Store.Load()
-	go s.Listen(ip, port, pipeIP, pipePort, pipeResponsePort)
+	s.(*dnsService).updateServeStale()
+	go func() {
+		if err := s.Listen(ips, port, pipeIP, pipePort, pipeResponsePort); err != nil {
+			logger.Errorf("DNSServer: Listen error: %v", err)
+		}
+	}()
+	return s
+}
+
+// StartWithStore init every parts of DNS service on a store shared with the REST
+// server in the same process: changes are visible right away and no net pipe is started.
+// The store is loaded here.
+func StartWithStore(registryStore registry.Store, ips []string, port int, logger log.Logger, forwarders []net.UDPAddr, cache model.CacheConfig) model.DNSServer {
+	s := NewWithStore(registryStore, logger, forwarders, cache)
+	s.(*dnsService).SharedStore = true
+	s.(*dnsService).Store.Load()
+	s.(*dnsService).updateServeStale()
+	go func() {
+		if err := s.Listen(ips, port, "", 0, 0); err != nil {
+			logger.Errorf("DNSServer: Listen error: %v", err)
+		}
+	}()
 	return s
 }
 
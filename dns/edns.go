@@ -0,0 +1,108 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	errs "errors"
+	"github.com/hellgate75/rebind/model"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// EDNS(0) supported version
+	ednsVersion uint8 = 0
+	// EDNS(0) UDP payload size advertised by the server
+	ednsServerUDPSize uint16 = 4096
+	// EDNS(0) BADVERS extended response code (RFC 6891 - 9)
+	rCodeBadVersion dnsmessage.RCode = 16
+)
+
+// parseEDNS reads the OPT pseudo-record of a message, if any.
+func parseEDNS(m dnsmessage.Message) (model.EDNS, error) {
+	var edns model.EDNS
+	for _, r := range m.Additionals {
+		if r.Header.Type != dnsmessage.TypeOPT {
+			continue
+		}
+		if edns.Enabled {
+			return model.EDNS{}, errs.New("multiple OPT records in the message")
+		}
+		edns.Enabled = true
+		edns.Version = uint8(r.Header.TTL >> 16)
+		edns.UDPSize = uint16(r.Header.Class)
+		edns.DNSSECOk = r.Header.DNSSECAllowed()
+	}
+	return edns, nil
+}
+
+// udpPayloadLimit returns the largest UDP answer the client accepts
+func udpPayloadLimit(edns model.EDNS) int {
+	if !edns.Enabled || int(edns.UDPSize) <= packetLen {
+		return packetLen
+	}
+	if edns.UDPSize > ednsServerUDPSize {
+		return int(ednsServerUDPSize)
+	}
+	return int(edns.UDPSize)
+}
+
+// responseMessage turns the packet message into the answer for the client,
+// replacing the client OPT record with the server one, when the client uses EDNS(0).
+// Response codes over 15 are split between the header and the OPT record.
+func responseMessage(p model.Packet) dnsmessage.Message {
+	message := p.Message
+	message.Header.Response = true
+	rcode := message.Header.RCode
+	message.Header.RCode = rcode & 0xF
+	var additionals = make([]dnsmessage.Resource, 0)
+	for _, r := range message.Additionals {
+		if r.Header.Type != dnsmessage.TypeOPT {
+			additionals = append(additionals, r)
+		}
+	}
+	if p.EDNS.Enabled {
+		var opt dnsmessage.ResourceHeader
+		_ = opt.SetEDNS0(int(ednsServerUDPSize), rcode, p.EDNS.DNSSECOk)
+		additionals = append(additionals, dnsmessage.Resource{
+			Header: opt,
+			Body:   &dnsmessage.OPTResource{},
+		})
+	}
+	message.Additionals = additionals
+	return message
+}
+
+// packWithinLimit packs the message in no more than limit bytes. Additional
+// records are dropped first; when answers still do not fit, the message is
+// sent with the TC bit, without authorities and with the answers that fit,
+// down to question and OPT record only (RFC 2181 - 9).
+func packWithinLimit(message *dnsmessage.Message, limit int) ([]byte, error) {
+	packed, err := message.Pack()
+	if err != nil || len(packed) <= limit {
+		return packed, err
+	}
+	var opt = make([]dnsmessage.Resource, 0)
+	for _, r := range message.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			opt = append(opt, r)
+		}
+	}
+	if len(opt) < len(message.Additionals) {
+		message.Additionals = opt
+		packed, err = message.Pack()
+		if err != nil || len(packed) <= limit {
+			return packed, err
+		}
+	}
+	message.Header.Truncated = true
+	message.Authorities = []dnsmessage.Resource{}
+	for {
+		packed, err = message.Pack()
+		if err != nil || len(packed) <= limit || len(message.Answers) == 0 {
+			return packed, err
+		}
+		message.Answers = message.Answers[:len(message.Answers)-1]
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"github.com/hellgate75/rebind/data"
+	"github.com/hellgate75/rebind/utils"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Weight of the last answer time in the forwarder latency average
+	healthLatencyWeight float64 = 0.3
+	// Consecutive failures before a forwarder is ejected
+	healthMaxFailures int = 3
+	// Time a failing forwarder is left out of the selection
+	healthEjectionTime time.Duration = 30 * time.Second
+)
+
+// upstreamHealth is the passive health state of a forwarder
+type upstreamHealth struct {
+	// Exponentially weighted moving average of the answer time
+	Latency time.Duration
+	// Consecutive failures since the last answer
+	Failures int
+	// Answers received from the forwarder
+	Answers int64
+	// Time the forwarder comes back in the selection, when ejected
+	EjectedUntil time.Time
+}
+
+// ejected reports whether the forwarder is left out of the selection. When the
+// ejection is over the failures are forgotten, the forwarder is ejected again
+// only after as many consecutive failures.
+func (h *upstreamHealth) ejected(now time.Time) bool {
+	if h.EjectedUntil.IsZero() {
+		return false
+	}
+	if h.EjectedUntil.After(now) {
+		return true
+	}
+	h.EjectedUntil = time.Time{}
+	h.Failures = 0
+	return false
+}
+
+// upstreamTracker orders the forwarders as per group policy, keeping
+// track of their health from the outcome of the forwarded queries
+type upstreamTracker struct {
+	sync.Mutex
+	health map[string]*upstreamHealth
+	turns  map[string]int
+	random *rand.Rand
+}
+
+// Order returns the forwarders in the order they have to be tried. Ejected
+// forwarders are moved to the end of the list, as last resort.
+func (t *upstreamTracker) Order(policy data.ForwardPolicy, fwds []net.UDPAddr) []net.UDPAddr {
+	t.Lock()
+	defer t.Unlock()
+	var ordered = make([]net.UDPAddr, len(fwds))
+	copy(ordered, fwds)
+	now := time.Now()
+	for _, fwd := range ordered {
+		if h, ok := t.health[utils.UpdAddrToString(fwd)]; ok {
+			h.ejected(now)
+		}
+	}
+	switch policy {
+	case data.RoundRobinPolicy:
+		if len(ordered) > 1 {
+			key := forwardersKey(fwds)
+			turn := t.turns[key] % len(ordered)
+			t.turns[key] = turn + 1
+			ordered = append(ordered[turn:], ordered[:turn]...)
+		}
+	case data.RandomPolicy:
+		t.random.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	case data.LowestLatencyPolicy:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return t.latencyOf(ordered[i]) < t.latencyOf(ordered[j])
+		})
+	}
+	var healthy = make([]net.UDPAddr, 0)
+	var ejected = make([]net.UDPAddr, 0)
+	for _, fwd := range ordered {
+		if h, ok := t.health[utils.UpdAddrToString(fwd)]; ok && h.ejected(now) {
+			ejected = append(ejected, fwd)
+		} else {
+			healthy = append(healthy, fwd)
+		}
+	}
+	return append(healthy, ejected...)
+}
+
+// Success records an answer of the forwarder, received after the given time
+func (t *upstreamTracker) Success(fwd net.UDPAddr, elapsed time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	h := t.healthOf(fwd)
+	if h.Answers == 0 {
+		h.Latency = elapsed
+	} else {
+		h.Latency = time.Duration(healthLatencyWeight*float64(elapsed) + (1-healthLatencyWeight)*float64(h.Latency))
+	}
+	h.Answers++
+	h.Failures = 0
+	h.EjectedUntil = time.Time{}
+}
+
+// Failure records a forwarder failure, ejecting it after too many consecutive ones
+func (t *upstreamTracker) Failure(fwd net.UDPAddr) {
+	t.Lock()
+	defer t.Unlock()
+	h := t.healthOf(fwd)
+	h.ejected(time.Now())
+	h.Failures++
+	if h.Failures >= healthMaxFailures {
+		h.EjectedUntil = time.Now().Add(healthEjectionTime)
+	}
+}
+
+// Prune forgets the forwarders no longer configured and the round-robin turns
+// of the forwarder sets including any of them
+func (t *upstreamTracker) Prune(fwds []net.UDPAddr) {
+	t.Lock()
+	defer t.Unlock()
+	var configured = make(map[string]bool)
+	for _, fwd := range fwds {
+		configured[utils.UpdAddrToString(fwd)] = true
+	}
+	for key := range t.health {
+		if !configured[key] {
+			delete(t.health, key)
+		}
+	}
+	for key := range t.turns {
+		for _, fwd := range strings.Split(key, ",") {
+			if !configured[fwd] {
+				delete(t.turns, key)
+				break
+			}
+		}
+	}
+}
+
+func (t *upstreamTracker) healthOf(fwd net.UDPAddr) *upstreamHealth {
+	key := utils.UpdAddrToString(fwd)
+	h, ok := t.health[key]
+	if !ok {
+		h = &upstreamHealth{}
+		t.health[key] = h
+	}
+	return h
+}
+
+// latencyOf returns the forwarder latency, each failure weights as a timeout.
+// Unknown forwarders come first, to get measured.
+func (t *upstreamTracker) latencyOf(fwd net.UDPAddr) time.Duration {
+	if h, ok := t.health[utils.UpdAddrToString(fwd)]; ok {
+		return h.Latency + time.Duration(h.Failures)*upstreamTimeout
+	}
+	return 0
+}
+
+func forwardersKey(fwds []net.UDPAddr) string {
+	var keys = make([]string, 0)
+	for _, fwd := range fwds {
+		keys = append(keys, utils.UpdAddrToString(fwd))
+	}
+	return strings.Join(keys, ",")
+}
+
+// newUpstreamTracker creates an empty forwarders health tracker
+func newUpstreamTracker() *upstreamTracker {
+	return &upstreamTracker{
+		health: make(map[string]*upstreamHealth),
+		turns:  make(map[string]int),
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"fmt"
+	"github.com/hellgate75/rebind/model"
+	"github.com/hellgate75/rebind/utils"
+	"golang.org/x/net/dns/dnsmessage"
+	"strings"
+)
+
+// questionName returns the lower case name of a question, without the trailing dot
+func questionName(q dnsmessage.Question) string {
+	qRep, _ := utils.ReplaceQuestionUnrelated(strings.ToLower(q.Name.String()))
+	return qRep
+}
+
+// questionKey returns the answers cache key of a question, made of name, type and class
+func questionKey(q dnsmessage.Question) string {
+	return fmt.Sprintf("%s|%v|%v", questionName(q), uint16(q.Type), uint16(q.Class))
+}
+
+// filterAnswers returns the records answering a question type,
+// CNAME records answer any question type for the name
+func filterAnswers(records []dnsmessage.Resource, qType dnsmessage.Type) []dnsmessage.Resource {
+	var answers = make([]dnsmessage.Resource, 0)
+	for _, r := range records {
+		if qType == dnsmessage.TypeALL || r.Header.Type == qType || r.Header.Type == dnsmessage.TypeCNAME {
+			answers = append(answers, r)
+		}
+	}
+	return answers
+}
+
+// zoneAuthority returns the SOA record of the closest enclosing zone, with the
+// TTL lowered to the SOA minimum, as required in negative answers (RFC 2308 - 3)
+func zoneAuthority(authority []dnsmessage.Resource) []dnsmessage.Resource {
+	var soa *dnsmessage.Resource
+	for i, r := range authority {
+		if r.Header.Type != dnsmessage.TypeSOA {
+			continue
+		}
+		if soa == nil || r.Header.Name.Length > soa.Header.Name.Length {
+			soa = &authority[i]
+		}
+	}
+	if soa == nil {
+		return []dnsmessage.Resource{}
+	}
+	out := *soa
+	if body, ok := out.Body.(*dnsmessage.SOAResource); ok && body.MinTTL < out.Header.TTL {
+		out.Header.TTL = body.MinTTL
+	}
+	return []dnsmessage.Resource{out}
+}
+
+// replyNegative answers the client with no records and the given response code,
+// the zone SOA record is added to the authority section when available
+func (s *dnsService) replyNegative(p model.Packet, rCode dnsmessage.RCode, authority []dnsmessage.Resource) {
+	p.Message.Header.RCode = rCode
+	p.Message.Answers = []dnsmessage.Resource{}
+	p.Message.Authorities = zoneAuthority(authority)
+	p.Message.Header.Authoritative = len(p.Message.Authorities) > 0
+	s.reply(p)
+}
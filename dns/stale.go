@@ -0,0 +1,70 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"github.com/hellgate75/rebind/model"
+	"golang.org/x/net/dns/dnsmessage"
+	"time"
+)
+
+const (
+	// TTL of the expired answers served when forwarders fail (RFC 8767 - 4)
+	staleAnswerTTL uint32 = 30
+	// Answers are prefetched in the last part of their TTL, in percent
+	prefetchTTLPercent int64 = 10
+	// Answers are prefetched only when served at least this number of times
+	prefetchMinHits int64 = 2
+)
+
+// isEnabled returns the group setting, when set, or the server one
+func isEnabled(groupValue *bool, serverValue bool) bool {
+	if groupValue != nil {
+		return *groupValue
+	}
+	return serverValue
+}
+
+// replyStale answers the client with an expired cached answer, if any
+func (s *dnsService) replyStale(p model.Packet) bool {
+	qKey := questionKey(p.Message.Questions[0])
+	stale, err := s.Answers.GetStale(qKey, staleAnswerTTL)
+	if err != nil {
+		return false
+	}
+	s.log.Warnf("DNSServer: Forwarders failed, answering %s with stale answer", qKey)
+	p.Message.Header.RCode = stale.RCode
+	p.Message.Answers = append(p.Message.Answers, stale.Answer...)
+	p.Message.Authorities = stale.Authority
+	s.reply(p)
+	return true
+}
+
+// needsPrefetch checks a popular answer is close to expiry
+func needsPrefetch(block model.AnswerBlock) bool {
+	return !block.Negative && block.Hits >= prefetchMinHits &&
+		block.Remaining() <= time.Duration(int64(block.TTL)*prefetchTTLPercent/100)
+}
+
+// prefetch refreshes in background the cached answer of a forwarded question,
+// when prefetch is enabled for the group in charge of the name
+func (s *dnsService) prefetch(p model.Packet, hostname string) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.log.Errorf("DNSServer: Prefetch runtime error: %v", r)
+		}
+	}()
+	result := s.Store.Lookup(hostname)
+	if !isEnabled(result.Prefetch, s.Cache.Prefetch) || len(result.Forwarders) == 0 ||
+		len(filterAnswers(result.Records, p.Message.Questions[0].Type)) > 0 {
+		return
+	}
+	s.log.Debugf("DNSServer: Prefetching answer for %s", questionKey(p.Message.Questions[0]))
+	p.Message.Answers = []dnsmessage.Resource{}
+	p.Message.Authorities = []dnsmessage.Resource{}
+	if _, err, _ := s.resolve(p, result.Forwarders, result.Policy); err != nil {
+		s.log.Warnf("DNSServer: Prefetch of %s failed -> Error: %v", hostname, err)
+	}
+}
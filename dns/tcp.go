@@ -0,0 +1,160 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"encoding/binary"
+	errs "errors"
+	"fmt"
+	"github.com/hellgate75/rebind/model"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DNS over TCP idle time allowed between two queries (RFC 7766 - 6.2.3)
+	tcpIdleTimeout time.Duration = 10 * time.Second
+	// DNS over TCP max time to write an answer
+	tcpWriteTimeout time.Duration = 5 * time.Second
+	// DNS over TCP max number of concurrent client connections
+	tcpMaxConnections int = 256
+	// DNS over TCP max number of pipelined queries in progress on a connection
+	tcpMaxPipelinedQueries int = 32
+	// DNS over TCP max message length, as per 2 bytes length prefix
+	tcpMaxMessageLen int = 65535
+	// DNS over TCP max wait before accepting again after a temporary error
+	tcpMaxAcceptDelay time.Duration = time.Second
+)
+
+// tcpWriter answers to a client on its TCP connection, prefixing
+// each message with the 2 bytes length (RFC 7766 - 8). Pipelined
+// queries can be answered out of order, so writes are serialized.
+type tcpWriter struct {
+	sync.Mutex
+	conn net.Conn
+}
+
+func (w *tcpWriter) Write(packed []byte) error {
+	if len(packed) > tcpMaxMessageLen {
+		return errs.New(fmt.Sprintf("message length %v exceeds the TCP limit of %v bytes", len(packed), tcpMaxMessageLen))
+	}
+	buf := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(buf, uint16(len(packed)))
+	copy(buf[2:], packed)
+	w.Lock()
+	defer w.Unlock()
+	_ = w.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	_, err := w.conn.Write(buf)
+	return err
+}
+
+func (w *tcpWriter) Network() string {
+	return "tcp"
+}
+
+// serveTCP accepts DNS over TCP clients, up to the connections limit
+func (s *dnsService) serveTCP(listener net.Listener) {
+	slots := make(chan struct{}, s.TCPMaxConnections)
+	var delay time.Duration
+	for s._started {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !s._started {
+				return
+			}
+			// temporary errors, e.g. too many open files, are retried with backoff
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > tcpMaxAcceptDelay {
+					delay = tcpMaxAcceptDelay
+				}
+				s.log.Errorf("DNSServer: Error accepting TCP client, retrying in %v -> Error: %v", delay, err)
+				time.Sleep(delay)
+				continue
+			}
+			// closed or broken listener
+			s.log.Errorf("DNSServer: Error accepting TCP client, stop listening on %s -> Error: %v", listener.Addr().String(), err)
+			return
+		}
+		delay = 0
+		select {
+		case slots <- struct{}{}:
+			go func() {
+				defer func() {
+					<-slots
+				}()
+				s.handleTCPConn(conn)
+			}()
+		default:
+			s.log.Warnf("DNSServer: Reached %v TCP connections, refusing client: %s", s.TCPMaxConnections, conn.RemoteAddr().String())
+			_ = conn.Close()
+		}
+	}
+}
+
+// handleTCPConn reads length prefixed queries from a client connection
+// until the client closes it or stays idle for longer than the idle timeout
+func (s *dnsService) handleTCPConn(conn net.Conn) {
+	var pending sync.WaitGroup
+	defer func() {
+		if r := recover(); r != nil {
+			s.log.Errorf("DNSServer: TCP client %s runtime error: %v", conn.RemoteAddr().String(), r)
+		}
+		pending.Wait()
+		_ = conn.Close()
+	}()
+	var addr net.UDPAddr
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		addr = net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port, Zone: tcpAddr.Zone}
+	}
+	writer := &tcpWriter{conn: conn}
+	pipeline := make(chan struct{}, tcpMaxPipelinedQueries)
+	lenBuf := make([]byte, 2)
+	for s._started {
+		_ = conn.SetReadDeadline(time.Now().Add(s.TCPIdleTimeout))
+		if _, err := io.ReadFull(conn, lenBuf); err != nil {
+			if err != io.EOF {
+				s.log.Debugf("DNSServer: Closing TCP client %s -> Reason: %v", addr.String(), err)
+			}
+			return
+		}
+		length := binary.BigEndian.Uint16(lenBuf)
+		if length == 0 {
+			return
+		}
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			s.log.Errorf("DNSServer: Error reading TCP request from %s -> Error: %v", addr.String(), err)
+			return
+		}
+		var m dnsmessage.Message
+		if err := m.Unpack(buf); err != nil {
+			// Stream cannot be trusted any longer, close the connection
+			s.log.Errorf("DNSServer: Error unpacking TCP request from %s -> Error: %v", addr.String(), err)
+			return
+		}
+		s.log.Debugf("DNSServer: TCP Questions: %v", len(m.Questions))
+		if len(m.Questions) == 0 {
+			continue
+		}
+		pipeline <- struct{}{}
+		pending.Add(1)
+		go func(p model.Packet) {
+			defer func() {
+				<-pipeline
+				pending.Done()
+			}()
+			s.Query(p)
+		}(model.Packet{
+			Addr:    addr,
+			Message: m,
+			Writer:  writer,
+		})
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	errs "errors"
+	"fmt"
+	"github.com/hellgate75/rebind/data"
+	"github.com/hellgate75/rebind/log"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// Max time waiting for a forwarder answer, before trying the next one
+	upstreamTimeout time.Duration = 2 * time.Second
+)
+
+// upstreamClient sends queries to the forwarders. Each query goes out from its
+// own UDP socket, so from a random source port, with a random message ID.
+// Answers not matching the query are discarded.
+type upstreamClient struct {
+	Timeout time.Duration
+	Health  *upstreamTracker
+	log     log.Logger
+}
+
+// Exchange sends the message to the forwarders, one after the other in the policy
+// order, until one of them answers in time and not with SERVFAIL or REFUSED. The
+// answer carries the ID of the original message.
+func (c *upstreamClient) Exchange(message dnsmessage.Message, fwds []net.UDPAddr, policy data.ForwardPolicy) (dnsmessage.Message, error) {
+	var err error
+	for _, fwd := range c.Health.Order(policy, fwds) {
+		var answer dnsmessage.Message
+		start := time.Now()
+		answer, err = c.exchangeWith(message, fwd)
+		if err == nil {
+			err = answerError(answer)
+		}
+		if err == nil {
+			c.Health.Success(fwd, time.Since(start))
+			answer.Header.ID = message.Header.ID
+			return answer, nil
+		}
+		c.Health.Failure(fwd)
+		c.log.Warnf("DNSServer: Forwarder %s failed -> Error: %v", fwd.String(), err)
+	}
+	if err == nil {
+		err = errs.New("no forwarders available")
+	}
+	return dnsmessage.Message{}, err
+}
+
+// answerError reports the answers of a forwarder unable to resolve the query,
+// the next forwarder may resolve it
+func answerError(answer dnsmessage.Message) error {
+	switch answer.Header.RCode {
+	case dnsmessage.RCodeServerFailure, dnsmessage.RCodeRefused:
+		return errs.New(fmt.Sprintf("forwarder answered %v", answer.Header.RCode))
+	}
+	return nil
+}
+
+func (c *upstreamClient) exchangeWith(message dnsmessage.Message, fwd net.UDPAddr) (dnsmessage.Message, error) {
+	deadline := time.Now().Add(c.Timeout)
+	id, err := randomID()
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	message.Header.ID = id
+	message.Header.Response = false
+	packed, err := message.Pack()
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	answer, err := c.exchangeUDP(packed, message, fwd, deadline)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	if answer.Header.Truncated {
+		c.log.Debugf("DNSServer: Truncated answer from %s, retrying over TCP", fwd.String())
+		return c.exchangeTCP(packed, message, fwd, time.Now().Add(c.Timeout))
+	}
+	return answer, nil
+}
+
+func (c *upstreamClient) exchangeUDP(packed []byte, message dnsmessage.Message, fwd net.UDPAddr, deadline time.Time) (dnsmessage.Message, error) {
+	conn, err := net.DialUDP("udp", nil, &fwd)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(deadline)
+	if _, err = conn.Write(packed); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	buf := make([]byte, udpReadBufferLen)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return dnsmessage.Message{}, err
+		}
+		var answer dnsmessage.Message
+		if err := answer.Unpack(buf[:n]); err != nil || !isAnswerOf(answer, message) {
+			c.log.Warnf("DNSServer: Discarded unexpected answer from %s", fwd.String())
+			continue
+		}
+		return answer, nil
+	}
+}
+
+func (c *upstreamClient) exchangeTCP(packed []byte, message dnsmessage.Message, fwd net.UDPAddr, deadline time.Time) (dnsmessage.Message, error) {
+	if len(packed) > tcpMaxMessageLen {
+		return dnsmessage.Message{}, errs.New(fmt.Sprintf("message length %v exceeds the TCP limit of %v bytes", len(packed), tcpMaxMessageLen))
+	}
+	conn, err := net.DialTimeout("tcp", fwd.String(), time.Until(deadline))
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(deadline)
+	buf := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(buf, uint16(len(packed)))
+	copy(buf[2:], packed)
+	if _, err = conn.Write(buf); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	lenBuf := make([]byte, 2)
+	if _, err = io.ReadFull(conn, lenBuf); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	buf = make([]byte, binary.BigEndian.Uint16(lenBuf))
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	var answer dnsmessage.Message
+	if err = answer.Unpack(buf); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	if !isAnswerOf(answer, message) {
+		return dnsmessage.Message{}, errs.New("answer doesn't match the query")
+	}
+	return answer, nil
+}
+
+// randomID returns a random message ID, the query socket tells apart the answers
+func randomID() (uint16, error) {
+	buf := make([]byte, 2)
+	if _, err := rand.Read(buf); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(buf), nil
+}
+
+// isAnswerOf checks the answer matches ID and question of the query
+func isAnswerOf(answer dnsmessage.Message, query dnsmessage.Message) bool {
+	if !answer.Header.Response || answer.Header.ID != query.Header.ID ||
+		len(answer.Questions) != len(query.Questions) {
+		return false
+	}
+	for i, q := range query.Questions {
+		a := answer.Questions[i]
+		if a.Type != q.Type || a.Class != q.Class || !equalNames(a.Name, q.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// equalNames compares two domain names, case insensitive
+func equalNames(n1 dnsmessage.Name, n2 dnsmessage.Name) bool {
+	if n1.Length != n2.Length {
+		return false
+	}
+	for i := 0; i < int(n1.Length); i++ {
+		b1, b2 := n1.Data[i], n2.Data[i]
+		if 'A' <= b1 && b1 <= 'Z' {
+			b1 += 'a' - 'A'
+		}
+		if 'A' <= b2 && b2 <= 'Z' {
+			b2 += 'a' - 'A'
+		}
+		if b1 != b2 {
+			return false
+		}
+	}
+	return true
+}
+
+// newUpstreamClient creates a forwarders client
+func newUpstreamClient(logger log.Logger) *upstreamClient {
+	return &upstreamClient{
+		Timeout: upstreamTimeout,
+		Health:  newUpstreamTracker(),
+		log:     logger,
+	}
+}
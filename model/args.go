@@ -33,6 +33,13 @@ type ReWebConfig struct {
 	DnsPipeIP           string `yaml:"dnsPipeIp" json:"dnsPipeIp" xml:"dns-pipe-ip"`
 	DnsPipePort         int    `yaml:"dnsPipePort" json:"dnsPipePort" xml:"dns-pipe-port"`
 	DnsPipeResponsePort int    `yaml:"dnsPipeResponsePort" json:"dnsPipeResponsePort" xml:"dns-pipe-response-port"`
+	DnsPipeSocket       string `yaml:"dnsPipeSocket,omitempty" json:"dnsPipeSocket,omitempty" xml:"dns-pipe-socket,omitempty"`
+	DnsPipeSecretFile   string `yaml:"dnsPipeSecretFile,omitempty" json:"dnsPipeSecretFile,omitempty" xml:"dns-pipe-secret-file,omitempty"`
+	DnsPipeTlsCert      string `yaml:"dnsPipeTlsCertFilePath,omitempty" json:"dnsPipeTlsCertFilePath,omitempty" xml:"dns-pipe-tls-cert-file-path,omitempty"`
+	DnsPipeTlsKey       string `yaml:"dnsPipeTlsKeyFilePath,omitempty" json:"dnsPipeTlsKeyFilePath,omitempty" xml:"dns-pipe-tls-key-file-path,omitempty"`
+	DnsPipeTlsCA        string `yaml:"dnsPipeTlsCaFilePath,omitempty" json:"dnsPipeTlsCaFilePath,omitempty" xml:"dns-pipe-tls-ca-file-path,omitempty"`
+	DataBackend         string `yaml:"dataBackend,omitempty" json:"dataBackend,omitempty" xml:"data-backend,omitempty"`
+	RemoteStore         bool   `yaml:"remoteStore,omitempty" json:"remoteStore,omitempty" xml:"remote-store,omitempty"`
 	TlsCert             string `yaml:"tlsCertFilePath" json:"tlsCertFilePath" xml:"tls-cert-file-path"`
 	TlsKey              string `yaml:"tlsKeyFilePath" json:"tlsKeyFilePath" xml:"tls-key-file-path"`
 	EnableFileLogging   bool   `yaml:"enableFileLogging" json:"enableFileLogging" xml:"enable-file-logging"`
@@ -43,20 +50,61 @@ type ReWebConfig struct {
 	LogFileCount        int    `yaml:"logFileCount" json:"logFileCount" xml:"log-file-count"`
 }
 
+// DNS answers cache configuration, time values in seconds, memory in bytes
+type CacheConfig struct {
+	MinTTL     uint32 `yaml:"minTtl" json:"minTtl" xml:"min-ttl"`
+	MaxTTL     uint32 `yaml:"maxTtl" json:"maxTtl" xml:"max-ttl"`
+	MaxEntries int    `yaml:"maxEntries" json:"maxEntries" xml:"max-entries"`
+	MaxMemory  int64  `yaml:"maxMemory" json:"maxMemory" xml:"max-memory"`
+	// Ceiling of negative answers TTL
+	NegativeMaxTTL uint32 `yaml:"negativeMaxTtl" json:"negativeMaxTtl" xml:"negative-max-ttl"`
+	// Expired answers served when forwarders fail, up to the stale window after expiry
+	ServeStale  bool   `yaml:"serveStale" json:"serveStale" xml:"serve-stale"`
+	StaleWindow uint32 `yaml:"staleWindow" json:"staleWindow" xml:"stale-window"`
+	// Popular answers refreshed in background before expiry
+	Prefetch bool `yaml:"prefetch" json:"prefetch" xml:"prefetch"`
+}
+
+// Journal of the records changes, intervals in seconds
+type JournalConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled" xml:"enabled"`
+	// Snapshots are taken at every interval and when the entries since the last one exceed max entries
+	SnapshotInterval uint `yaml:"snapshotInterval" json:"snapshotInterval" xml:"snapshot-interval"`
+	MaxEntries       int  `yaml:"maxEntries" json:"maxEntries" xml:"max-entries"`
+	// Snapshots kept for point-in-time recovery
+	Snapshots int `yaml:"snapshots" json:"snapshots" xml:"snapshots"`
+}
+
 type ReBindConfig struct {
-	DataDirPath         string `yaml:"dataDir" json:"dataDir" xml:"data-dir"`
-	ConfigDirPath       string `yaml:"configDir" json:"configDir" xml:"config-dir"`
-	ListenIP            string `yaml:"listenIp" json:"listenIp" xml:"listen-ip"`
-	ListenPort          int    `yaml:"listenPort" json:"listenPort" xml:"listen-port"`
-	DnsPipeIP           string `yaml:"dnsPipeIp" json:"dnsPipeIp" xml:"dns-pipe-ip"`
-	DnsPipePort         int    `yaml:"dnsPipePort" json:"dnsPipePort" xml:"dns-pipe-port"`
-	DnsPipeResponsePort int    `yaml:"dnsPipeResponsePort" json:"dnsPipeResponsePort" xml:"dns-pipe-response-port"`
-	EnableFileLogging   bool   `yaml:"enableFileLogging" json:"enableFileLogging" xml:"enable-file-logging"`
-	LogVerbosity        string `yaml:"logVerbosity" json:"logVerbosity" xml:"log-verbosity"`
-	LogFilePath         string `yaml:"logFilePath" json:"logFilePath" xml:"log-file-path"`
-	EnableLogRotate     bool   `yaml:"enableLogRotate" json:"enableLogRotate" xml:"enable-log-rotate"`
-	LogMaxFileSize      int64  `yaml:"logMaxFileSize" json:"logMaxFileSize" xml:"log-max-file-size"`
-	LogFileCount        int    `yaml:"logFileCount" json:"logFileCount" xml:"log-file-count"`
+	DataDirPath         string      `yaml:"dataDir" json:"dataDir" xml:"data-dir"`
+	ConfigDirPath       string      `yaml:"configDir" json:"configDir" xml:"config-dir"`
+	ListenIP            string      `yaml:"listenIp" json:"listenIp" xml:"listen-ip"`
+	ListenIPs           []string    `yaml:"listenIps,omitempty" json:"listenIps,omitempty" xml:"listen-ips,omitempty"`
+	ListenPort          int         `yaml:"listenPort" json:"listenPort" xml:"listen-port"`
+	DnsPipeIP           string      `yaml:"dnsPipeIp" json:"dnsPipeIp" xml:"dns-pipe-ip"`
+	DnsPipePort         int         `yaml:"dnsPipePort" json:"dnsPipePort" xml:"dns-pipe-port"`
+	DnsPipeResponsePort int         `yaml:"dnsPipeResponsePort" json:"dnsPipeResponsePort" xml:"dns-pipe-response-port"`
+	DnsPipeSocket       string      `yaml:"dnsPipeSocket,omitempty" json:"dnsPipeSocket,omitempty" xml:"dns-pipe-socket,omitempty"`
+	DnsPipeSecretFile   string      `yaml:"dnsPipeSecretFile,omitempty" json:"dnsPipeSecretFile,omitempty" xml:"dns-pipe-secret-file,omitempty"`
+	DnsPipeTlsCert      string      `yaml:"dnsPipeTlsCertFilePath,omitempty" json:"dnsPipeTlsCertFilePath,omitempty" xml:"dns-pipe-tls-cert-file-path,omitempty"`
+	DnsPipeTlsKey       string      `yaml:"dnsPipeTlsKeyFilePath,omitempty" json:"dnsPipeTlsKeyFilePath,omitempty" xml:"dns-pipe-tls-key-file-path,omitempty"`
+	DnsPipeTlsCA        string      `yaml:"dnsPipeTlsCaFilePath,omitempty" json:"dnsPipeTlsCaFilePath,omitempty" xml:"dns-pipe-tls-ca-file-path,omitempty"`
+	DataBackend         string      `yaml:"dataBackend,omitempty" json:"dataBackend,omitempty" xml:"data-backend,omitempty"`
+	EnableFileLogging   bool        `yaml:"enableFileLogging" json:"enableFileLogging" xml:"enable-file-logging"`
+	LogVerbosity        string      `yaml:"logVerbosity" json:"logVerbosity" xml:"log-verbosity"`
+	LogFilePath         string      `yaml:"logFilePath" json:"logFilePath" xml:"log-file-path"`
+	EnableLogRotate     bool        `yaml:"enableLogRotate" json:"enableLogRotate" xml:"enable-log-rotate"`
+	LogMaxFileSize      int64       `yaml:"logMaxFileSize" json:"logMaxFileSize" xml:"log-max-file-size"`
+	LogFileCount        int         `yaml:"logFileCount" json:"logFileCount" xml:"log-file-count"`
+	Cache               CacheConfig `yaml:"cache" json:"cache" xml:"cache"`
+	// Journal of the records changes, group stores are saved at the snapshots
+	Journal JournalConfig `yaml:"journal,omitempty" json:"journal,omitempty" xml:"journal,omitempty"`
+	// All-in-one mode, the Rest server runs in the same process sharing the store
+	WithRest       bool   `yaml:"withRest,omitempty" json:"withRest,omitempty" xml:"with-rest,omitempty"`
+	RestListenIP   string `yaml:"restListenIp,omitempty" json:"restListenIp,omitempty" xml:"rest-listen-ip,omitempty"`
+	RestListenPort int    `yaml:"restListenPort,omitempty" json:"restListenPort,omitempty" xml:"rest-listen-port,omitempty"`
+	RestTlsCert    string `yaml:"restTlsCertFilePath,omitempty" json:"restTlsCertFilePath,omitempty" xml:"rest-tls-cert-file-path,omitempty"`
+	RestTlsKey     string `yaml:"restTlsKeyFilePath,omitempty" json:"restTlsKeyFilePath,omitempty" xml:"rest-tls-key-file-path,omitempty"`
 }
 
 func SaveConfig(path string, name string, config interface{}) error {
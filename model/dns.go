@@ -12,7 +12,7 @@ import (
 
 // DNSServer will do Listen, Query and Send.
 type DNSServer interface {
-	Listen(ipAddress string, port int, pipeAddress string, pipePort int, pipeResponsePort int) error
+	Listen(ipAddresses []string, port int, pipeAddress string, pipePort int, pipeResponsePort int) error
 	Query(Packet)
 	GetService() DNSService
 	Wait()
@@ -25,10 +25,28 @@ type DNSService interface {
 	Remove(key string, r *dnsmessage.Resource) bool
 }
 
+// PacketWriter sends back an answer to the client a Packet came from.
+type PacketWriter interface {
+	// Write sends a packed DNS message
+	Write(packed []byte) error
+	// Network returns the transport the client is using (udp or tcp)
+	Network() string
+}
+
+// EDNS carries the EDNS(0) OPT pseudo-record data of a request (RFC 6891).
+type EDNS struct {
+	Enabled  bool
+	Version  uint8
+	UDPSize  uint16
+	DNSSECOk bool
+}
+
 // Packet carries DNS packet payload and sender address.
 type Packet struct {
 	Addr    net.UDPAddr
 	Message dnsmessage.Message
+	EDNS    EDNS
+	Writer  PacketWriter `json:"-"`
 }
 
 // Collects indformation about any answer
@@ -36,11 +54,30 @@ type AnswerBlock struct {
 	Created time.Time
 	TTL     time.Duration
 	Answer  []dnsmessage.Resource
+	// Negative answers (NXDOMAIN / NODATA) response code and zone SOA
+	Negative  bool
+	RCode     dnsmessage.RCode
+	Authority []dnsmessage.Resource
+	// Number of times the answer has been served
+	Hits int64
 }
 
 func (answer *AnswerBlock) IsValid() bool {
-	return int64((time.Now().Nanosecond() - answer.Created.Nanosecond())) >= int64(answer.TTL.Nanoseconds())
+	return time.Now().Before(answer.Expires())
+}
 
+// Expires returns the time the answer expires at
+func (answer *AnswerBlock) Expires() time.Time {
+	return answer.Created.Add(answer.TTL)
+}
+
+// Remaining returns the answer time to live left, zero when expired
+func (answer *AnswerBlock) Remaining() time.Duration {
+	remaining := time.Until(answer.Expires())
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
 }
 
 type Get struct {
@@ -89,4 +126,13 @@ type Response struct {
 	Status  int         `yaml:"status" json:"status" xml:"status"`
 	Message string      `yaml:"message" json:"message" xml:"message"`
 	Data    interface{} `yaml:"data" json:"data" xml:"data"`
+	// Outcome of the change propagation to the DNS server, for changing requests
+	Propagation *Propagation `yaml:"propagation,omitempty" json:"propagation,omitempty" xml:"propagation,omitempty"`
+}
+
+// Propagation reports whether the DNS server applied a change
+type Propagation struct {
+	Command string `yaml:"command" json:"command" xml:"command"`
+	Status  string `yaml:"status" json:"status" xml:"status"`
+	Error   string `yaml:"error,omitempty" json:"error,omitempty" xml:"error,omitempty"`
 }
@@ -23,6 +23,18 @@ const (
 	DefaultDnsPipeAddress           = "127.0.0.1"
 	DefaultDnsPipePort              = 953
 	DefaultDnsAnswerPipePort        = 954
+	DefaultCacheMinTTL       uint32 = 0
+	DefaultCacheMaxTTL       uint32 = 86400
+	DefaultCacheMaxEntries          = store.DEFAULT_ANSWER_CACHE_MAX_ENTRIES
+	DefaultCacheMaxMemory           = store.DEFAULT_ANSWER_CACHE_MAX_MEMORY
+	DefaultCacheNegativeTTL  uint32 = 3600
+	DefaultCacheStaleWindow  uint32 = 86400
+)
+
+const (
+	DefaultSnapshotInterval   uint = 300
+	DefaultSnapshotMaxEntries      = 10000
+	DefaultSnapshotsKept           = 3
 )
 
 var (
@@ -99,6 +111,21 @@ type UpdateRequestForm struct {
 	NewValue   interface{}    `yaml:"value" json:"value" xml:"value"`
 }
 
+// BatchOperation is an operation of a batch on a group: field is resource,
+// domain or forwarder; resources use the record, domains and forwarders the
+// value and, for updates, the new value
+type BatchOperation struct {
+	Action   Action        `yaml:"action" json:"action" xml:"action"`
+	Field    string        `yaml:"field" json:"field" xml:"field"`
+	Record   model.Request `yaml:"record" json:"record" xml:"record"`
+	Value    string        `yaml:"value" json:"value" xml:"value"`
+	NewValue string        `yaml:"newValue" json:"newValue" xml:"new-value"`
+}
+
+type DnsBatchRequest struct {
+	Operations []BatchOperation `yaml:"operations" json:"operations" xml:"operations"`
+}
+
 type GroupCreationRequest struct {
 	Forwarders []net.UDPAddr `yaml:"fowarders" json:"fowarders" xml:"fowarders"`
 	Domains    []string      `yaml:"domains" json:"domains" xml:"domains"`
@@ -0,0 +1,90 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package net
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Command sent over a net pipe
+type Command string
+
+const (
+	// Reload all the groups, no payload, replies ReloadReply
+	ReloadCommand Command = "reload"
+	// Load a group store, payload LoadPayload, replies LoadReply
+	LoadCommand Command = "load"
+	// Stop the server, no payload and no reply payload
+	ShutdownCommand Command = "shutdown"
+)
+
+// Outcome of a command sent over a net pipe
+type CommandStatus string
+
+const (
+	// Command executed by the other side
+	CommandOk CommandStatus = "ok"
+	// Command failed on the other side
+	CommandFailed CommandStatus = "ko"
+	// No reply received in time
+	CommandTimeout CommandStatus = "timeout"
+	// Command not delivered to the other side
+	CommandNotSent CommandStatus = "not-sent"
+	// Default time waiting for a command reply
+	DEFAULT_COMMAND_TIMEOUT time.Duration = 5 * time.Second
+)
+
+// LoadPayload is the payload of the load command
+type LoadPayload struct {
+	Group string `yaml:"group" json:"group" xml:"group"`
+}
+
+// LoadReply is the reply payload of the load command
+type LoadReply struct {
+	Group   string `yaml:"group" json:"group" xml:"group"`
+	Records int64  `yaml:"records" json:"records" xml:"records"`
+}
+
+// ReloadReply is the reply payload of the reload command
+type ReloadReply struct {
+	Groups []string `yaml:"groups" json:"groups" xml:"groups"`
+}
+
+// CommandHandler executes a request, the returned value is the reply payload
+type CommandHandler func(ctx context.Context, request Request) (interface{}, error)
+
+// CommandHandlers is the registry of the handlers of the commands received by a pipe
+type CommandHandlers struct {
+	sync.RWMutex
+	handlers map[Command]CommandHandler
+}
+
+// Register sets the handler of a command, nil handler removes it
+func (h *CommandHandlers) Register(command Command, handler CommandHandler) {
+	h.Lock()
+	defer h.Unlock()
+	if handler == nil {
+		delete(h.handlers, command)
+		return
+	}
+	h.handlers[command] = handler
+}
+
+// Get returns the handler of a command
+func (h *CommandHandlers) Get(command Command) (CommandHandler, bool) {
+	h.RLock()
+	defer h.RUnlock()
+	handler, ok := h.handlers[command]
+	return handler, ok
+}
+
+// NewCommandHandlers creates an empty command handlers registry
+func NewCommandHandlers() *CommandHandlers {
+	return &CommandHandlers{
+		handlers: make(map[Command]CommandHandler),
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Frames waiting for the other side, further frames are refused
+	DEFAULT_QUEUE_SIZE int = 256
+	// First wait before connecting again, doubled on each failure
+	MIN_RECONNECT_DELAY time.Duration = 100 * time.Millisecond
+	// Longest wait before connecting again
+	MAX_RECONNECT_DELAY time.Duration = 10 * time.Second
+)
+
+// State of the connection to the other side of a pipe
+type ConnectionState string
+
+const (
+	// The pipe never sent anything or it only listens
+	NoConnection ConnectionState = "none"
+	// Connecting to the other side
+	Connecting ConnectionState = "connecting"
+	// Connected to the other side
+	Connected ConnectionState = "connected"
+	// Other side not reachable, waiting to connect again
+	Disconnected ConnectionState = "disconnected"
+)
+
+// PipeStatus describes the state of a pipe and of its connections
+type PipeStatus struct {
+	Running    bool            `yaml:"running" json:"running" xml:"running"`
+	Endpoint   string          `yaml:"endpoint" json:"endpoint" xml:"endpoint"`
+	Clients    int             `yaml:"clients" json:"clients" xml:"clients"`
+	Peer       string          `yaml:"peer,omitempty" json:"peer,omitempty" xml:"peer,omitempty"`
+	State      ConnectionState `yaml:"state" json:"state" xml:"state"`
+	Queued     int             `yaml:"queued" json:"queued" xml:"queued"`
+	Reconnects uint64          `yaml:"reconnects" json:"reconnects" xml:"reconnects"`
+	LastError  string          `yaml:"lastError,omitempty" json:"lastError,omitempty" xml:"last-error,omitempty"`
+}
+
+// outFrame is a frame waiting in the queue, dropped when its context is done
+type outFrame struct {
+	ctx   context.Context
+	frame Frame
+}
+
+// link is the long-lived connection to the other side of a pipe. Frames wait
+// in a bounded queue while the other side is not reachable, and the link
+// connects again with exponential backoff.
+type link struct {
+	sync.Mutex
+	p           *pipe
+	network     string
+	address     string
+	queue       chan outFrame
+	broken      chan struct{}
+	stop        chan struct{}
+	conn        net.Conn
+	state       ConnectionState
+	connections uint64
+	failures    uint64
+	lastError   error
+	closed      bool
+}
+
+// push queues a frame, it fails when the queue is full
+func (l *link) push(ctx context.Context, frame Frame) error {
+	select {
+	case l.queue <- outFrame{ctx: ctx, frame: frame}:
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("NetPipe.Send: Outbound queue to %s is full (%v frames)", l.address, cap(l.queue)))
+	}
+}
+
+// run writes the queued frames, connecting when needed, until the link is closed
+func (l *link) run() {
+	defer func() {
+		if r := recover(); r != nil {
+			l.p.log(errorLevel, "NetPipe.Link: Runtime error: %v", r)
+		}
+	}()
+	delay := MIN_RECONNECT_DELAY
+	var next *outFrame
+	for {
+		if l.current() == nil {
+			if err := l.connect(); err != nil {
+				l.failed(err)
+				if !l.wait(delay) {
+					return
+				}
+				delay = backoff(delay)
+				continue
+			}
+		}
+		if next == nil {
+			select {
+			case <-l.stop:
+				return
+			case <-l.broken:
+				continue
+			case item := <-l.queue:
+				next = &item
+			}
+		}
+		if err := next.ctx.Err(); err != nil {
+			l.p.log(debugLevel, "NetPipe.Link: Dropped %s frame %s -> Error: %v", next.frame.Type, next.frame.ID, err)
+			next = nil
+			continue
+		}
+		data, err := l.encode(next.frame)
+		if err != nil {
+			l.p.log(errorLevel, "NetPipe.Link: Dropped %s frame %s -> Error: %v", next.frame.Type, next.frame.ID, err)
+			next = nil
+			continue
+		}
+		if err = l.write(data); err != nil {
+			l.failed(err)
+			if !l.wait(delay) {
+				return
+			}
+			delay = backoff(delay)
+			continue
+		}
+		next = nil
+		delay = MIN_RECONNECT_DELAY
+	}
+}
+
+// encode signs a frame, at each attempt so that it doesn't expire in the queue
+func (l *link) encode(frame Frame) ([]byte, error) {
+	if err := l.p.sign(&frame); err != nil {
+		return nil, err
+	}
+	return encodeFrame(frame)
+}
+
+func (l *link) write(data []byte) error {
+	conn := l.current()
+	if conn == nil {
+		return errors.New(fmt.Sprintf("NetPipe.Link: Not connected to %s", l.address))
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(DEFAULT_COMMAND_TIMEOUT))
+	_, err := conn.Write(data)
+	if err != nil {
+		l.drop(conn)
+	}
+	return err
+}
+
+// wait sleeps before the next attempt, it returns false when the link is closed
+func (l *link) wait(delay time.Duration) bool {
+	select {
+	case <-l.stop:
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
+
+func backoff(delay time.Duration) time.Duration {
+	delay *= 2
+	if delay > MAX_RECONNECT_DELAY {
+		delay = MAX_RECONNECT_DELAY
+	}
+	return delay
+}
+
+func (l *link) current() net.Conn {
+	l.Lock()
+	defer l.Unlock()
+	return l.conn
+}
+
+func (l *link) connect() error {
+	l.Lock()
+	l.state = Connecting
+	l.Unlock()
+	conn, err := l.p.dial(l.network, l.address)
+	l.Lock()
+	defer l.Unlock()
+	if err != nil {
+		l.state = Disconnected
+		return err
+	}
+	if l.closed {
+		conn.Close()
+		return errors.New("NetPipe.Link: Link closed")
+	}
+	if conn.LocalAddr().String() == conn.RemoteAddr().String() {
+		// TCP simultaneous open on a local port with no listener
+		conn.Close()
+		l.state = Disconnected
+		return errors.New(fmt.Sprintf("NetPipe.Link: Connection to %s is connected to itself", l.address))
+	}
+	l.conn = conn
+	l.state = Connected
+	l.connections++
+	l.failures = 0
+	l.lastError = nil
+	l.p.log(infoLevel, "NetPipe.Link: Connected to %s", l.address)
+	go l.serve(conn)
+	return nil
+}
+
+// failed records a failure, logging only the first one of a sequence
+func (l *link) failed(err error) {
+	l.Lock()
+	defer l.Unlock()
+	l.failures++
+	l.lastError = err
+	if l.failures == 1 {
+		l.p.log(warnLevel, "NetPipe.Link: Connection to %s failed, retrying -> Error: %v", l.address, err)
+	} else {
+		l.p.log(debugLevel, "NetPipe.Link: Connection to %s failed %v times -> Error: %v", l.address, l.failures, err)
+	}
+}
+
+// serve reads the frames coming back on the connection, until it is closed
+func (l *link) serve(conn net.Conn) {
+	defer func() {
+		if r := recover(); r != nil {
+			l.p.log(errorLevel, "NetPipe.Link: Runtime error: %v", r)
+		}
+		l.drop(conn)
+	}()
+	if l.p._pType == PIPE_OUT {
+		_, _ = io.Copy(ioutil.Discard, conn)
+		return
+	}
+	l.p.handleFrames(conn, l.p.sendFrame)
+}
+
+// drop closes a broken connection, the link connects again
+func (l *link) drop(conn net.Conn) {
+	l.Lock()
+	defer l.Unlock()
+	conn.Close()
+	if l.conn != conn {
+		return
+	}
+	l.conn = nil
+	if !l.closed {
+		l.state = Disconnected
+	}
+	select {
+	case l.broken <- struct{}{}:
+	default:
+	}
+}
+
+// close stops the link, the queued frames are discarded
+func (l *link) close() {
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	close(l.stop)
+	if l.conn != nil {
+		l.conn.Close()
+		l.conn = nil
+	}
+	l.state = NoConnection
+}
+
+// status fills the connection fields of the pipe status
+func (l *link) status(status *PipeStatus) {
+	l.Lock()
+	defer l.Unlock()
+	status.Peer = l.address
+	status.State = l.state
+	status.Queued = len(l.queue)
+	if l.connections > 1 {
+		status.Reconnects = l.connections - 1
+	}
+	if l.lastError != nil {
+		status.LastError = l.lastError.Error()
+	}
+}
+
+func newLink(p *pipe, network string, address string, queueSize int) *link {
+	return &link{
+		p:       p,
+		network: network,
+		address: address,
+		queue:   make(chan outFrame, queueSize),
+		broken:  make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		state:   Disconnected,
+	}
+}
+
+// outbound returns the link to the other side, creating it on the first use
+func (p *pipe) outbound() *link {
+	p.linkMutex.Lock()
+	defer p.linkMutex.Unlock()
+	if p.link == nil {
+		if p.socketPath != "" {
+			p.link = newLink(p, "unix", p.socketPath, DEFAULT_QUEUE_SIZE)
+		} else {
+			p.link = newLink(p, "tcp", fmt.Sprintf("%s:%v", p.answerAddress, p.answerPort), DEFAULT_QUEUE_SIZE)
+		}
+		go p.link.run()
+	}
+	return p.link
+}
+
+// closeOutbound stops the link to the other side
+func (p *pipe) closeOutbound() {
+	p.linkMutex.Lock()
+	defer p.linkMutex.Unlock()
+	if p.link != nil {
+		p.link.close()
+		p.link = nil
+	}
+}
@@ -5,11 +5,17 @@
 package net
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/hellgate75/rebind/log"
+	"io"
 	"io/ioutil"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -51,7 +57,16 @@ type NetPipe interface {
 	IsRunning() bool
 	GetInputChannel() (<-chan []byte, error)
 	GetOutputChannel() (chan []byte, error)
+	// Write queues raw data for the other side, delivered as a data frame
 	Write(d []byte) (int, error)
+	// Handle registers the handler of a command received by the pipe
+	Handle(command Command, handler CommandHandler)
+	// Call sends a request and waits for its reply, until the context is done
+	Call(ctx context.Context, request Request) (Reply, error)
+	// Secure sets authentication and encryption of the pipe, before starting it
+	Secure(security PipeSecurity)
+	// Status returns the state of the pipe and of the connection to the other side
+	Status() PipeStatus
 }
 
 type level byte
@@ -85,6 +100,35 @@ type pipe struct {
 	_active       bool
 	_handler      PipeHandler
 	_log          log.Logger
+	commands      *CommandHandlers
+	pendingMutex  sync.Mutex
+	pending       map[string]chan Reply
+	idPrefix      string
+	idSeq         uint64
+	socketPath    string
+	socketListen  bool
+	linkMutex     sync.Mutex
+	link          *link
+	clientsMutex  sync.Mutex
+	clients       map[net.Conn]bool
+	security      PipeSecurity
+	guard         *replayGuard
+}
+
+// endpoint describes where the pipe listens
+func (p *pipe) endpoint() string {
+	if p.socketPath != "" {
+		return fmt.Sprintf("unix:%s", p.socketPath)
+	}
+	return fmt.Sprintf("%s:%v", p.listenAddress, p.listenPort)
+}
+
+// answerEndpoint describes where the pipe sends, without creating the link
+func (p *pipe) answerEndpoint() string {
+	if p.socketPath != "" {
+		return fmt.Sprintf("unix:%s", p.socketPath)
+	}
+	return fmt.Sprintf("%s:%v", p.answerAddress, p.answerPort)
 }
 
 func (p *pipe) log(level level, m string, args ...interface{}) {
@@ -110,7 +154,7 @@ func (p *pipe) log(level level, m string, args ...interface{}) {
 			p._log.Info(message)
 		}
 	} else {
-		fmt.Println(fmt.Sprintf("[%s] %s"), level.String(), message)
+		fmt.Println(fmt.Sprintf("[%s] %s", level.String(), message))
 	}
 }
 
@@ -125,7 +169,7 @@ func (p *pipe) Start() error {
 			internalError = errors.New(fmt.Sprintf("NetPipe.Start: Runtime error: %v", r))
 		}
 	}()
-	p.log(infoLevel, "NetPipe.Start -> Start listening on : %s:%v", p.listenAddress, p.listenPort)
+	p.log(infoLevel, "NetPipe.Start -> Start listening on : %s", p.endpoint())
 	p._active = true
 	p.inChan = make(chan []byte)
 	if p._handler == nil {
@@ -133,9 +177,17 @@ func (p *pipe) Start() error {
 	} else {
 		p.outChan = nil
 	}
-	p.listener, internalError = net.Listen("tcp", fmt.Sprintf("%s:%v", p.listenAddress, p.listenPort))
+	if p.socketPath != "" {
+		internalError = p.startSocket()
+		if internalError != nil {
+			p._active = false
+		}
+		return internalError
+	}
+	p.listener, internalError = p.listen("tcp", fmt.Sprintf("%s:%v", p.listenAddress, p.listenPort))
 	if internalError != nil {
-		return nil
+		p._active = false
+		return internalError
 	}
 	go p.writeOnChannelRead()
 	go p.readOnOutNP()
@@ -147,7 +199,7 @@ func (p *pipe) Stop() {
 		p.log(errorLevel, "NetPipe.Stop: Unable to stop listener for an out pipe")
 		return
 	}
-	p.log(infoLevel, "NetPipe.Stop -> Stop listening on: %s:%v", p.listenAddress, p.listenPort)
+	p.log(infoLevel, "NetPipe.Stop -> Stop listening on: %s", p.endpoint())
 	p._active = false
 	time.Sleep(500 * time.Millisecond)
 	defer func() {
@@ -163,6 +215,11 @@ func (p *pipe) Stop() {
 			p.listener.Close()
 		}
 		p.listener = nil
+		p.closeOutbound()
+		p.closeClients()
+		if p.socketPath != "" {
+			p.stopSocket()
+		}
 	}()
 }
 
@@ -170,6 +227,52 @@ func (p *pipe) IsRunning() bool {
 	return p._active
 }
 
+func (p *pipe) Status() PipeStatus {
+	status := PipeStatus{
+		Running:  p._active,
+		Endpoint: p.endpoint(),
+		State:    NoConnection,
+	}
+	p.clientsMutex.Lock()
+	status.Clients = len(p.clients)
+	p.clientsMutex.Unlock()
+	p.linkMutex.Lock()
+	l := p.link
+	p.linkMutex.Unlock()
+	if l != nil {
+		l.status(&status)
+	}
+	return status
+}
+
+// addClient tracks a connection accepted by the listener
+func (p *pipe) addClient(conn net.Conn) {
+	p.clientsMutex.Lock()
+	defer p.clientsMutex.Unlock()
+	if p.clients == nil {
+		p.clients = make(map[net.Conn]bool)
+	}
+	p.clients[conn] = true
+}
+
+// removeClient closes a connection accepted by the listener
+func (p *pipe) removeClient(conn net.Conn) {
+	p.clientsMutex.Lock()
+	defer p.clientsMutex.Unlock()
+	conn.Close()
+	delete(p.clients, conn)
+}
+
+// closeClients closes all the connections accepted by the listener
+func (p *pipe) closeClients() {
+	p.clientsMutex.Lock()
+	defer p.clientsMutex.Unlock()
+	for conn := range p.clients {
+		conn.Close()
+	}
+	p.clients = nil
+}
+
 func (p *pipe) readOnOutNP() {
 	defer func() {
 		if r := recover(); r != nil {
@@ -195,10 +298,31 @@ func (p *pipe) handleRequest(conn net.Conn) {
 			p.log(errorLevel, "NetPipe.HandleRequest: Runtime error: %v", r)
 			p.Stop()
 		}
-		conn.Close()
+		p.removeClient(conn)
 	}()
+	p.addClient(conn)
 	p.log(debugLevel, "NetPipe.HandleRequest: Handling Conn with client...")
-	byteArr, err := ioutil.ReadAll(conn)
+	reader := bufio.NewReader(conn)
+	if isFramed(reader) {
+		if p.socketPath != "" {
+			// replies go back on the same connection
+			client := &socketConn{conn: conn}
+			p.handleFrames(reader, func(frame Frame) error {
+				if err := p.sign(&frame); err != nil {
+					return err
+				}
+				return client.write(frame)
+			})
+		} else {
+			p.handleFrames(reader, p.sendFrame)
+		}
+		return
+	}
+	if p.security.Enabled() {
+		p.log(warnLevel, "NetPipe.HandleRequest: Rejected not framed message from: %s", conn.RemoteAddr())
+		return
+	}
+	byteArr, err := ioutil.ReadAll(reader)
 	if err == nil {
 		p.log(debugLevel, "NetPipe.HandleRequest: Writing Client Request On NetPipe...")
 		if p._handler != nil {
@@ -210,47 +334,188 @@ func (p *pipe) handleRequest(conn net.Conn) {
 		p.log(errorLevel, "NetPipe.HandleRequest: Reading error: %v", err)
 	}
 }
+
+// handleFrames reads the frames of a connection, executing requests and delivering replies
+func (p *pipe) handleFrames(reader io.Reader, reply func(frame Frame) error) {
+	for p._active {
+		frame, err := readFrame(reader)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			p.log(errorLevel, "NetPipe.HandleFrames: Reading error: %v", err)
+			return
+		}
+		if err = p.verify(frame); err != nil {
+			p.log(warnLevel, "NetPipe.HandleFrames: Rejected %s frame %s -> Error: %v", frame.Type, frame.ID, err)
+			return
+		}
+		switch frame.Type {
+		case RequestFrame:
+			p.execute(frame, reply)
+		case ReplyFrame:
+			p.deliver(frame)
+		case DataFrame:
+			p.receive(frame)
+		default:
+			p.log(warnLevel, "NetPipe.HandleFrames: Discarded frame %s of unknown type: %s", frame.ID, frame.Type)
+		}
+	}
+}
+
+// execute runs the handler of a request and sends back its reply
+func (p *pipe) execute(frame Frame, send func(frame Frame) error) {
+	reply := Frame{
+		Type:   ReplyFrame,
+		ID:     frame.ID,
+		Status: CommandOk,
+	}
+	if handler, ok := p.commands.Get(frame.Command); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_COMMAND_TIMEOUT)
+		payload, err := p.run(ctx, handler, Request{
+			ID:      frame.ID,
+			Command: frame.Command,
+			Payload: frame.Payload,
+		})
+		cancel()
+		if err == nil && payload != nil {
+			reply.Payload, err = json.Marshal(payload)
+		}
+		if err != nil {
+			reply.Status = CommandFailed
+			reply.Error = err.Error()
+		}
+	} else {
+		reply.Status = CommandFailed
+		reply.Error = fmt.Sprintf("unknown command: %s", frame.Command)
+		p.log(warnLevel, "NetPipe.Execute: Unknown command %s in request %s", frame.Command, frame.ID)
+	}
+	if err := send(reply); err != nil {
+		p.log(errorLevel, "NetPipe.Execute: Unable to reply to request %s, Error: %v", frame.ID, err)
+	}
+}
+
+func (p *pipe) run(ctx context.Context, handler CommandHandler, request Request) (payload interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("runtime error: %v", r))
+		}
+	}()
+	return handler(ctx, request)
+}
+
+// deliver passes a reply to the call waiting for it
+func (p *pipe) deliver(frame Frame) {
+	p.pendingMutex.Lock()
+	answer, ok := p.pending[frame.ID]
+	p.pendingMutex.Unlock()
+	if !ok {
+		p.log(warnLevel, "NetPipe.Deliver: Discarded reply to unknown request: %s", frame.ID)
+		return
+	}
+	select {
+	case answer <- Reply{
+		ID:      frame.ID,
+		Status:  frame.Status,
+		Error:   frame.Error,
+		Payload: frame.Payload,
+	}:
+	default:
+	}
+}
+
+// receive passes the raw data of a data frame to the pipe handler or to the output channel
+func (p *pipe) receive(frame Frame) {
+	var data []byte
+	if err := json.Unmarshal(frame.Payload, &data); err != nil {
+		p.log(warnLevel, "NetPipe.Receive: Discarded data frame %s -> Error: %v", frame.ID, err)
+		return
+	}
+	if p._handler != nil {
+		p._handler(string(data))
+	} else if p.outChan != nil {
+		p.outChan <- data
+	}
+}
+
+func (p *pipe) Handle(command Command, handler CommandHandler) {
+	p.commands.Register(command, handler)
+}
+
+func (p *pipe) Call(ctx context.Context, request Request) (Reply, error) {
+	if p._pType != PIPE_INOUT {
+		return Reply{Status: CommandNotSent}, errors.New("NetPipe.Call: Unable to call on a not in-out pipe")
+	}
+	if !p._active {
+		return Reply{Status: CommandNotSent}, errors.New("NetPipe.Call: Net pipe is not running")
+	}
+	if request.ID == "" {
+		request.ID = p.nextID()
+	}
+	answer := make(chan Reply, 1)
+	p.pendingMutex.Lock()
+	p.pending[request.ID] = answer
+	p.pendingMutex.Unlock()
+	defer func() {
+		p.pendingMutex.Lock()
+		delete(p.pending, request.ID)
+		p.pendingMutex.Unlock()
+	}()
+	frame := Frame{
+		Type:    RequestFrame,
+		ID:      request.ID,
+		Command: request.Command,
+		Payload: request.Payload,
+	}
+	if err := p.enqueue(ctx, frame); err != nil {
+		return Reply{ID: request.ID, Status: CommandNotSent}, err
+	}
+	select {
+	case reply := <-answer:
+		return reply, reply.Err()
+	case <-ctx.Done():
+		return Reply{ID: request.ID, Status: CommandTimeout}, errors.New(fmt.Sprintf("NetPipe.Call: No reply to %s request %s -> Error: %v", request.Command, request.ID, ctx.Err()))
+	}
+}
+
+// sendFrame queues a frame for the other side of the pipe
+func (p *pipe) sendFrame(frame Frame) error {
+	return p.enqueue(context.Background(), frame)
+}
+
+// enqueue queues a frame on the link to the other side, the frame is
+// discarded if the context is done before it is written
+func (p *pipe) enqueue(ctx context.Context, frame Frame) error {
+	if p.socketPath != "" && p.socketListen {
+		return errors.New("NetPipe.Send: The listening side of a Unix socket pipe only replies")
+	}
+	if p._pType != PIPE_OUT && !p._active {
+		return errors.New("NetPipe.Send: Net pipe is not running")
+	}
+	return p.outbound().push(ctx, frame)
+}
+
+func (p *pipe) nextID() string {
+	return fmt.Sprintf("%s-%v", p.idPrefix, atomic.AddUint64(&p.idSeq, 1))
+}
+
 func (p *pipe) writeOnChannelRead() {
 	defer func() {
 		if r := recover(); r != nil {
 			p.log(errorLevel, "NetPipe.WriteThread: Runtime error: %v", r)
-			p.Stop()
 		}
 	}()
 	for p._active {
-		//fmt.Printf("NetPipe.WriteThread: Waiting for message to send at port: %v", p.answerPort)
 		select {
 		case msg, ok := <-p.inChan:
 			if !ok {
-				continue
+				return
 			}
-			outConn, err := net.Dial("tcp", fmt.Sprintf("%s:%v", p.answerAddress, p.answerPort))
-			if err != nil {
-				p.log(errorLevel, "NetPipe.WriteThread: error dialing on: %s:%v, Error: %v", p.answerAddress, p.answerPort, err)
-				panic(err)
+			if _, err := p.Write(msg); err != nil {
+				p.log(errorLevel, "NetPipe.WriteThread: Unable to send message, Error: %v", err)
 			}
-			p.log(debugLevel, "NetPipe.WriteThread: connected on port: %v", p.answerPort)
-			go p.handleAnswer(outConn, msg)
 		case <-time.After(10 * time.Second):
-		default:
-
-		}
-	}
-}
-
-func (p *pipe) handleAnswer(outConn net.Conn, msg []byte) {
-	defer func() {
-		if r := recover(); r != nil {
-			p.log(errorLevel, "NetPipe.HandleAnswer: Runtime error: %v", r)
-			p.Stop()
 		}
-		outConn.Close()
-	}()
-	if outConn != nil {
-		p.log(debugLevel, "NetPipe.HandleAnswer: Sending message at: %s:%v", p.answerAddress, p.answerPort)
-		_, _ = outConn.Write(msg)
-	} else {
-		p.log(errorLevel, "NetPipe.HandleAnswer: Failed to acquire writer")
 	}
 }
 
@@ -279,27 +544,20 @@ func (p *pipe) Write(d []byte) (int, error) {
 		p.log(errorLevel, "NetPipe.Start: Unable to write data for an in pipe")
 		return 0, errors.New("NetPipe.Start: Unable to write data for an in pipe")
 	}
-	var n int
-	defer func() {
-		if r := recover(); r != nil {
-			n = 0
-			p.log(errorLevel, "NetPipe.Write: Runtime error: %v", r)
-			p.Stop()
-		}
-	}()
-	p.log(debugLevel, "NetPipe.Write: Connecting on: %s:%v", p.answerAddress, p.answerPort)
-	outConn, err := net.Dial("tcp", fmt.Sprintf("%s:%v", p.answerAddress, p.answerPort))
+	payload, err := json.Marshal(d)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	defer outConn.Close()
-	if outConn != nil {
-		n, err = outConn.Write(d)
-	} else {
-		p.log(errorLevel, "NetPipe.Write: Failed to acquire writer")
-		err = errors.New("NetPipe.Write: Failed to acquire writer")
+	err = p.sendFrame(Frame{
+		Type:    DataFrame,
+		ID:      p.nextID(),
+		Payload: payload,
+	})
+	if err != nil {
+		p.log(errorLevel, "NetPipe.Write: Unable to queue data for: %s, Error: %v", p.answerEndpoint(), err)
+		return 0, err
 	}
-	return n, err
+	return len(d), nil
 }
 func New(pType PipeType, inputPort int, outputPort int, handler PipeHandler, logger log.Logger) (NetPipe, error) {
 	return NewNetPipe(pType, DEFAULT_LISTEN_ADDRESS, inputPort, DEFAULT_ANSWER_ADDRESS, outputPort, handler, logger)
@@ -344,6 +602,10 @@ func NewNetPipe(pType PipeType, listenAddress string, inputPort int, answerAddre
 		answerAddress: answerAddress,
 		_handler:      handler,
 		_log:          logger,
+		commands:      NewCommandHandlers(),
+		pending:       make(map[string]chan Reply),
+		idPrefix:      fmt.Sprintf("%x", time.Now().UnixNano()),
+		guard:         newReplayGuard(),
 	}, nil
 
 }
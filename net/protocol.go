@@ -0,0 +1,162 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package net
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Frames are made of the magic bytes, the protocol version, the JSON
+// message length as 32 bits big endian integer and the JSON message.
+const (
+	PROTOCOL_VERSION uint8 = 1
+	// Large enough for the group stores sent by the remote registry store
+	MAX_FRAME_LEN  int = 16 * 1024 * 1024
+	frameHeaderLen int = 7
+)
+
+var frameMagic = []byte{'R', 'P'}
+
+// Type of frame
+type FrameType string
+
+const (
+	RequestFrame FrameType = "request"
+	ReplyFrame   FrameType = "reply"
+	// Raw data written on the pipe, the payload is the data as base64 JSON string
+	DataFrame FrameType = "data"
+)
+
+// Frame is the message exchanged over the pipe, a request or its reply
+type Frame struct {
+	Type    FrameType       `yaml:"type" json:"type" xml:"type"`
+	ID      string          `yaml:"id" json:"id" xml:"id"`
+	Command Command         `yaml:"command,omitempty" json:"command,omitempty" xml:"command,omitempty"`
+	Status  CommandStatus   `yaml:"status,omitempty" json:"status,omitempty" xml:"status,omitempty"`
+	Error   string          `yaml:"error,omitempty" json:"error,omitempty" xml:"error,omitempty"`
+	Payload json.RawMessage `yaml:"payload,omitempty" json:"payload,omitempty" xml:"payload,omitempty"`
+	// Signature fields, set when the pipe has a shared secret
+	Timestamp int64  `yaml:"timestamp,omitempty" json:"timestamp,omitempty" xml:"timestamp,omitempty"`
+	Nonce     string `yaml:"nonce,omitempty" json:"nonce,omitempty" xml:"nonce,omitempty"`
+	MAC       string `yaml:"mac,omitempty" json:"mac,omitempty" xml:"mac,omitempty"`
+}
+
+// Request is a command sent over the pipe, with its payload
+type Request struct {
+	ID      string
+	Command Command
+	Payload json.RawMessage
+}
+
+// Decode reads the request payload
+func (r Request) Decode(v interface{}) error {
+	if len(r.Payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.Payload, v)
+}
+
+// Reply is the answer to a request, with its payload
+type Reply struct {
+	ID      string
+	Status  CommandStatus
+	Error   string
+	Payload json.RawMessage
+}
+
+// Decode reads the reply payload
+func (r Reply) Decode(v interface{}) error {
+	if len(r.Payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.Payload, v)
+}
+
+// Err returns the error of a failed command
+func (r Reply) Err() error {
+	if r.Status == CommandOk {
+		return nil
+	}
+	if r.Error != "" {
+		return errors.New(r.Error)
+	}
+	return errors.New(fmt.Sprintf("command %s status: %s", r.ID, r.Status))
+}
+
+// NewRequest creates a request of the command, the payload is encoded as JSON
+func NewRequest(command Command, payload interface{}) (Request, error) {
+	request := Request{
+		Command: command,
+	}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return request, err
+		}
+		request.Payload = data
+	}
+	return request, nil
+}
+
+func writeFrame(w io.Writer, frame Frame) error {
+	buf, err := encodeFrame(frame)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// encodeFrame returns header and JSON message of a frame
+func encodeFrame(frame Frame) ([]byte, error) {
+	data, err := json.Marshal(&frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MAX_FRAME_LEN {
+		return nil, errors.New(fmt.Sprintf("frame length %v exceeds the limit of %v bytes", len(data), MAX_FRAME_LEN))
+	}
+	buf := make([]byte, frameHeaderLen+len(data))
+	copy(buf, frameMagic)
+	buf[2] = PROTOCOL_VERSION
+	binary.BigEndian.PutUint32(buf[3:], uint32(len(data)))
+	copy(buf[frameHeaderLen:], data)
+	return buf, nil
+}
+
+func readFrame(r io.Reader) (Frame, error) {
+	var frame Frame
+	header := make([]byte, frameHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return frame, err
+	}
+	if header[0] != frameMagic[0] || header[1] != frameMagic[1] {
+		return frame, errors.New("invalid frame header")
+	}
+	if header[2] != PROTOCOL_VERSION {
+		return frame, errors.New(fmt.Sprintf("unsupported protocol version: %v", header[2]))
+	}
+	length := binary.BigEndian.Uint32(header[3:])
+	if int64(length) > int64(MAX_FRAME_LEN) {
+		return frame, errors.New(fmt.Sprintf("frame length %v exceeds the limit of %v bytes", length, MAX_FRAME_LEN))
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return frame, err
+	}
+	err := json.Unmarshal(data, &frame)
+	return frame, err
+}
+
+// isFramed checks if the incoming data starts with a frame
+func isFramed(r *bufio.Reader) bool {
+	head, err := r.Peek(len(frameMagic))
+	return err == nil && head[0] == frameMagic[0] && head[1] == frameMagic[1]
+}
@@ -0,0 +1,208 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package net
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Max difference between the frame timestamp and the local clock
+	MAX_FRAME_CLOCK_SKEW time.Duration = 30 * time.Second
+	// Server name verified on the certificate of a Unix socket pipe
+	SOCKET_TLS_SERVER_NAME string = "localhost"
+)
+
+// PipeSecurity configures the authentication and encryption of a pipe
+type PipeSecurity struct {
+	// Shared secret signing frames with HMAC-SHA256, empty disables signatures.
+	// Frames not signed, signed with another secret, too old or replayed are rejected.
+	Secret []byte
+	// TLS configuration, nil disables TLS. Use NewPipeTLSConfig for mutual TLS.
+	TLS *tls.Config
+}
+
+// Enabled reports whether any security option is set
+func (s PipeSecurity) Enabled() bool {
+	return len(s.Secret) > 0 || s.TLS != nil
+}
+
+// replayGuard remembers the nonces of the accepted frames, within the clock skew window
+type replayGuard struct {
+	sync.Mutex
+	nonces map[string]time.Time
+}
+
+// accept records a nonce, it fails when the nonce has already been seen
+func (g *replayGuard) accept(nonce string, now time.Time) bool {
+	g.Lock()
+	defer g.Unlock()
+	for n, seen := range g.nonces {
+		if now.Sub(seen) > 2*MAX_FRAME_CLOCK_SKEW {
+			delete(g.nonces, n)
+		}
+	}
+	if _, ok := g.nonces[nonce]; ok {
+		return false
+	}
+	g.nonces[nonce] = now
+	return true
+}
+
+func newReplayGuard() *replayGuard {
+	return &replayGuard{
+		nonces: make(map[string]time.Time),
+	}
+}
+
+// frameMAC computes the signature of a frame, on its JSON form without signature
+func frameMAC(secret []byte, frame Frame) (string, error) {
+	frame.MAC = ""
+	data, err := json.Marshal(&frame)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// sign adds timestamp, nonce and signature to a frame, when a secret is set
+func (p *pipe) sign(frame *Frame) error {
+	if len(p.security.Secret) == 0 {
+		return nil
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	frame.Timestamp = time.Now().UnixNano()
+	frame.Nonce = hex.EncodeToString(nonce)
+	mac, err := frameMAC(p.security.Secret, *frame)
+	if err != nil {
+		return err
+	}
+	frame.MAC = mac
+	return nil
+}
+
+// verify checks signature, age and uniqueness of a frame, when a secret is set
+func (p *pipe) verify(frame Frame) error {
+	if len(p.security.Secret) == 0 {
+		return nil
+	}
+	if frame.MAC == "" || frame.Nonce == "" {
+		return errors.New("frame not signed")
+	}
+	expected, err := frameMAC(p.security.Secret, frame)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(expected), []byte(frame.MAC)) {
+		return errors.New("invalid frame signature")
+	}
+	now := time.Now()
+	skew := now.Sub(time.Unix(0, frame.Timestamp))
+	if skew > MAX_FRAME_CLOCK_SKEW || skew < -MAX_FRAME_CLOCK_SKEW {
+		return errors.New(fmt.Sprintf("frame timestamp out of the accepted window, skew: %v", skew))
+	}
+	if !p.guard.accept(frame.Nonce, now) {
+		return errors.New("replayed frame")
+	}
+	return nil
+}
+
+func (p *pipe) Secure(security PipeSecurity) {
+	p.security = security
+}
+
+// listen opens a listener, over TLS when configured
+func (p *pipe) listen(network string, address string) (net.Listener, error) {
+	listener, err := net.Listen(network, address)
+	if err != nil || p.security.TLS == nil {
+		return listener, err
+	}
+	return tls.NewListener(listener, p.security.TLS), nil
+}
+
+// dial connects to the other side, over TLS when configured
+func (p *pipe) dial(network string, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: DEFAULT_COMMAND_TIMEOUT}
+	if p.security.TLS == nil {
+		return dialer.Dial(network, address)
+	}
+	config := p.security.TLS.Clone()
+	if config.ServerName == "" {
+		if network == "unix" {
+			config.ServerName = SOCKET_TLS_SERVER_NAME
+		} else if host, _, err := net.SplitHostPort(address); err == nil {
+			config.ServerName = strings.Trim(host, "[]")
+		}
+	}
+	return tls.DialWithDialer(dialer, network, address, config)
+}
+
+// NewPipeTLSConfig creates a mutual TLS configuration: the pipe presents the
+// certificate and requires the other side to present one signed by the CA.
+// The certificate of a listening side must be valid for its listen address,
+// or for "localhost" on Unix sockets.
+func NewPipeTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	caPem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPem) {
+		return nil, errors.New(fmt.Sprintf("NetPipe.TLS: No certificates found in CA file: %s", caFile))
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// LoadPipeSecurity reads the shared secret and the mutual TLS files, empty
+// paths disable the related option
+func LoadPipeSecurity(secretFile string, certFile string, keyFile string, caFile string) (PipeSecurity, error) {
+	var security PipeSecurity
+	if secretFile != "" {
+		secret, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			return security, err
+		}
+		security.Secret = []byte(strings.TrimSpace(string(secret)))
+		if len(security.Secret) == 0 {
+			return security, errors.New(fmt.Sprintf("NetPipe.Security: Empty secret in file: %s", secretFile))
+		}
+	}
+	if certFile != "" || keyFile != "" || caFile != "" {
+		config, err := NewPipeTLSConfig(certFile, keyFile, caFile)
+		if err != nil {
+			return security, err
+		}
+		security.TLS = config
+	}
+	return security, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package net
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hellgate75/rebind/log"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Permissions of the Unix socket file, only owner and group can connect
+	DEFAULT_SOCKET_MODE os.FileMode = 0660
+	// Permissions of the Unix socket folder, when created by the pipe
+	DEFAULT_SOCKET_DIR_MODE os.FileMode = 0750
+)
+
+// socketConn is a connection over a Unix domain socket, carrying frames both ways
+type socketConn struct {
+	sync.Mutex
+	conn net.Conn
+}
+
+// write sends a frame, writes of concurrent frames don't interleave
+func (c *socketConn) write(frame Frame) error {
+	c.Lock()
+	defer c.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(DEFAULT_COMMAND_TIMEOUT))
+	return writeFrame(c.conn, frame)
+}
+
+// startSocket creates the socket file on the listening side, the other side
+// connects on the first frame sent and keeps the connection open
+func (p *pipe) startSocket() error {
+	p._active = true
+	if !p.socketListen {
+		return nil
+	}
+	if info, err := os.Stat(p.socketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return errors.New(fmt.Sprintf("NetPipe.Start: File %s exists and it is not a socket", p.socketPath))
+		}
+		// left by a previous run
+		if err = os.Remove(p.socketPath); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(p.socketPath), DEFAULT_SOCKET_DIR_MODE); err != nil {
+		return err
+	}
+	// bound in a folder only the owner can access and moved in place when only
+	// owner and group can connect, whatever the umask and the socket folder mode
+	bindDir, err := ioutil.TempDir(filepath.Dir(p.socketPath), ".rebind-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(bindDir)
+	bindPath := filepath.Join(bindDir, "sock")
+	listener, err := p.listen("unix", bindPath)
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(bindPath, DEFAULT_SOCKET_MODE); err == nil {
+		err = os.Rename(bindPath, p.socketPath)
+	}
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	p.listener = listener
+	go p.readOnOutNP()
+	return nil
+}
+
+// stopSocket removes the socket file on the listening side
+func (p *pipe) stopSocket() {
+	if p.socketListen {
+		_ = os.Remove(p.socketPath)
+	}
+}
+
+// NewSocketPipe creates an in-out pipe over a Unix domain socket, using a single
+// bidirectional connection. The listening side creates the socket file, with
+// DEFAULT_SOCKET_MODE permissions, and executes the commands; the other side
+// connects to it and calls the commands.
+func NewSocketPipe(socketPath string, listen bool, handler PipeHandler, logger log.Logger) (NetPipe, error) {
+	if socketPath == "" {
+		return nil, errors.New("NetPipe.New: empty socket path")
+	}
+	if logger != nil {
+		logger.Infof("NetPipe.New: Creating Net-Pipe on Unix socket: %s", socketPath)
+	} else {
+		fmt.Printf("[INFO ] NetPipe.New: Creating Net-Pipe on Unix socket: %s\n", socketPath)
+	}
+	return &pipe{
+		_pType:       PIPE_INOUT,
+		socketPath:   socketPath,
+		socketListen: listen,
+		_handler:     handler,
+		_log:         logger,
+		commands:     NewCommandHandlers(),
+		pending:      make(map[string]chan Reply),
+		idPrefix:     fmt.Sprintf("%x", time.Now().UnixNano()),
+		guard:        newReplayGuard(),
+	}, nil
+}
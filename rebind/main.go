@@ -6,19 +6,26 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"github.com/hellgate75/rebind/data"
 	"github.com/hellgate75/rebind/dns"
 	"github.com/hellgate75/rebind/log"
 	"github.com/hellgate75/rebind/model"
 	"github.com/hellgate75/rebind/model/rest"
+	pnet "github.com/hellgate75/rebind/net"
+	"github.com/hellgate75/rebind/registry"
+	"github.com/hellgate75/rebind/rest/services"
 	"github.com/hellgate75/rebind/utils"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 )
 
 var rwDirPath string
+var dataBackend string
 var configDirPath string
 var initializeAndExit bool
 var useConfigFile bool
@@ -28,12 +35,35 @@ var logVerbosity string
 var enableLogRotate bool
 var logMaxFileSize int64
 var logMaxFileCount int
-var listenIP string
+var listenIPs model.ArgumentsList
 var listenPort int
 var dnsPipeIP string
 var dnsPipePort int
 var dnsPipeResponsePort int
+var dnsPipeSocket string
+var dnsPipeSecretFile string
+var dnsPipeTlsCert string
+var dnsPipeTlsKey string
+var dnsPipeTlsCA string
 var fwdrsString model.ArgumentsList
+var cacheMinTTL uint
+var cacheMaxTTL uint
+var cacheMaxEntries int
+var cacheMaxMemory int64
+var cacheNegativeMaxTTL uint
+var cacheServeStale bool
+var cacheStaleWindow uint
+var cachePrefetch bool
+var journalEnabled bool
+var snapshotInterval uint
+var snapshotMaxEntries int
+var snapshotsKept int
+var recoverTo string
+var withRest bool
+var restListenIP string
+var restListenPort int
+var restTlsCert string
+var restTlsKey string
 
 var logger = log.NewLogger("re-bind", log.DEBUG)
 
@@ -42,6 +72,7 @@ var defaultForwarders = make([]net.UDPAddr, 0)
 func init() {
 	logger.Info("Initializing Re-Bind DNS Server ....")
 	flag.StringVar(&rwDirPath, "data-dir", rest.DefaultStorageFolder, "dns storage dir")
+	flag.StringVar(&dataBackend, "data-backend", string(data.FileBackend), "dns storage backend (file, bolt, memory)")
 	flag.StringVar(&configDirPath, "config-dir", rest.DefaultConfigFolder, "dns config dir")
 	flag.BoolVar(&initializeAndExit, "init-and-exit", false, "initialize config in the config dir and exit")
 	flag.BoolVar(&useConfigFile, "use-config-file", false, "use config file instead parameters")
@@ -51,12 +82,35 @@ func init() {
 	flag.BoolVar(&enableLogRotate, "log-rotate", true, "log file rotation enabled")
 	flag.Int64Var(&logMaxFileSize, "log-max-size", 1024, "log file rotation max file size in bytes")
 	flag.IntVar(&logMaxFileCount, "log-count", 1024, "log file rotation max number of file")
-	flag.StringVar(&listenIP, "listen-ip", rest.DefaultIpAddress, "dns forward ip")
+	flag.Var(&listenIPs, "listen-ip", fmt.Sprintf("dns listen ipv4 or ipv6 address, default %s (multiple values)", rest.DefaultIpAddress))
 	flag.IntVar(&listenPort, "listen-port", rest.DefaultDnsServerPort, "dns forward port")
 	flag.StringVar(&dnsPipeIP, "dns-pipe-ip", rest.DefaultDnsPipeAddress, "tcp dns pipe ip")
 	flag.IntVar(&dnsPipePort, "dns-pipe-port", rest.DefaultDnsPipePort, "tcp dns pipe port")
 	flag.IntVar(&dnsPipeResponsePort, "dns-pipe-response-port", rest.DefaultDnsAnswerPipePort, "tcp dns pipe responses port")
+	flag.StringVar(&dnsPipeSocket, "dns-pipe-socket", "", "unix socket dns pipe path (e.g. /run/rebind/control.sock), replaces the tcp dns pipe")
+	flag.StringVar(&dnsPipeSecretFile, "dns-pipe-secret-file", "", "file with the dns pipe shared secret, signing and authenticating messages")
+	flag.StringVar(&dnsPipeTlsCert, "dns-pipe-tls-cert", "", "dns pipe mutual tls certificate file path")
+	flag.StringVar(&dnsPipeTlsKey, "dns-pipe-tls-key", "", "dns pipe mutual tls certificate key file path")
+	flag.StringVar(&dnsPipeTlsCA, "dns-pipe-tls-ca", "", "dns pipe mutual tls certification authority file path")
 	flag.Var(&fwdrsString, "forwarder", "Forwarder address in format \"ipv4|ipv6;port;ipv6zone\" (mutliple values)")
+	flag.UintVar(&cacheMinTTL, "cache-min-ttl", uint(rest.DefaultCacheMinTTL), "answers cache min time to live in seconds")
+	flag.UintVar(&cacheMaxTTL, "cache-max-ttl", uint(rest.DefaultCacheMaxTTL), "answers cache max time to live in seconds, 0 means no limit")
+	flag.IntVar(&cacheMaxEntries, "cache-max-entries", rest.DefaultCacheMaxEntries, "answers cache max number of entries")
+	flag.Int64Var(&cacheMaxMemory, "cache-max-memory", rest.DefaultCacheMaxMemory, "answers cache max memory in bytes")
+	flag.UintVar(&cacheNegativeMaxTTL, "cache-negative-max-ttl", uint(rest.DefaultCacheNegativeTTL), "negative answers cache max time to live in seconds, 0 means no limit")
+	flag.BoolVar(&cacheServeStale, "serve-stale", false, "answer with expired cached answers when forwarders fail")
+	flag.UintVar(&cacheStaleWindow, "stale-window", uint(rest.DefaultCacheStaleWindow), "time in seconds expired answers are kept to be served stale, when serve-stale is enabled for the server or for a group")
+	flag.BoolVar(&cachePrefetch, "prefetch", false, "refresh popular cached answers before they expire")
+	flag.BoolVar(&journalEnabled, "journal", false, "journal the records changes in the data dir, group stores are saved at the snapshots (requires a single writer: rest server with remote store or all-in-one mode)")
+	flag.UintVar(&snapshotInterval, "snapshot-interval", rest.DefaultSnapshotInterval, "journal snapshots interval in seconds, 0 means only on max entries")
+	flag.IntVar(&snapshotMaxEntries, "snapshot-max-entries", rest.DefaultSnapshotMaxEntries, "journal entries triggering a snapshot, 0 means only on interval")
+	flag.IntVar(&snapshotsKept, "snapshots-kept", rest.DefaultSnapshotsKept, "journal snapshots kept for point-in-time recovery")
+	flag.StringVar(&recoverTo, "recover-to", "", "recover the data dir from the journal to a time (RFC3339, e.g. 2020-04-15T10:30:00Z) and exit")
+	flag.BoolVar(&withRest, "with-rest", false, "all-in-one mode, starts the rest server in the same process sharing the store, without dns pipe")
+	flag.StringVar(&restListenIP, "rest-listen-ip", rest.DefaultIpAddress, "all-in-one mode http server ip")
+	flag.IntVar(&restListenPort, "rest-listen-port", rest.DefaultRestServerPort, "all-in-one mode http server port")
+	flag.StringVar(&restTlsCert, "rest-tls-cert", "", "all-in-one mode http server tls certificate file path")
+	flag.StringVar(&restTlsKey, "rest-tls-key", "", "all-in-one mode http server tls certificate key file path")
 }
 
 func main() {
@@ -66,22 +120,39 @@ func main() {
 		flag.Usage()
 		os.Exit(0)
 	}
+	if len(listenIPs) == 0 {
+		listenIPs = append(listenIPs, rest.DefaultIpAddress)
+	}
 	if initializeAndExit {
 		logger.Info("Initialize Re-Bind Dns Server and Exit!!")
 		config := model.ReBindConfig{
 			DataDirPath:         rwDirPath,
+			DataBackend:         dataBackend,
 			ConfigDirPath:       configDirPath,
-			ListenIP:            listenIP,
+			ListenIP:            listenIPs[0],
+			ListenIPs:           listenIPs,
 			ListenPort:          listenPort,
 			DnsPipeIP:           dnsPipeIP,
 			DnsPipePort:         dnsPipePort,
 			DnsPipeResponsePort: dnsPipeResponsePort,
+			DnsPipeSocket:       dnsPipeSocket,
+			DnsPipeSecretFile:   dnsPipeSecretFile,
+			DnsPipeTlsCert:      dnsPipeTlsCert,
+			DnsPipeTlsKey:       dnsPipeTlsKey,
+			DnsPipeTlsCA:        dnsPipeTlsCA,
 			EnableFileLogging:   enableFileLogging,
 			LogVerbosity:        logVerbosity,
 			LogFilePath:         logFilePath,
 			LogFileCount:        logMaxFileCount,
 			LogMaxFileSize:      logMaxFileSize,
 			EnableLogRotate:     enableLogRotate,
+			Cache:               cacheConfig(),
+			Journal:             journalConfig(),
+			WithRest:            withRest,
+			RestListenIP:        restListenIP,
+			RestListenPort:      restListenPort,
+			RestTlsCert:         restTlsCert,
+			RestTlsKey:          restTlsKey,
 		}
 		cSErr := model.SaveConfig(configDirPath, "rebind", &config)
 		if cSErr != nil {
@@ -100,18 +171,45 @@ func main() {
 			logger.Warnf("Loading configuration from file complete!!", config)
 			logger.Debugf("Configuration: %v", config)
 			rwDirPath = config.DataDirPath
+			dataBackend = config.DataBackend
 			configDirPath = config.ConfigDirPath
-			listenIP = config.ListenIP
+			if len(config.ListenIPs) > 0 {
+				listenIPs = config.ListenIPs
+			} else if config.ListenIP != "" {
+				listenIPs = model.ArgumentsList{config.ListenIP}
+			}
 			listenPort = config.ListenPort
 			dnsPipeIP = config.DnsPipeIP
 			dnsPipePort = config.DnsPipePort
 			dnsPipeResponsePort = config.DnsPipeResponsePort
+			dnsPipeSocket = config.DnsPipeSocket
+			dnsPipeSecretFile = config.DnsPipeSecretFile
+			dnsPipeTlsCert = config.DnsPipeTlsCert
+			dnsPipeTlsKey = config.DnsPipeTlsKey
+			dnsPipeTlsCA = config.DnsPipeTlsCA
 			enableFileLogging = config.EnableFileLogging
 			logVerbosity = config.LogVerbosity
 			logFilePath = config.LogFilePath
 			logMaxFileCount = config.LogFileCount
 			logMaxFileSize = config.LogMaxFileSize
 			enableLogRotate = config.EnableLogRotate
+			cacheMinTTL = uint(config.Cache.MinTTL)
+			cacheMaxTTL = uint(config.Cache.MaxTTL)
+			cacheMaxEntries = config.Cache.MaxEntries
+			cacheMaxMemory = config.Cache.MaxMemory
+			cacheNegativeMaxTTL = uint(config.Cache.NegativeMaxTTL)
+			cacheServeStale = config.Cache.ServeStale
+			cacheStaleWindow = uint(config.Cache.StaleWindow)
+			cachePrefetch = config.Cache.Prefetch
+			journalEnabled = config.Journal.Enabled
+			snapshotInterval = config.Journal.SnapshotInterval
+			snapshotMaxEntries = config.Journal.MaxEntries
+			snapshotsKept = config.Journal.Snapshots
+			withRest = config.WithRest
+			restListenIP = config.RestListenIP
+			restListenPort = config.RestListenPort
+			restTlsCert = config.RestTlsCert
+			restTlsKey = config.RestTlsKey
 		}
 	}
 	verbosity := log.LogLevelFromString(logVerbosity)
@@ -161,7 +259,9 @@ func main() {
 	for _, fw := range fwdrsString {
 		list := strings.Split(fw, ";")
 		var ip net.IP
-		if addr, err := net.ResolveIPAddr("udp", list[0]); err != nil {
+		if addr, err := net.ResolveIPAddr("ip", list[0]); err != nil {
+			logger.Warnf("Invalid forwarder address: %s -> Error: %v", fw, err)
+		} else {
 			ip = addr.IP
 			port := 53
 			zone := ""
@@ -181,13 +281,132 @@ func main() {
 			})
 		}
 	}
-	logger.Infof("Required ip address : %v", listenIP)
+	for _, ip := range listenIPs {
+		logger.Infof("Required ip address : %v", ip)
+	}
 	logger.Infof("Required port : %v", listenPort)
 	for _, fw := range defaultForwarders {
 		logger.Infof("Default forwarder : %s:%v[:%s]", fw.IP, fw.Port, fw.Zone)
 	}
-	dnsServer := dns.Start(rwDirPath, listenIP, listenPort, dnsPipeIP, dnsPipePort, dnsPipeResponsePort, logger, []net.UDPAddr{{IP: net.ParseIP(listenIP), Port: listenPort}})
+	backendType, ok := data.ParseBackendType(dataBackend)
+	if !ok {
+		logger.Errorf("Unknown dns storage backend: %s", dataBackend)
+		os.Exit(1)
+	}
+	backend, err := data.NewBackend(backendType, rwDirPath, logger)
+	if err != nil {
+		logger.Errorf("Unable to open dns storage backend %s, Error: %v", backendType, err)
+		os.Exit(1)
+	}
+	defer backend.Close()
+	var journal *data.Journal
+	if journalEnabled || recoverTo != "" {
+		journal, err = data.OpenJournal(filepath.Join(rwDirPath, data.JOURNAL_FOLDER), logger)
+		if err != nil {
+			logger.Errorf("Unable to open dns storage journal, Error: %v", err)
+			os.Exit(1)
+		}
+		defer journal.Close()
+	}
+	if recoverTo != "" {
+		recoverAndExit(backend, journal)
+	}
+	var store registry.Store
+	if journal != nil {
+		store = registry.NewJournaledStore(logger, rwDirPath, backend, journal, journalConfig(), defaultForwarders)
+	} else {
+		store = registry.NewStoreWith(logger, rwDirPath, backend, defaultForwarders)
+	}
+	if withRest {
+		startAllInOne(store)
+		return
+	}
+	pipeSecurity, err := pnet.LoadPipeSecurity(dnsPipeSecretFile, dnsPipeTlsCert, dnsPipeTlsKey, dnsPipeTlsCA)
+	if err != nil {
+		logger.Errorf("Unable to load dns pipe security settings, Error: %v", err)
+		os.Exit(1)
+	}
+	dnsServer := dns.StartWithPipe(store, listenIPs, listenPort, dnsPipeIP, dnsPipePort, dnsPipeResponsePort, dnsPipeSocket, pipeSecurity, logger, defaultForwarders, cacheConfig())
 	time.Sleep(5 * time.Second)
 	logger.Info("Re-Bind DNS Server started!!")
 	dnsServer.Wait()
 }
+
+// startAllInOne starts the DNS server and the Rest server sharing one registry
+// store: Rest changes are visible to the DNS server right away, without net pipe
+func startAllInOne(store registry.Store) {
+	dnsServer := dns.StartWithStore(store, listenIPs, listenPort, logger, defaultForwarders, cacheConfig())
+	go func() {
+		rtr := services.NewApiRouter(nil, store, logger, services.BaseUrl(restListenIP, restListenPort, restTlsCert, restTlsKey))
+		if err := services.ListenAndServe(rtr, restListenIP, restListenPort, restTlsCert, restTlsKey, logger); err != nil {
+			logger.Errorf("RestService start-up:: Error listening on %s:%v - Error: %v", restListenIP, restListenPort, err)
+			os.Exit(1)
+		}
+	}()
+	time.Sleep(5 * time.Second)
+	logger.Info("Re-Bind DNS and Rest Server started!!")
+	dnsServer.Wait()
+}
+
+// recoverAndExit recovers the data dir to the required time from the journal
+func recoverAndExit(backend data.Backend, journal *data.Journal) {
+	t, err := time.Parse(time.RFC3339, recoverTo)
+	if err != nil {
+		logger.Errorf("Invalid recovery time: %s, Error: %v", recoverTo, err)
+		os.Exit(1)
+	}
+	bucket := data.NewGroupsBucketWith(rwDirPath, backend, logger)
+	bucket.UseJournal(journal)
+	if err = bucket.Load(defaultForwarders); err == nil {
+		err = recoverWithHistory(&bucket, t)
+	}
+	backend.Close()
+	journal.Close()
+	if err != nil {
+		logger.Errorf("Unable to recover the data dir to: %s, Error: %v", recoverTo, err)
+		os.Exit(1)
+	}
+	logger.Infof("Data dir recovered to: %s", recoverTo)
+	os.Exit(0)
+}
+
+// recoverWithHistory recovers the groups to a time, recording the restored
+// records in the groups history
+func recoverWithHistory(bucket *data.GroupsBucket, t time.Time) error {
+	before, err := bucket.Records()
+	if err != nil {
+		return err
+	}
+	if err = bucket.RecoverTo(t, snapshotsKept); err != nil {
+		return err
+	}
+	after, err := bucket.Records()
+	if err != nil {
+		return err
+	}
+	history := data.NewHistory(filepath.Join(rwDirPath, data.HISTORY_FOLDER), logger)
+	return history.RecordStates(data.SYSTEM_ACTOR, data.HistoryRecoverOp, before, after)
+}
+
+func journalConfig() model.JournalConfig {
+	return model.JournalConfig{
+		Enabled:          journalEnabled,
+		SnapshotInterval: snapshotInterval,
+		MaxEntries:       snapshotMaxEntries,
+		Snapshots:        snapshotsKept,
+	}
+}
+
+// cacheConfig collects the answers cache configuration from the flags
+func cacheConfig() model.CacheConfig {
+	return model.CacheConfig{
+		MinTTL:         uint32(cacheMinTTL),
+		MaxTTL:         uint32(cacheMaxTTL),
+		MaxEntries:     cacheMaxEntries,
+		MaxMemory:      cacheMaxMemory,
+		NegativeMaxTTL: uint32(cacheNegativeMaxTTL),
+		ServeStale:     cacheServeStale,
+		StaleWindow:    uint32(cacheStaleWindow),
+		Prefetch:       cachePrefetch,
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package registry
+
+import (
+	"fmt"
+	"github.com/hellgate75/rebind/log"
+	"sync"
+)
+
+// ChangeEvent describes a change of the records in the groups
+type ChangeEvent struct {
+	// Names of the changed groups, empty when all groups changed
+	Groups []string
+	// Host names of the changed records, empty when any record may have changed
+	Hostnames []string
+}
+
+// All reports whether any record may have changed
+func (e ChangeEvent) All() bool {
+	return len(e.Hostnames) == 0
+}
+
+// ChangeListener is notified of the changes of the records in the groups
+type ChangeListener func(event ChangeEvent)
+
+// changeListeners is the registry of the listeners of a store
+type changeListeners struct {
+	sync.RWMutex
+	listeners []ChangeListener
+}
+
+func (l *changeListeners) add(listener ChangeListener) {
+	if listener == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.listeners = append(l.listeners, listener)
+}
+
+// notify calls the listeners, a failing listener doesn't prevent the others to be called
+func (l *changeListeners) notify(logger log.Logger, event ChangeEvent) {
+	l.RLock()
+	listeners := l.listeners
+	l.RUnlock()
+	for _, listener := range listeners {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					if logger != nil {
+						logger.Errorf(fmt.Sprintf("Store.notify::Runtime error in change listener: %v", r))
+					}
+				}
+			}()
+			listener(event)
+		}()
+	}
+}
+
+// AddListener registers a listener of the records changes
+func (s *_store) AddListener(listener ChangeListener) {
+	s.changes.add(listener)
+}
+
+func (s *_store) notify(event ChangeEvent) {
+	s.changes.notify(s.log, event)
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hellgate75/rebind/data"
+	"github.com/hellgate75/rebind/store"
+	"net"
+)
+
+func (s *_store) ListGroups() []data.Group {
+	s.RLock()
+	defer s.RUnlock()
+	return s.store.ListGroups()
+}
+
+func (s *_store) GetGroup(groupName string) (data.Group, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.store.GetGroupById(groupName)
+}
+
+func (s *_store) GetGroupStore(group data.Group) (store.GroupStoreData, error) {
+	s.RLock()
+	defer s.RUnlock()
+	groupStore, err := s.store.GetGroupStore(group)
+	if err != nil {
+		return store.GroupStoreData{}, err
+	}
+	// a copy, the loaded store changes only when saved
+	return store.NewGroupStoreData(data.CopyRecords(groupStore.PersistentData())), nil
+}
+
+func (s *_store) CreateGroup(groupName string, domains []string, forwarders []net.UDPAddr) (group data.Group, err error) {
+	s.Lock()
+	defer func() {
+		if r := recover(); r != nil {
+			if s.log != nil {
+				s.log.Errorf(fmt.Sprintf("Store.CreateGroup::Runtime error: %v", r))
+			}
+			err = errors.New(fmt.Sprintf("%v", r))
+		}
+		s.Unlock()
+		if err == nil {
+			// answers of the group domains may come from other groups
+			s.notify(ChangeEvent{Groups: []string{group.Name}})
+		}
+	}()
+	if s.store.Contains(groupName) {
+		return group, errors.New(fmt.Sprintf("Group %s already exists", groupName))
+	}
+	group, _, err = s.store.CreateAndPersistGroupAndStore(groupName, domains, forwarders)
+	return group, err
+}
+
+func (s *_store) UpdateGroup(group data.Group) (err error) {
+	s.Lock()
+	defer func() {
+		if r := recover(); r != nil {
+			if s.log != nil {
+				s.log.Errorf(fmt.Sprintf("Store.UpdateGroup::Runtime error: %v", r))
+			}
+			err = errors.New(fmt.Sprintf("%v", r))
+		}
+		s.Unlock()
+		if err == nil {
+			s.notify(ChangeEvent{Groups: []string{group.Name}})
+		}
+	}()
+	if !s.store.UpdateExistingGroup(group) {
+		return errors.New(fmt.Sprintf("Unable to find group by id: %s", group.Name))
+	}
+	// loaded group store keeps a copy of domains and forwarders
+	s.store.Invalidate(group.Name)
+	if err = s.store.SaveMeta(); err != nil {
+		return err
+	}
+	return s.store.LogGroupChange(group)
+}
+
+func (s *_store) DeleteGroup(groupName string) (err error) {
+	s.Lock()
+	defer func() {
+		if r := recover(); r != nil {
+			if s.log != nil {
+				s.log.Errorf(fmt.Sprintf("Store.DeleteGroup::Runtime error: %v", r))
+			}
+			err = errors.New(fmt.Sprintf("%v", r))
+		}
+		s.Unlock()
+		if err == nil {
+			s.notify(ChangeEvent{Groups: []string{groupName}})
+		}
+	}()
+	if !s.store.Delete(groupName) {
+		return errors.New(fmt.Sprintf("Unable to delete group: %s", groupName))
+	}
+	if err = s.history.Archive(groupName); err != nil && s.log != nil {
+		s.log.Errorf("Store.DeleteGroup:: Unable to archive history of group %s, Error: %v", groupName, err)
+	}
+	return nil
+}
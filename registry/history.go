@@ -0,0 +1,158 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hellgate75/rebind/data"
+	"github.com/hellgate75/rebind/store"
+)
+
+// hostRecords returns a copy of the records of the given host names of a group store
+func hostRecords(groupStore *store.GroupStoreData, hostnames ...string) map[string][]store.DNSRecord {
+	var records = make(map[string][]store.DNSRecord)
+	for _, hostname := range hostnames {
+		if recs, err := groupStore.Get(hostname); err == nil {
+			records[hostname] = append([]store.DNSRecord{}, recs...)
+		}
+	}
+	return records
+}
+
+// recordHistory records a new version of a group, when the records changed
+func (s *_store) recordHistory(groupName string, actor string, op data.HistoryOp, changes []data.RecordChange) {
+	if len(changes) == 0 {
+		return
+	}
+	if actor == "" {
+		actor = data.SYSTEM_ACTOR
+	}
+	err := s.history.Append(groupName, &data.HistoryEntry{
+		Actor:   actor,
+		Op:      op,
+		Changes: changes,
+	})
+	if err != nil && s.log != nil {
+		s.log.Errorf("Store.recordHistory:: Unable to record history of group %s, Error: %v", groupName, err)
+	}
+}
+
+// groupRecords returns the group and the persistent data of its store
+func (s *_store) groupRecords(groupName string) (data.Group, store.GroupStorePersistent, error) {
+	group, err := s.store.GetGroupById(groupName)
+	if err != nil {
+		return group, store.GroupStorePersistent{}, err
+	}
+	groupStore, err := s.store.GetGroupStore(group)
+	if err != nil {
+		return group, store.GroupStorePersistent{}, err
+	}
+	return group, groupStore.PersistentData(), nil
+}
+
+func (s *_store) GroupHistory(groupName string) ([]data.HistoryEntry, error) {
+	s.RLock()
+	defer s.RUnlock()
+	group, err := s.store.GetGroupById(groupName)
+	if err != nil {
+		return nil, err
+	}
+	return s.history.List(group.Name)
+}
+
+func (s *_store) GetGroupVersion(groupName string, version uint64) (store.GroupStorePersistent, error) {
+	s.RLock()
+	defer s.RUnlock()
+	group, persistent, err := s.groupRecords(groupName)
+	if err != nil {
+		return persistent, err
+	}
+	records, err := s.history.StateAt(group.Name, persistent.Store, version)
+	if err != nil {
+		return persistent, err
+	}
+	persistent.Store = records
+	return persistent, nil
+}
+
+func (s *_store) DiffGroupVersions(groupName string, from uint64, to uint64) ([]data.RecordChange, error) {
+	s.RLock()
+	defer s.RUnlock()
+	group, persistent, err := s.groupRecords(groupName)
+	if err != nil {
+		return nil, err
+	}
+	before, err := s.history.StateAt(group.Name, persistent.Store, from)
+	if err != nil {
+		return nil, err
+	}
+	after, err := s.history.StateAt(group.Name, persistent.Store, to)
+	if err != nil {
+		return nil, err
+	}
+	return data.DiffRecords(before, after), nil
+}
+
+func (s *_store) RollbackGroup(actor string, groupName string, version uint64) (entry data.HistoryEntry, err error) {
+	var event ChangeEvent
+	s.Lock()
+	defer func() {
+		if r := recover(); r != nil {
+			if s.log != nil {
+				s.log.Errorf(fmt.Sprintf("Store.RollbackGroup::Runtime error: %v", r))
+			}
+			err = errors.New(fmt.Sprintf("%v", r))
+		}
+		s.Unlock()
+		if err == nil && len(event.Groups) > 0 {
+			s.notify(event)
+			s.snapshotIfNeeded()
+		}
+	}()
+	group, persistent, err := s.groupRecords(groupName)
+	if err != nil {
+		return entry, err
+	}
+	records, err := s.history.StateAt(group.Name, persistent.Store, version)
+	if err != nil {
+		return entry, err
+	}
+	changes := data.DiffRecords(persistent.Store, records)
+	if len(changes) == 0 {
+		return entry, nil
+	}
+	persistent.Store = records
+	groupStore := store.NewGroupStoreData(persistent)
+	group.NumRecs = countRecords(&groupStore)
+	group, err = s.store.SaveGroupChange(&groupStore, group, data.JournalEntry{
+		Op:    data.JournalStoreOp,
+		Store: &persistent,
+	})
+	if err != nil {
+		return entry, err
+	}
+	if s.store.UpdateExistingGroup(group) {
+		if err = s.store.SaveMeta(); err != nil {
+			return entry, err
+		}
+	}
+	if actor == "" {
+		actor = data.SYSTEM_ACTOR
+	}
+	entry = data.HistoryEntry{
+		Actor:   actor,
+		Op:      data.HistoryRollbackOp,
+		Changes: changes,
+	}
+	if err = s.history.Append(group.Name, &entry); err != nil {
+		return entry, err
+	}
+	event.Groups = []string{group.Name}
+	for _, change := range changes {
+		event.Hostnames = append(event.Hostnames, change.Key)
+	}
+	return entry, nil
+}
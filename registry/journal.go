@@ -0,0 +1,57 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package registry
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// snapshots takes a snapshot at every interval, when the journal has new entries
+func (s *_store) snapshots(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.store.PendingChanges() > 0 {
+			s.snapshot()
+		}
+	}
+}
+
+// snapshotIfNeeded takes a snapshot in background when the journal exceeds the
+// configured number of entries
+func (s *_store) snapshotIfNeeded() {
+	if s.journal.MaxEntries > 0 && s.store.PendingChanges() >= s.journal.MaxEntries {
+		go s.snapshot()
+	}
+}
+
+// snapshot saves the changed group stores and writes a snapshot of the groups,
+// one snapshot at a time
+func (s *_store) snapshot() {
+	if !atomic.CompareAndSwapInt32(&s.snapshotting, 0, 1) {
+		return
+	}
+	s.Lock()
+	defer func() {
+		if r := recover(); r != nil {
+			if s.log != nil {
+				s.log.Errorf(fmt.Sprintf("Store.snapshot::Runtime error: %v", r))
+			}
+		}
+		s.Unlock()
+		atomic.StoreInt32(&s.snapshotting, 0)
+	}()
+	if err := s.store.Snapshot(s.journal.Snapshots); err != nil {
+		if s.log != nil {
+			s.log.Errorf("Store.snapshot:: Unable to take journal snapshot, Error: %v", err)
+		}
+		return
+	}
+	if s.log != nil {
+		s.log.Infof("Store.snapshot:: journal snapshot complete!!")
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package registry
+
+import (
+	"fmt"
+	"github.com/hellgate75/rebind/data"
+	"github.com/hellgate75/rebind/store"
+	"github.com/hellgate75/rebind/utils"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strings"
+)
+
+const (
+	// Default SOA values used for groups with no SOA record
+	defaultSOATTL     uint32 = 300
+	defaultSOASerial  uint32 = 1
+	defaultSOARefresh uint32 = 3600
+	defaultSOARetry   uint32 = 600
+	defaultSOAExpire  uint32 = 86400
+	defaultSOAMinTTL  uint32 = 300
+	// Zone used for host names with no or default domain
+	defaultZone = "local"
+)
+
+// LookupResult collects what the groups know about a host name
+type LookupResult struct {
+	// Records of any type found for the host name
+	Records []dnsmessage.Resource
+	// Forwarders of the groups in charge of the host name, or
+	// of the default group when no group is in charge of it
+	Forwarders []net.UDPAddr
+	// Forwarders selection policy of the group closest to the host name
+	Policy data.ForwardPolicy
+	// Serve-stale and prefetch settings of the group closest to the host name,
+	// nil when the group uses the server settings
+	ServeStale *bool
+	Prefetch   *bool
+	// Groups whose domains contain the host name
+	Groups []data.Group
+	// SOA records of the zones the host name belongs to
+	Authority []dnsmessage.Resource
+}
+
+// Lookup looks for the host name records in the groups in charge of its domains
+func (s *_store) Lookup(hostname string) LookupResult {
+	var result = LookupResult{
+		Records:    make([]dnsmessage.Resource, 0),
+		Forwarders: make([]net.UDPAddr, 0),
+		Groups:     make([]data.Group, 0),
+		Authority:  make([]dnsmessage.Resource, 0),
+	}
+	s.RLock()
+	defer func() {
+		if r := recover(); r != nil {
+			if s.log != nil {
+				s.log.Errorf(fmt.Sprintf("Store.Lookup::Runtime error: %v", r))
+			}
+		}
+		s.RUnlock()
+	}()
+	hostname = strings.TrimSuffix(hostname, ".")
+	key := hostname
+	domains := utils.SplitDomainsFromHostname(hostname)
+	if len(domains) == 1 && (domains[0] == "" || utils.IsDefaultGroupDomain(domains[0])) {
+		key = strings.Split(hostname, ".")[0]
+	}
+	// Domains are sorted from the widest to the narrowest, so the
+	// zone of a group is the last domain matching it
+	var groups = make(map[string]data.Group)
+	var zones = make(map[string]string)
+	var names = make([]string, 0)
+	for _, domain := range domains {
+		gr, err := s.store.GetGroupsByDomain(domain)
+		if err != nil || len(gr) == 0 {
+			continue
+		}
+		for _, g := range gr {
+			if _, ok := groups[g.Name]; !ok {
+				names = append(names, g.Name)
+			}
+			groups[g.Name] = g
+			zones[g.Name] = domain
+		}
+	}
+	if len(groups) == 0 {
+		if g, err := s.store.GetGroupById(utils.DEFAULT_GROUP_NAME); err == nil {
+			result.Forwarders = append(result.Forwarders, g.Forwarders...)
+			result.Policy = g.Policy
+			result.ServeStale = g.ServeStale
+			result.Prefetch = g.Prefetch
+		}
+		return result
+	}
+	var policyZone = -1
+	for _, name := range names {
+		g := groups[name]
+		if len(g.Forwarders) > 0 && len(zones[name]) > policyZone {
+			result.Policy = g.Policy
+			result.ServeStale = g.ServeStale
+			result.Prefetch = g.Prefetch
+			policyZone = len(zones[name])
+		}
+		result.Groups = append(result.Groups, g)
+		result.Forwarders = append(result.Forwarders, g.Forwarders...)
+		sg, err := s.store.GetGroupStore(g)
+		if err != nil {
+			s.log.Errorf("Store.Lookup:: Unable to get Store from file, due to Error: %v", err)
+			result.Authority = append(result.Authority, defaultSOA(zones[name]))
+			continue
+		}
+		for _, r := range recordsOf(&sg, key) {
+			result.Records = append(result.Records, r.Resource)
+		}
+		result.Authority = append(result.Authority, zoneSOA(&sg, zones[name]))
+	}
+	result.Forwarders = utils.RemoveDuplicatesInUpdAddrList(result.Forwarders)
+	return result
+}
+
+// recordsOf returns the records of a host name, saved with or without the trailing dot
+func recordsOf(sg *store.GroupStoreData, hostname string) []store.DNSRecord {
+	var out = make([]store.DNSRecord, 0)
+	if recs, err := sg.Get(hostname); err == nil {
+		out = append(out, recs...)
+	}
+	if recs, err := sg.Get(hostname + "."); err == nil {
+		out = append(out, recs...)
+	}
+	return out
+}
+
+// zoneSOA returns the SOA record of the zone in the group store, or a default one
+func zoneSOA(sg *store.GroupStoreData, zone string) dnsmessage.Resource {
+	for _, r := range recordsOf(sg, zone) {
+		if r.Resource.Header.Type == dnsmessage.TypeSOA {
+			return r.Resource
+		}
+	}
+	return defaultSOA(zone)
+}
+
+// defaultSOA builds the SOA record of a zone with no SOA record in its group
+func defaultSOA(zone string) dnsmessage.Resource {
+	if zone == "" {
+		zone = defaultZone
+	}
+	zone = strings.TrimSuffix(zone, ".") + "."
+	name, _ := dnsmessage.NewName(zone)
+	ns, _ := dnsmessage.NewName("ns." + zone)
+	mbox, _ := dnsmessage.NewName("hostmaster." + zone)
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  name,
+			Type:  dnsmessage.TypeSOA,
+			Class: dnsmessage.ClassINET,
+			TTL:   defaultSOATTL,
+		},
+		Body: &dnsmessage.SOAResource{
+			NS:      ns,
+			MBox:    mbox,
+			Serial:  defaultSOASerial,
+			Refresh: defaultSOARefresh,
+			Retry:   defaultSOARetry,
+			Expire:  defaultSOAExpire,
+			MinTTL:  defaultSOAMinTTL,
+		},
+	}
+}
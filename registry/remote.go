@@ -0,0 +1,480 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/hellgate75/rebind/data"
+	"github.com/hellgate75/rebind/log"
+	pnet "github.com/hellgate75/rebind/net"
+	"github.com/hellgate75/rebind/store"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+)
+
+// Commands of the remote store, executed by the process owning the store
+const (
+	storeLookupCommand         pnet.Command = "store.lookup"
+	storeSetCommand            pnet.Command = "store.set"
+	storeOverrideCommand       pnet.Command = "store.override"
+	storeRemoveCommand         pnet.Command = "store.remove"
+	storeSaveCommand           pnet.Command = "store.save"
+	storeCloneCommand          pnet.Command = "store.clone"
+	storeSaveGroupStoreCommand pnet.Command = "store.save-group-store"
+	storeInvalidateCommand     pnet.Command = "store.invalidate"
+	storeGroupsCommand         pnet.Command = "store.groups"
+	storeGroupCommand          pnet.Command = "store.group"
+	storeGroupStoreCommand     pnet.Command = "store.group-store"
+	storeCreateGroupCommand    pnet.Command = "store.create-group"
+	storeUpdateGroupCommand    pnet.Command = "store.update-group"
+	storeDeleteGroupCommand    pnet.Command = "store.delete-group"
+	storeHistoryCommand        pnet.Command = "store.history"
+	storeVersionCommand        pnet.Command = "store.version"
+	storeDiffCommand           pnet.Command = "store.diff"
+	storeRollbackCommand       pnet.Command = "store.rollback"
+	storeBatchCommand          pnet.Command = "store.batch"
+)
+
+// storeArgs are the arguments of a remote store call, gob encoded
+// because records carry the dnsmessage resource bodies
+type storeArgs struct {
+	Hostname   string
+	Hostnames  []string
+	Resource   dnsmessage.Resource
+	Resources  []dnsmessage.Resource
+	Old        *dnsmessage.Resource
+	Addr       net.IP
+	RecordData string
+	GroupName  string
+	Group      data.Group
+	GroupStore store.GroupStorePersistent
+	Domains    []string
+	Forwarders []net.UDPAddr
+	Actor      string
+	Version    uint64
+	From       uint64
+	To         uint64
+}
+
+// storeResult is the result of a remote store call, gob encoded
+type storeResult struct {
+	Ok         bool
+	Lookup     LookupResult
+	Group      data.Group
+	Groups     []data.Group
+	GroupStore store.GroupStorePersistent
+	Stores     map[string]store.GroupStorePersistent
+	History    []data.HistoryEntry
+	Changes    []data.RecordChange
+	Entry      data.HistoryEntry
+}
+
+func encodeStoreValue(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeStoreValue(b []byte, value interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(value)
+}
+
+// NewRemoteStore creates a Store forwarding the calls over a net pipe to the
+// process owning the store, which registered the store commands with
+// RegisterStoreCommands. The remote store keeps no data: Load does nothing and
+// GetGroupBucket returns nil.
+func NewRemoteStore(pipe pnet.NetPipe, logger log.Logger) Store {
+	return &remoteStore{
+		pipe: pipe,
+		log:  logger,
+	}
+}
+
+type remoteStore struct {
+	pipe    pnet.NetPipe
+	log     log.Logger
+	changes changeListeners
+}
+
+// call executes a store command on the other side and waits for its result
+func (s *remoteStore) call(command pnet.Command, args storeArgs) (result storeResult, err error) {
+	payload, err := encodeStoreValue(&args)
+	if err != nil {
+		return result, err
+	}
+	request, err := pnet.NewRequest(command, payload)
+	if err != nil {
+		return result, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pnet.DEFAULT_COMMAND_TIMEOUT)
+	defer cancel()
+	reply, err := s.pipe.Call(ctx, request)
+	if err != nil {
+		return result, err
+	}
+	var b []byte
+	if err = reply.Decode(&b); err != nil {
+		return result, err
+	}
+	if len(b) > 0 {
+		err = decodeStoreValue(b, &result)
+	}
+	return result, err
+}
+
+func (s *remoteStore) failed(method string, err error) {
+	if s.log != nil {
+		s.log.Errorf("RemoteStore.%s:: Error: %v", method, err)
+	}
+}
+
+func (s *remoteStore) GetGroupBucket() *data.GroupsBucket {
+	return nil
+}
+
+func (s *remoteStore) Get(hostname string) ([]dnsmessage.Resource, []net.UDPAddr, bool) {
+	result := s.Lookup(hostname)
+	return result.Records, result.Forwarders, len(result.Records) > 0
+}
+
+func (s *remoteStore) Lookup(hostname string) LookupResult {
+	result, err := s.call(storeLookupCommand, storeArgs{Hostname: hostname})
+	if err != nil {
+		s.failed("Lookup", err)
+		return LookupResult{
+			Records:    make([]dnsmessage.Resource, 0),
+			Forwarders: make([]net.UDPAddr, 0),
+			Groups:     make([]data.Group, 0),
+			Authority:  make([]dnsmessage.Resource, 0),
+		}
+	}
+	return result.Lookup
+}
+
+func (s *remoteStore) Set(hostname string, resource dnsmessage.Resource, addr net.IP, recordData string, old *dnsmessage.Resource) bool {
+	result, err := s.call(storeSetCommand, storeArgs{
+		Hostname:   hostname,
+		Resource:   resource,
+		Addr:       addr,
+		RecordData: recordData,
+		Old:        old,
+	})
+	if err != nil {
+		s.failed("Set", err)
+		return false
+	}
+	if result.Ok {
+		s.notify(ChangeEvent{Hostnames: []string{hostname}})
+	}
+	return result.Ok
+}
+
+func (s *remoteStore) Override(hostname string, resources []dnsmessage.Resource) {
+	_, err := s.call(storeOverrideCommand, storeArgs{
+		Hostname:  hostname,
+		Resources: resources,
+	})
+	if err != nil {
+		s.failed("Override", err)
+		return
+	}
+	s.notify(ChangeEvent{Hostnames: []string{hostname}})
+}
+
+func (s *remoteStore) Remove(hostname string, r *dnsmessage.Resource) bool {
+	result, err := s.call(storeRemoveCommand, storeArgs{
+		Hostname: hostname,
+		Old:      r,
+	})
+	if err != nil {
+		s.failed("Remove", err)
+		return false
+	}
+	if result.Ok {
+		s.notify(ChangeEvent{Hostnames: []string{hostname}})
+	}
+	return result.Ok
+}
+
+func (s *remoteStore) Save() {
+	if _, err := s.call(storeSaveCommand, storeArgs{}); err != nil {
+		s.failed("Save", err)
+	}
+}
+
+// Load does nothing, the process owning the store loads it
+func (s *remoteStore) Load() {
+}
+
+func (s *remoteStore) Clone() map[string]store.GroupStoreData {
+	cp := make(map[string]store.GroupStoreData)
+	result, err := s.call(storeCloneCommand, storeArgs{})
+	if err != nil {
+		s.failed("Clone", err)
+		return cp
+	}
+	for key, persistent := range result.Stores {
+		cp[key] = store.NewGroupStoreData(persistent)
+	}
+	return cp
+}
+
+func (s *remoteStore) SaveGroupStore(group data.Group, groupStore *store.GroupStoreData, hostnames ...string) error {
+	return s.SaveGroupStoreAs(data.SYSTEM_ACTOR, group, groupStore, hostnames...)
+}
+
+func (s *remoteStore) SaveGroupStoreAs(actor string, group data.Group, groupStore *store.GroupStoreData, hostnames ...string) error {
+	_, err := s.call(storeSaveGroupStoreCommand, storeArgs{
+		Actor:      actor,
+		Group:      group,
+		GroupStore: groupStore.PersistentData(),
+		Hostnames:  hostnames,
+	})
+	if err != nil {
+		return err
+	}
+	s.notify(ChangeEvent{
+		Groups:    []string{group.Name},
+		Hostnames: hostnames,
+	})
+	return nil
+}
+
+func (s *remoteStore) SaveGroupAndStore(actor string, group data.Group, groupStore *store.GroupStoreData) error {
+	_, err := s.call(storeBatchCommand, storeArgs{
+		Actor:      actor,
+		Group:      group,
+		GroupStore: groupStore.PersistentData(),
+	})
+	if err != nil {
+		return err
+	}
+	s.notify(ChangeEvent{Groups: []string{group.Name}})
+	return nil
+}
+
+func (s *remoteStore) Invalidate(groupName string) error {
+	_, err := s.call(storeInvalidateCommand, storeArgs{GroupName: groupName})
+	if err != nil {
+		return err
+	}
+	var event ChangeEvent
+	if groupName != "" {
+		event.Groups = []string{groupName}
+	}
+	s.notify(event)
+	return nil
+}
+
+func (s *remoteStore) ListGroups() []data.Group {
+	result, err := s.call(storeGroupsCommand, storeArgs{})
+	if err != nil {
+		s.failed("ListGroups", err)
+		return make([]data.Group, 0)
+	}
+	if result.Groups == nil {
+		return make([]data.Group, 0)
+	}
+	return result.Groups
+}
+
+func (s *remoteStore) GetGroup(groupName string) (data.Group, error) {
+	result, err := s.call(storeGroupCommand, storeArgs{GroupName: groupName})
+	return result.Group, err
+}
+
+func (s *remoteStore) GetGroupStore(group data.Group) (store.GroupStoreData, error) {
+	result, err := s.call(storeGroupStoreCommand, storeArgs{Group: group})
+	if err != nil {
+		return store.GroupStoreData{}, err
+	}
+	return store.NewGroupStoreData(result.GroupStore), nil
+}
+
+func (s *remoteStore) CreateGroup(groupName string, domains []string, forwarders []net.UDPAddr) (data.Group, error) {
+	result, err := s.call(storeCreateGroupCommand, storeArgs{
+		GroupName:  groupName,
+		Domains:    domains,
+		Forwarders: forwarders,
+	})
+	return result.Group, err
+}
+
+func (s *remoteStore) UpdateGroup(group data.Group) error {
+	_, err := s.call(storeUpdateGroupCommand, storeArgs{Group: group})
+	return err
+}
+
+func (s *remoteStore) DeleteGroup(groupName string) error {
+	_, err := s.call(storeDeleteGroupCommand, storeArgs{GroupName: groupName})
+	return err
+}
+
+func (s *remoteStore) GroupHistory(groupName string) ([]data.HistoryEntry, error) {
+	result, err := s.call(storeHistoryCommand, storeArgs{GroupName: groupName})
+	return result.History, err
+}
+
+func (s *remoteStore) GetGroupVersion(groupName string, version uint64) (store.GroupStorePersistent, error) {
+	result, err := s.call(storeVersionCommand, storeArgs{
+		GroupName: groupName,
+		Version:   version,
+	})
+	return result.GroupStore, err
+}
+
+func (s *remoteStore) DiffGroupVersions(groupName string, from uint64, to uint64) ([]data.RecordChange, error) {
+	result, err := s.call(storeDiffCommand, storeArgs{
+		GroupName: groupName,
+		From:      from,
+		To:        to,
+	})
+	return result.Changes, err
+}
+
+func (s *remoteStore) RollbackGroup(actor string, groupName string, version uint64) (data.HistoryEntry, error) {
+	result, err := s.call(storeRollbackCommand, storeArgs{
+		Actor:     actor,
+		GroupName: groupName,
+		Version:   version,
+	})
+	if err != nil {
+		return result.Entry, err
+	}
+	if len(result.Entry.Changes) > 0 {
+		var event = ChangeEvent{Groups: []string{groupName}}
+		for _, change := range result.Entry.Changes {
+			event.Hostnames = append(event.Hostnames, change.Key)
+		}
+		s.notify(event)
+	}
+	return result.Entry, nil
+}
+
+func (s *remoteStore) AddListener(listener ChangeListener) {
+	s.changes.add(listener)
+}
+
+func (s *remoteStore) notify(event ChangeEvent) {
+	s.changes.notify(s.log, event)
+}
+
+// storeCommand wraps a store call as a net pipe command handler
+func storeCommand(exec func(args storeArgs) (storeResult, error)) pnet.CommandHandler {
+	return func(ctx context.Context, request pnet.Request) (payload interface{}, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = errors.New(fmt.Sprintf("Runtime error executing %s: %v", request.Command, r))
+			}
+		}()
+		var b []byte
+		if err = request.Decode(&b); err != nil {
+			return nil, err
+		}
+		var args storeArgs
+		if len(b) > 0 {
+			if err = decodeStoreValue(b, &args); err != nil {
+				return nil, err
+			}
+		}
+		result, err := exec(args)
+		if err != nil {
+			return nil, err
+		}
+		return encodeStoreValue(&result)
+	}
+}
+
+// RegisterStoreCommands makes a store available to the remote stores on the
+// other side of the pipe, which becomes its single writer
+func RegisterStoreCommands(pipe pnet.NetPipe, st Store) {
+	pipe.Handle(storeLookupCommand, storeCommand(func(args storeArgs) (storeResult, error) {
+		return storeResult{Lookup: st.Lookup(args.Hostname)}, nil
+	}))
+	pipe.Handle(storeSetCommand, storeCommand(func(args storeArgs) (storeResult, error) {
+		return storeResult{Ok: st.Set(args.Hostname, args.Resource, args.Addr, args.RecordData, args.Old)}, nil
+	}))
+	pipe.Handle(storeOverrideCommand, storeCommand(func(args storeArgs) (storeResult, error) {
+		st.Override(args.Hostname, args.Resources)
+		return storeResult{Ok: true}, nil
+	}))
+	pipe.Handle(storeRemoveCommand, storeCommand(func(args storeArgs) (storeResult, error) {
+		return storeResult{Ok: st.Remove(args.Hostname, args.Old)}, nil
+	}))
+	pipe.Handle(storeSaveCommand, storeCommand(func(args storeArgs) (storeResult, error) {
+		st.Save()
+		return storeResult{Ok: true}, nil
+	}))
+	pipe.Handle(storeCloneCommand, storeCommand(func(args storeArgs) (storeResult, error) {
+		var result = storeResult{
+			Ok:     true,
+			Stores: make(map[string]store.GroupStorePersistent),
+		}
+		for _, group := range st.ListGroups() {
+			groupStore, err := st.GetGroupStore(group)
+			if err == nil {
+				result.Stores[group.Name] = groupStore.PersistentData()
+			}
+		}
+		return result, nil
+	}))
+	pipe.Handle(storeSaveGroupStoreCommand, storeCommand(func(args storeArgs) (storeResult, error) {
+		groupStore := store.NewGroupStoreData(args.GroupStore)
+		return storeResult{Ok: true}, st.SaveGroupStoreAs(args.Actor, args.Group, &groupStore, args.Hostnames...)
+	}))
+	pipe.Handle(storeBatchCommand, storeCommand(func(args storeArgs) (storeResult, error) {
+		groupStore := store.NewGroupStoreData(args.GroupStore)
+		return storeResult{Ok: true}, st.SaveGroupAndStore(args.Actor, args.Group, &groupStore)
+	}))
+	pipe.Handle(storeInvalidateCommand, storeCommand(func(args storeArgs) (storeResult, error) {
+		return storeResult{Ok: true}, st.Invalidate(args.GroupName)
+	}))
+	pipe.Handle(storeGroupsCommand, storeCommand(func(args storeArgs) (storeResult, error) {
+		return storeResult{Ok: true, Groups: st.ListGroups()}, nil
+	}))
+	pipe.Handle(storeGroupCommand, storeCommand(func(args storeArgs) (storeResult, error) {
+		group, err := st.GetGroup(args.GroupName)
+		return storeResult{Ok: true, Group: group}, err
+	}))
+	pipe.Handle(storeGroupStoreCommand, storeCommand(func(args storeArgs) (storeResult, error) {
+		groupStore, err := st.GetGroupStore(args.Group)
+		if err != nil {
+			return storeResult{}, err
+		}
+		return storeResult{Ok: true, GroupStore: groupStore.PersistentData()}, nil
+	}))
+	pipe.Handle(storeCreateGroupCommand, storeCommand(func(args storeArgs) (storeResult, error) {
+		group, err := st.CreateGroup(args.GroupName, args.Domains, args.Forwarders)
+		return storeResult{Ok: true, Group: group}, err
+	}))
+	pipe.Handle(storeUpdateGroupCommand, storeCommand(func(args storeArgs) (storeResult, error) {
+		return storeResult{Ok: true}, st.UpdateGroup(args.Group)
+	}))
+	pipe.Handle(storeDeleteGroupCommand, storeCommand(func(args storeArgs) (storeResult, error) {
+		return storeResult{Ok: true}, st.DeleteGroup(args.GroupName)
+	}))
+	pipe.Handle(storeHistoryCommand, storeCommand(func(args storeArgs) (storeResult, error) {
+		history, err := st.GroupHistory(args.GroupName)
+		return storeResult{Ok: true, History: history}, err
+	}))
+	pipe.Handle(storeVersionCommand, storeCommand(func(args storeArgs) (storeResult, error) {
+		persistent, err := st.GetGroupVersion(args.GroupName, args.Version)
+		return storeResult{Ok: true, GroupStore: persistent}, err
+	}))
+	pipe.Handle(storeDiffCommand, storeCommand(func(args storeArgs) (storeResult, error) {
+		changes, err := st.DiffGroupVersions(args.GroupName, args.From, args.To)
+		return storeResult{Ok: true, Changes: changes}, err
+	}))
+	pipe.Handle(storeRollbackCommand, storeCommand(func(args storeArgs) (storeResult, error) {
+		entry, err := st.RollbackGroup(args.Actor, args.GroupName, args.Version)
+		return storeResult{Ok: true, Entry: entry}, err
+	}))
+}
@@ -5,13 +5,17 @@
 package registry
 
 import (
+	"errors"
 	"fmt"
 	"github.com/hellgate75/rebind/data"
 	"github.com/hellgate75/rebind/log"
+	"github.com/hellgate75/rebind/model"
 	"github.com/hellgate75/rebind/store"
 	"github.com/hellgate75/rebind/utils"
 	"golang.org/x/net/dns/dnsmessage"
 	"net"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
 	"time"
@@ -22,6 +26,7 @@ import (
 
 type Store interface {
 	Get(hostname string) ([]dnsmessage.Resource, []net.UDPAddr, bool)
+	Lookup(hostname string) LookupResult
 	Set(hostname string, resource dnsmessage.Resource, addr net.IP, recordData string, old *dnsmessage.Resource) bool
 	Override(hostname string, resources []dnsmessage.Resource)
 	Remove(hostname string, r *dnsmessage.Resource) bool
@@ -29,27 +34,89 @@ type Store interface {
 	Load()
 	Clone() map[string]store.GroupStoreData
 	GetGroupBucket() *data.GroupsBucket
+	// Persists a group store changed out of the store and notifies the listeners
+	SaveGroupStore(group data.Group, groupStore *store.GroupStoreData, hostnames ...string) error
+	// Persists a group store changed out of the store by an actor, recorded in the group history
+	SaveGroupStoreAs(actor string, group data.Group, groupStore *store.GroupStoreData, hostnames ...string) error
+	// Persists together an existing group and its store, changed out of the store by an actor, as a single change
+	SaveGroupAndStore(actor string, group data.Group, groupStore *store.GroupStoreData) error
+	// Drops the loaded store of a group, or of all groups and reloads the groups
+	// index when the group name is empty, and notifies the listeners
+	Invalidate(groupName string) error
+	AddListener(listener ChangeListener)
+	// Lists the groups
+	ListGroups() []data.Group
+	// Gets a group by name
+	GetGroup(groupName string) (data.Group, error)
+	// Gets the store of a group
+	GetGroupStore(group data.Group) (store.GroupStoreData, error)
+	// Creates and persists a group, with an empty store, and notifies the listeners
+	CreateGroup(groupName string, domains []string, forwarders []net.UDPAddr) (data.Group, error)
+	// Persists the changes of an existing group, not of its store, and notifies the listeners
+	UpdateGroup(group data.Group) error
+	// Deletes a group and its store and notifies the listeners
+	DeleteGroup(groupName string) error
+	// Lists the versions of the records of a group, oldest first
+	GroupHistory(groupName string) ([]data.HistoryEntry, error)
+	// Gets the records of a group at a version, 0 is before the first recorded change
+	GetGroupVersion(groupName string, version uint64) (store.GroupStorePersistent, error)
+	// Diffs the records of a group between two versions
+	DiffGroupVersions(groupName string, from uint64, to uint64) ([]data.RecordChange, error)
+	// Rolls the records of a group back to a version, recorded as a new version by the actor
+	RollbackGroup(actor string, groupName string, version uint64) (data.HistoryEntry, error)
 }
 
 // Create New Store with a logger and the rw config directory path
 func NewStore(logger log.Logger, rwDirPath string,
+	forwarders []net.UDPAddr) Store {
+	return NewStoreWith(logger, rwDirPath, data.NewFileBackend(rwDirPath, logger), forwarders)
+}
+
+// Create New Store with a logger, the rw config directory path and the storage backend
+func NewStoreWith(logger log.Logger, rwDirPath string, backend data.Backend,
 	forwarders []net.UDPAddr) Store {
 	return &_store{
 		log:        logger,
-		store:      data.NewGroupsBucket(rwDirPath, logger),
+		store:      data.NewGroupsBucketWith(rwDirPath, backend, logger),
+		cache:      store.NewGroupsStore(),
+		forwarders: forwarders,
+		rwDirPath:  rwDirPath,
+		history:    data.NewHistory(filepath.Join(rwDirPath, data.HISTORY_FOLDER), logger),
+	}
+}
+
+// Create New Store with a logger, the rw config directory path and the storage
+// backend, journaling the records changes: group stores are saved at the snapshots,
+// taken periodically and when the journal exceeds the configured number of entries
+func NewJournaledStore(logger log.Logger, rwDirPath string, backend data.Backend,
+	journal *data.Journal, config model.JournalConfig, forwarders []net.UDPAddr) Store {
+	s := &_store{
+		log:        logger,
+		store:      data.NewGroupsBucketWith(rwDirPath, backend, logger),
 		cache:      store.NewGroupsStore(),
 		forwarders: forwarders,
 		rwDirPath:  rwDirPath,
+		history:    data.NewHistory(filepath.Join(rwDirPath, data.HISTORY_FOLDER), logger),
+		journal:    config,
 	}
+	s.store.UseJournal(journal)
+	if config.SnapshotInterval > 0 {
+		go s.snapshots(time.Duration(config.SnapshotInterval) * time.Second)
+	}
+	return s
 }
 
 type _store struct {
 	sync.RWMutex
-	store      data.GroupsBucket
-	cache      store.GroupsStore
-	rwDirPath  string
-	log        log.Logger
-	forwarders []net.UDPAddr
+	store        data.GroupsBucket
+	cache        store.GroupsStore
+	rwDirPath    string
+	log          log.Logger
+	forwarders   []net.UDPAddr
+	changes      changeListeners
+	history      *data.History
+	journal      model.JournalConfig
+	snapshotting int32
 }
 
 func (s *_store) GetGroupBucket() *data.GroupsBucket {
@@ -57,54 +124,11 @@ func (s *_store) GetGroupBucket() *data.GroupsBucket {
 }
 
 func (s *_store) Get(hostname string) ([]dnsmessage.Resource, []net.UDPAddr, bool) {
-	var ok = true
-	s.RLock()
-	defer func() {
-		if r := recover(); r != nil {
-			if s.log != nil {
-				s.log.Errorf(fmt.Sprintf("Store.Get::Runtime error: %v", r))
-				ok = false
-			}
-		}
-		s.RUnlock()
-	}()
-	domains := utils.SplitDomainsFromHostname(hostname)
-	var res = make([]dnsmessage.Resource, 0)
-	var fwd = make([]net.UDPAddr, 0)
-
-	var groups = make(map[string]data.Group, 0)
-	for _, domain := range domains {
-		gr, err := s.store.GetGroupsByDomain(domain)
-		if err == nil || len(gr) == 0 {
-			s.log.Error("Store.Get:: Unable to get Store from domain/sub-domain: %s, due to Error: %v", domain, err)
-			ok = false
-			continue
-		}
-		for _, g := range gr {
-			groups[g.Name] = g
-		}
-	}
-	for _, g := range groups {
-		fwd = append(fwd, g.Forwarders...)
-		sg, err := s.store.GetGroupStore(g)
-		if err != nil {
-			s.log.Error("Store.Get:: Unable to get Store from file, due to Error: %v", err)
-			continue
-		}
-		recs, errR := sg.Get(hostname)
-		if errR != nil {
-			s.log.Error("Store.Get:: Unable to discover for host: %s, due to Error: %v", hostname, errR.Error())
-			continue
-		}
-		for _, r := range recs {
-			res = append(res, r.Resource)
-		}
-	}
-	return res, fwd, ok
+	result := s.Lookup(hostname)
+	return result.Records, result.Forwarders, len(result.Records) > 0
 }
 
 func (s *_store) GetGroupsFromHost(hostname string) ([]data.Group, error) {
-	return nil, nil
 	server := strings.Split(hostname, ".")[0]
 	domains := utils.SplitDomainsFromHostname(hostname)
 	if len(domains) == 1 && (domains[0] == "" || utils.IsDefaultGroupDomain(domains[0])) {
@@ -113,8 +137,8 @@ func (s *_store) GetGroupsFromHost(hostname string) ([]data.Group, error) {
 	var groups = make([]data.Group, 0)
 	for _, domain := range domains {
 		gr, err := s.store.GetGroupsByDomain(domain)
-		if err == nil || len(gr) == 0 {
-			s.log.Error("Store.GetGroupsFromHost:: Unable to get Store from domain/sub-domain: %s, due to Error: %v", domain, err)
+		if err != nil || len(gr) == 0 {
+			s.log.Debugf("Store.GetGroupsFromHost:: Unable to get Store from domain/sub-domain: %s, due to Error: %v", domain, err)
 			continue
 		}
 		groups = append(groups, gr...)
@@ -125,6 +149,7 @@ func (s *_store) GetGroupsFromHost(hostname string) ([]data.Group, error) {
 func (s *_store) Set(hostname string, resource dnsmessage.Resource, addr net.IP, recordData string, old *dnsmessage.Resource) bool {
 	ok := true
 	changed := false
+	event := ChangeEvent{Hostnames: []string{hostname}}
 	s.Lock()
 	defer func() {
 		if r := recover(); r != nil {
@@ -134,6 +159,10 @@ func (s *_store) Set(hostname string, resource dnsmessage.Resource, addr net.IP,
 			}
 		}
 		s.Unlock()
+		if changed {
+			s.notify(event)
+			s.snapshotIfNeeded()
+		}
 	}()
 	server := strings.Split(hostname, ".")[0]
 	domains := utils.SplitDomainsFromHostname(hostname)
@@ -145,9 +174,8 @@ func (s *_store) Set(hostname string, resource dnsmessage.Resource, addr net.IP,
 	var groups = make(map[string]data.Group, 0)
 	for _, domain := range domains {
 		gr, err := s.store.GetGroupsByDomain(domain)
-		if err == nil || len(gr) == 0 {
-			s.log.Error("Store.Set:: Unable to get Store from domain/sub-domain: %s, due to Error: %v", domain, err)
-			ok = false
+		if err != nil || len(gr) == 0 {
+			s.log.Debugf("Store.Set:: Unable to get Store from domain/sub-domain: %s, due to Error: %v", domain, err)
 			continue
 		}
 		for _, g := range gr {
@@ -164,29 +192,27 @@ func (s *_store) Set(hostname string, resource dnsmessage.Resource, addr net.IP,
 		}
 		sg.Forwarders = append(sg.Forwarders, fwd...)
 		sg.Forwarders = utils.RemoveDuplicatesInUpdAddrList(sg.Forwarders)
-		recs, errR := sg.Get(hostname)
-		if errR != nil || len(recs) == 0 {
-			sg.Set(hostname, store.DNSRecord{
-				Resource: resource,
-				TTL:      resource.Header.TTL,
-				Created:  time.Now(),
-				Data:     recordData,
-				Addr:     addr,
-				Type:     resource.Header.Type.String(),
-				NodeName: hostname,
-			})
-		} else {
-			sg.Set(hostname, store.DNSRecord{
-				Resource: resource,
-				TTL:      resource.Header.TTL,
-				Created:  time.Now(),
-				Data:     recordData,
-				Addr:     addr,
-				Type:     resource.Header.Type.String(),
-				NodeName: hostname,
-			})
+		before := hostRecords(&sg, hostname)
+		record := store.DNSRecord{
+			Resource: resource,
+			TTL:      resource.Header.TTL,
+			Created:  time.Now(),
+			Data:     recordData,
+			Addr:     addr,
+			Type:     resource.Header.Type.String(),
+			NodeName: hostname,
+		}
+		sg.Set(hostname, record)
+		g, err = s.store.SaveGroupChange(&sg, g, data.JournalEntry{
+			Op:      data.JournalSetOp,
+			Key:     hostname,
+			Records: []store.DNSRecord{record},
+		})
+		if err == nil {
+			changed = true
+			event.Groups = append(event.Groups, g.Name)
+			s.recordHistory(g.Name, data.SYSTEM_ACTOR, data.HistorySetOp, data.DiffRecords(before, hostRecords(&sg, hostname), hostname))
 		}
-		g, err = s.store.SaveGroup(sg, g)
 		if s.store.UpdateExistingGroup(g) {
 			change = true
 		}
@@ -198,6 +224,7 @@ func (s *_store) Set(hostname string, resource dnsmessage.Resource, addr net.IP,
 }
 
 func (s *_store) Override(hostname string, resources []dnsmessage.Resource) {
+	event := ChangeEvent{Hostnames: []string{hostname}}
 	s.Lock()
 	defer func() {
 		if r := recover(); r != nil {
@@ -206,6 +233,10 @@ func (s *_store) Override(hostname string, resources []dnsmessage.Resource) {
 			}
 		}
 		s.Unlock()
+		if len(event.Groups) > 0 {
+			s.notify(event)
+			s.snapshotIfNeeded()
+		}
 	}()
 	if len(resources) == 0 {
 		s.log.Error("Store.Override:: error: Resource are empty, please remove instead of update empty")
@@ -235,8 +266,8 @@ func (s *_store) Override(hostname string, resources []dnsmessage.Resource) {
 	var groups = make([]data.Group, 0)
 	for _, domain := range domains {
 		gr, err := s.store.GetGroupsByDomain(domain)
-		if err == nil || len(gr) == 0 {
-			s.log.Error("Store.Override:: Unable to get Store from domain/sub-domain: %s, due to Error: %v", domain, err)
+		if err != nil || len(gr) == 0 {
+			s.log.Debugf("Store.Override:: Unable to get Store from domain/sub-domain: %s, due to Error: %v", domain, err)
 			continue
 		}
 		groups = append(groups, gr...)
@@ -252,9 +283,18 @@ func (s *_store) Override(hostname string, resources []dnsmessage.Resource) {
 		}
 		sg.Forwarders = append(sg.Forwarders, fwd...)
 		sg.Forwarders = utils.RemoveDuplicatesInUpdAddrList(sg.Forwarders)
+		before := hostRecords(&sg, hostname)
 		errR := sg.Replace(hostname, dnsRecords)
 		if errR == nil {
-			g, err = s.store.SaveGroup(sg, g)
+			g, err = s.store.SaveGroupChange(&sg, g, data.JournalEntry{
+				Op:      data.JournalReplaceOp,
+				Key:     hostname,
+				Records: dnsRecords,
+			})
+			if err == nil {
+				event.Groups = append(event.Groups, g.Name)
+				s.recordHistory(g.Name, data.SYSTEM_ACTOR, data.HistoryReplaceOp, data.DiffRecords(before, hostRecords(&sg, hostname), hostname))
+			}
 			if s.store.UpdateExistingGroup(g) {
 				change = true
 			}
@@ -267,6 +307,7 @@ func (s *_store) Override(hostname string, resources []dnsmessage.Resource) {
 
 func (s *_store) Remove(hostname string, r *dnsmessage.Resource) bool {
 	ok := false
+	event := ChangeEvent{Hostnames: []string{hostname}}
 	s.Lock()
 	defer func() {
 		if r := recover(); r != nil {
@@ -275,11 +316,207 @@ func (s *_store) Remove(hostname string, r *dnsmessage.Resource) bool {
 			}
 		}
 		s.Unlock()
+		if ok {
+			s.notify(event)
+			s.snapshotIfNeeded()
+		}
 	}()
-	//TODO: Here code for removing element in all marching groups
+	server := strings.Split(hostname, ".")[0]
+	domains := utils.SplitDomainsFromHostname(hostname)
+	if len(domains) == 1 && (domains[0] == "" || utils.IsDefaultGroupDomain(domains[0])) {
+		hostname = server
+	}
+
+	var groups = make(map[string]data.Group, 0)
+	for _, domain := range domains {
+		gr, err := s.store.GetGroupsByDomain(domain)
+		if err != nil || len(gr) == 0 {
+			s.log.Debugf("Store.Remove:: Unable to get Store from domain/sub-domain: %s, due to Error: %v", domain, err)
+			continue
+		}
+		for _, g := range gr {
+			groups[g.Name] = g
+		}
+	}
+	var change = false
+	for _, g := range groups {
+		loaded, err := s.store.GetGroupStore(g)
+		if err != nil {
+			s.log.Errorf("Store.Remove:: Unable to get Store from file, due to Error: %v", err)
+			continue
+		}
+		// a copy, the loaded store is replaced only when saved
+		sg := store.NewGroupStoreData(data.CopyRecords(loaded.PersistentData()))
+		before := hostRecords(&sg, hostname)
+		if sg.RemoveResource(hostname, r) == 0 {
+			continue
+		}
+		g.NumRecs = countRecords(&sg)
+		g, err = s.store.SaveGroupChange(&sg, g, data.JournalEntry{
+			Op:       data.JournalRemoveOp,
+			Key:      hostname,
+			Resource: r,
+		})
+		if err != nil {
+			s.log.Errorf("Store.Remove:: Unable to save group %s, due to Error: %v", g.Name, err)
+			continue
+		}
+		ok = true
+		event.Groups = append(event.Groups, g.Name)
+		s.recordHistory(g.Name, data.SYSTEM_ACTOR, data.HistoryRemoveOp, data.DiffRecords(before, hostRecords(&sg, hostname), hostname))
+		if s.store.UpdateExistingGroup(g) {
+			change = true
+		}
+	}
+	if change {
+		s.store.SaveMeta()
+	}
 	return ok
 }
 
+// countRecords returns the number of records of a group store
+func countRecords(groupStore *store.GroupStoreData) int64 {
+	var numRecs int64
+	for _, key := range groupStore.Keys() {
+		recs, _ := groupStore.Get(key)
+		numRecs += int64(len(recs))
+	}
+	return numRecs
+}
+
+func (s *_store) SaveGroupStore(group data.Group, groupStore *store.GroupStoreData, hostnames ...string) error {
+	return s.SaveGroupStoreAs(data.SYSTEM_ACTOR, group, groupStore, hostnames...)
+}
+
+func (s *_store) SaveGroupStoreAs(actor string, group data.Group, groupStore *store.GroupStoreData, hostnames ...string) (err error) {
+	s.Lock()
+	defer func() {
+		if r := recover(); r != nil {
+			if s.log != nil {
+				s.log.Errorf(fmt.Sprintf("Store.SaveGroupStore::Runtime error: %v", r))
+			}
+			err = errors.New(fmt.Sprintf("%v", r))
+		}
+		s.Unlock()
+		if err == nil {
+			s.notify(ChangeEvent{
+				Groups:    []string{group.Name},
+				Hostnames: hostnames,
+			})
+			s.snapshotIfNeeded()
+		}
+	}()
+	var before = make(map[string][]store.DNSRecord)
+	if current, cErr := s.store.GetGroupStore(group); cErr == nil {
+		before = current.PersistentData().Store
+	}
+	group.NumRecs = countRecords(groupStore)
+	group, err = s.store.SaveGroupChange(groupStore, group, groupStoreEntry(groupStore, hostnames))
+	if err != nil {
+		return err
+	}
+	s.recordHistory(group.Name, actor, data.HistoryUpdateOp, data.DiffRecords(before, groupStore.PersistentData().Store, hostnames...))
+	if s.store.UpdateExistingGroup(group) {
+		err = s.store.SaveMeta()
+	}
+	return err
+}
+
+func (s *_store) SaveGroupAndStore(actor string, group data.Group, groupStore *store.GroupStoreData) (err error) {
+	var event ChangeEvent
+	s.Lock()
+	defer func() {
+		if r := recover(); r != nil {
+			if s.log != nil {
+				s.log.Errorf(fmt.Sprintf("Store.SaveGroupAndStore::Runtime error: %v", r))
+			}
+			err = errors.New(fmt.Sprintf("%v", r))
+		}
+		s.Unlock()
+		if err == nil {
+			s.notify(event)
+			s.snapshotIfNeeded()
+		}
+	}()
+	current, err := s.store.GetGroupById(group.Name)
+	if err != nil {
+		return err
+	}
+	var before = make(map[string][]store.DNSRecord)
+	if currentStore, cErr := s.store.GetGroupStore(current); cErr == nil {
+		before = currentStore.PersistentData().Store
+	}
+	groupStore.GroupName = group.Name
+	groupStore.Domains = group.Domains
+	groupStore.Forwarders = group.Forwarders
+	group.NumRecs = countRecords(groupStore)
+	group, err = s.store.SaveGroupAndStore(groupStore, group)
+	if err != nil {
+		return err
+	}
+	changes := data.DiffRecords(before, groupStore.PersistentData().Store)
+	s.recordHistory(group.Name, actor, data.HistoryBatchOp, changes)
+	event.Groups = []string{group.Name}
+	// changed domains or forwarders may change any answer
+	if reflect.DeepEqual(current.Domains, group.Domains) && reflect.DeepEqual(current.Forwarders, group.Forwarders) {
+		for _, change := range changes {
+			event.Hostnames = append(event.Hostnames, change.Key)
+		}
+	}
+	return nil
+}
+
+// groupStoreEntry returns the journal entry of a group store changed out of the
+// store: the records of the changed host name, or all the records
+func groupStoreEntry(groupStore *store.GroupStoreData, hostnames []string) data.JournalEntry {
+	if len(hostnames) != 1 {
+		var persistent = groupStore.PersistentData()
+		return data.JournalEntry{
+			Op:    data.JournalStoreOp,
+			Store: &persistent,
+		}
+	}
+	recs, err := groupStore.Get(hostnames[0])
+	if err != nil {
+		return data.JournalEntry{
+			Op:  data.JournalRemoveOp,
+			Key: hostnames[0],
+		}
+	}
+	return data.JournalEntry{
+		Op:      data.JournalReplaceOp,
+		Key:     hostnames[0],
+		Records: recs,
+	}
+}
+
+func (s *_store) Invalidate(groupName string) (err error) {
+	s.Lock()
+	defer func() {
+		if r := recover(); r != nil {
+			if s.log != nil {
+				s.log.Errorf(fmt.Sprintf("Store.Invalidate::Runtime error: %v", r))
+			}
+			err = errors.New(fmt.Sprintf("%v", r))
+		}
+		s.Unlock()
+		if err == nil {
+			var event ChangeEvent
+			if groupName != "" {
+				event.Groups = []string{groupName}
+			}
+			s.notify(event)
+		}
+	}()
+	if groupName == "" {
+		// reload drops all the loaded stores
+		err = s.store.ReLoad()
+	} else {
+		s.store.Invalidate(groupName)
+	}
+	return err
+}
+
 func (s *_store) Save() {
 	defer func() {
 		if r := recover(); r != nil {
@@ -297,7 +534,10 @@ func (s *_store) Save() {
 }
 
 func (s *_store) Load() {
+	// the groups and the loaded stores are replaced, lookups wait for it
+	s.Lock()
 	err := s.store.Load(s.forwarders)
+	s.Unlock()
 	if err != nil {
 		if s.log != nil {
 			s.log.Errorf("Store.Load:: loading meta -> err Error: %v maybe first start,please ignore", err)
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/hellgate75/rebind/log"
 	"github.com/hellgate75/rebind/net"
@@ -31,6 +32,9 @@ func createV1ApiEndpoints(router *mux.Router,
 	v1GroupRest := NewV1DnsGroupRestService(pipe, store, logger, hostBaseUrl)
 	v1DnsGroupResourcesRest := NewV1DnsGroupResourcesRestService(pipe, store, logger, hostBaseUrl)
 	v1DnsGroupResourceDetailsRest := NewV1DnsGroupResourceDetailsRestService(pipe, store, logger, hostBaseUrl)
+	v1DnsGroupHistoryRest := NewV1DnsGroupHistoryRestService(pipe, store, logger, hostBaseUrl)
+	v1DnsGroupVersionRest := NewV1DnsGroupVersionRestService(pipe, store, logger, hostBaseUrl)
+	v1DnsGroupBatchRest := NewV1DnsGroupBatchRestService(pipe, store, logger, hostBaseUrl)
 	//Adding entry point for zones queries (PUT, POST, DEL, GET)
 	router.HandleFunc("/v1/dns", authFunc(dnsHandler(v1DnsRootRest))).Methods("GET", "POST", "PUT", "DELETE")
 	//Adding entry point for groups queries (PUT, POST, DEL, GET)
@@ -41,4 +45,64 @@ func createV1ApiEndpoints(router *mux.Router,
 	router.HandleFunc("/v1/dns/group/{group:[a-zA-Z0-9]+}/resources", authFunc(dnsHandler(v1DnsGroupResourcesRest))).Methods("GET", "POST", "PUT", "DELETE")
 	//Adding entry point for specific group queries (PUT, POST, DEL, GET)
 	router.HandleFunc("/v1/dns/group/{group:[a-zA-Z0-9]+}/resources/{resource:[a-zA-Z0-9]+}", authFunc(dnsHandler(v1DnsGroupResourceDetailsRest))).Methods("GET", "POST", "PUT", "DELETE")
+	//Adding entry point for specific group history queries (GET)
+	router.HandleFunc("/v1/dns/group/{group:[a-zA-Z0-9]+}/history", authFunc(dnsHandler(v1DnsGroupHistoryRest))).Methods("GET")
+	//Adding entry point for specific group version queries and rollback (POST, GET)
+	router.HandleFunc("/v1/dns/group/{group:[a-zA-Z0-9]+}/history/{version:[0-9]+}", authFunc(dnsHandler(v1DnsGroupVersionRest))).Methods("GET", "POST")
+	//Adding entry point for specific group batch of operations (POST, PUT) and its templates (GET)
+	router.HandleFunc("/v1/dns/group/{group:[a-zA-Z0-9]+}/batch", authFunc(dnsHandler(v1DnsGroupBatchRest))).Methods("GET", "POST", "PUT")
+}
+
+// NewApiRouter creates a router with all the API endpoints. A nil pipe means
+// the store is shared with the DNS server, so changes need no propagation.
+func NewApiRouter(pipe net.NetPipe, store registry.Store, logger log.Logger, hostBaseUrl string) *mux.Router {
+	// Handler stuf for the API service groups
+	dnsHandler := func(serv RestService) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodPost:
+				serv.Create(w, r)
+			case http.MethodGet:
+				serv.Read(w, r)
+			case http.MethodPut:
+				serv.Update(w, r)
+			case http.MethodDelete:
+				serv.Delete(w, r)
+			}
+		}
+	}
+
+	// no authentication yet, requests go straight to the handlers
+	withAuth := func(h http.HandlerFunc) http.HandlerFunc {
+		return h
+	}
+
+	rtr := mux.NewRouter()
+	// Creates/Sets API endpoints handlers
+	CreateApiEndpoints(rtr, withAuth, dnsHandler, pipe, store, logger, hostBaseUrl)
+	return rtr
+}
+
+// BaseUrl returns the base url of the API server
+func BaseUrl(listenIP string, listenPort int, tlsCert string, tlsKey string) string {
+	var proto string = "http"
+	if tlsCert != "" && tlsKey != "" {
+		proto = "https"
+	}
+	return fmt.Sprintf("%s://%s:%v", proto, listenIP, listenPort)
+}
+
+// ListenAndServe serves the API router, with TLS when certificate and key are provided
+func ListenAndServe(router *mux.Router, listenIP string, listenPort int, tlsCert string, tlsKey string, logger log.Logger) error {
+	//Adding entry point for generic queries (GET)
+	http.Handle("/", router)
+
+	// Adding TLS certificates if required
+	if tlsCert == "" || tlsKey == "" {
+		logger.Infof("RestService start-up:: Starting server in simple mode on ip: %s and port: %v\n", listenIP, listenPort)
+		return http.ListenAndServe(fmt.Sprintf("%s:%v", listenIP, listenPort), nil)
+	}
+	logger.Infof("RestService start-up:: Starting server in TLS mode on ip: %s and port: %v\n", listenIP, listenPort)
+	logger.Infof("RestService start-up:: Using certificate file: %s and certticate key file: %v..\n", tlsCert, tlsKey)
+	return http.ListenAndServeTLS(fmt.Sprintf("%s:%v", listenIP, listenPort), tlsCert, tlsKey, nil)
 }
@@ -59,3 +59,30 @@ func NewV1DnsGroupResourceDetailsRestService(pipe net.NetPipe, store registry.St
 		BaseUrl: hostBaseUrl,
 	}
 }
+
+func NewV1DnsGroupHistoryRestService(pipe net.NetPipe, store registry.Store, logger log.Logger, hostBaseUrl string) RestService {
+	return &v1.DnsGroupHistoryService{
+		Pipe:    pipe,
+		Store:   store,
+		Log:     logger,
+		BaseUrl: hostBaseUrl,
+	}
+}
+
+func NewV1DnsGroupVersionRestService(pipe net.NetPipe, store registry.Store, logger log.Logger, hostBaseUrl string) RestService {
+	return &v1.DnsGroupVersionService{
+		Pipe:    pipe,
+		Store:   store,
+		Log:     logger,
+		BaseUrl: hostBaseUrl,
+	}
+}
+
+func NewV1DnsGroupBatchRestService(pipe net.NetPipe, store registry.Store, logger log.Logger, hostBaseUrl string) RestService {
+	return &v1.DnsGroupBatchService{
+		Pipe:    pipe,
+		Store:   store,
+		Log:     logger,
+		BaseUrl: hostBaseUrl,
+	}
+}
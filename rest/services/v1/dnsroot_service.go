@@ -59,7 +59,7 @@ func (s *DnsRootService) Read(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	groups := s.Store.GetGroupBucket().ListGroups()
+	groups := s.Store.ListGroups()
 	var list = make([]string, 0)
 	for _, g := range groups {
 		list = append(list, g.Name)
@@ -0,0 +1,330 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hellgate75/rebind/data"
+	"github.com/hellgate75/rebind/log"
+	"github.com/hellgate75/rebind/model"
+	"github.com/hellgate75/rebind/model/rest"
+	"github.com/hellgate75/rebind/net"
+	"github.com/hellgate75/rebind/registry"
+	"github.com/hellgate75/rebind/store"
+	"github.com/hellgate75/rebind/utils"
+	"golang.org/x/net/dns/dnsmessage"
+	net2 "net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DnsGroupBatchService is an implementation of RestService interface.
+type DnsGroupBatchService struct {
+	Pipe    net.NetPipe
+	Store   registry.Store
+	Log     log.Logger
+	BaseUrl string
+}
+
+// isDeleteAction accepts the DELETE spelling too
+func isDeleteAction(action rest.Action) bool {
+	return rest.DeleteResoource.Equals(action) || rest.Action("DELETE").Equals(action)
+}
+
+// applyBatchOperation applies an operation to the copies of a group and of its store
+func applyBatchOperation(group *data.Group, gsd *store.GroupStoreData, op rest.BatchOperation) error {
+	switch toField(op.Field) {
+	case rest.Field("resource"):
+		return applyResourceOperation(gsd, op)
+	case rest.Field("domain"):
+		return applyDomainOperation(group, op)
+	case rest.Field("forwarder"):
+		return applyForwarderOperation(group, op)
+	}
+	return errors.New(fmt.Sprintf("unknown field: %s", op.Field))
+}
+
+func applyResourceOperation(gsd *store.GroupStoreData, op rest.BatchOperation) error {
+	if op.Record.Host == "" {
+		return errors.New("record host cannot be empty")
+	}
+	if isDeleteAction(op.Action) {
+		var resource *dnsmessage.Resource
+		if op.Record.Type != "" {
+			var err error
+			if resource, err = toRemovedResource(op.Record.Host, op.Record.Type, op.Record.Data); err != nil {
+				return err
+			}
+		}
+		if gsd.RemoveResource(op.Record.Host, resource) == 0 {
+			return errors.New(fmt.Sprintf("no records of host %s match", op.Record.Host))
+		}
+		return nil
+	}
+	host, typeS, ipAddr, recData, resource, err := utils.ToRecordData(op.Record)
+	if err != nil {
+		return err
+	}
+	rec := store.DNSRecord{
+		Data:     recData,
+		Addr:     ipAddr,
+		Resource: resource,
+		Type:     typeS,
+		NodeName: host,
+		TTL:      resource.Header.TTL,
+		Created:  time.Now(),
+	}
+	if rest.UpdateResoource.Equals(op.Action) {
+		// replaces the records of the type, or the one with the old data
+		old, err := toRemovedResource(host, typeS, op.Record.OldData)
+		if err != nil {
+			return err
+		}
+		if gsd.RemoveResource(host, old) == 0 {
+			return errors.New(fmt.Sprintf("no %s records of host %s to update", typeS, host))
+		}
+	} else if rest.AddResoource.Equals(op.Action) {
+		if recs, rErr := gsd.Get(host); rErr == nil {
+			for _, existing := range recs {
+				if existing.Matches(&resource) {
+					return errors.New(fmt.Sprintf("%s record of host %s already present", typeS, host))
+				}
+			}
+		}
+	} else {
+		return errors.New(fmt.Sprintf("unknown action: %s", op.Action))
+	}
+	if sErr := gsd.Set(host, rec); sErr != nil {
+		return sErr.Error()
+	}
+	return nil
+}
+
+func indexOfDomain(domains []string, value string) int {
+	for idx, domain := range domains {
+		if strings.ToLower(domain) == strings.ToLower(value) {
+			return idx
+		}
+	}
+	return -1
+}
+
+func applyDomainOperation(group *data.Group, op rest.BatchOperation) error {
+	if op.Value == "" {
+		return errors.New("domain value cannot be empty")
+	}
+	index := indexOfDomain(group.Domains, op.Value)
+	if rest.AddResoource.Equals(op.Action) {
+		if index >= 0 {
+			return errors.New(fmt.Sprintf("domain %s already present", op.Value))
+		}
+		group.Domains = append(group.Domains, op.Value)
+		return nil
+	}
+	if index < 0 {
+		return errors.New(fmt.Sprintf("domain %s is not present", op.Value))
+	}
+	if isDeleteAction(op.Action) {
+		group.Domains = append(group.Domains[:index], group.Domains[index+1:]...)
+		return nil
+	}
+	if rest.UpdateResoource.Equals(op.Action) {
+		if op.NewValue == "" {
+			return errors.New("domain new value cannot be empty")
+		}
+		if other := indexOfDomain(group.Domains, op.NewValue); other >= 0 && other != index {
+			return errors.New(fmt.Sprintf("domain %s already present", op.NewValue))
+		}
+		group.Domains[index] = op.NewValue
+		return nil
+	}
+	return errors.New(fmt.Sprintf("unknown action: %s", op.Action))
+}
+
+func indexOfForwarder(forwarders []net2.UDPAddr, addr *net2.UDPAddr) int {
+	for idx, forwarder := range forwarders {
+		if forwarder.String() == addr.String() {
+			return idx
+		}
+	}
+	return -1
+}
+
+func applyForwarderOperation(group *data.Group, op rest.BatchOperation) error {
+	addr, err := net2.ResolveUDPAddr("udp", op.Value)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid forwarder %s, Error: %v", op.Value, err))
+	}
+	index := indexOfForwarder(group.Forwarders, addr)
+	if rest.AddResoource.Equals(op.Action) {
+		if index >= 0 {
+			return errors.New(fmt.Sprintf("forwarder %s already present", op.Value))
+		}
+		group.Forwarders = append(group.Forwarders, *addr)
+		return nil
+	}
+	if index < 0 {
+		return errors.New(fmt.Sprintf("forwarder %s is not present", op.Value))
+	}
+	if isDeleteAction(op.Action) {
+		group.Forwarders = append(group.Forwarders[:index], group.Forwarders[index+1:]...)
+		return nil
+	}
+	if rest.UpdateResoource.Equals(op.Action) {
+		newAddr, err := net2.ResolveUDPAddr("udp", op.NewValue)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid forwarder %s, Error: %v", op.NewValue, err))
+		}
+		if other := indexOfForwarder(group.Forwarders, newAddr); other >= 0 && other != index {
+			return errors.New(fmt.Sprintf("forwarder %s already present", op.NewValue))
+		}
+		group.Forwarders[index] = *newAddr
+		return nil
+	}
+	return errors.New(fmt.Sprintf("unknown action: %s", op.Action))
+}
+
+// sameGroupTargets reports whether two groups have the same domains and forwarders
+func sameGroupTargets(a data.Group, b data.Group) bool {
+	if len(a.Domains) != len(b.Domains) || len(a.Forwarders) != len(b.Forwarders) {
+		return false
+	}
+	for idx, domain := range a.Domains {
+		if indexOfDomain(b.Domains, domain) != idx {
+			return false
+		}
+	}
+	for idx, forwarder := range a.Forwarders {
+		if indexOfForwarder(b.Forwarders, &forwarder) != idx {
+			return false
+		}
+	}
+	return true
+}
+
+// Create is HTTP handler of POST model.Request.
+// Use for applying a batch of operations on the group records, domains and
+// forwarders: all of them are validated and take effect together, or none does.
+func (s *DnsGroupBatchService) Create(w http.ResponseWriter, r *http.Request) {
+	s.Store.Load()
+	groupName := getParentGroup(r)
+	group, err := s.Store.GetGroup(groupName)
+	if err != nil {
+		writeBatchErrorResponse(w, r, s.Log, groupName, "group doesn't exists", http.StatusNotFound)
+		return
+	}
+	var req rest.DnsBatchRequest
+	err = utils.RestParseRequest(w, r, &req)
+	if err != nil {
+		writeBatchErrorResponse(w, r, s.Log, group.Name, fmt.Sprintf("decoding batch request, Error: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Operations) == 0 {
+		writeBatchErrorResponse(w, r, s.Log, group.Name, "no operations", http.StatusBadRequest)
+		return
+	}
+	gsd, err := s.Store.GetGroupStore(group)
+	if err != nil {
+		writeBatchErrorResponse(w, r, s.Log, group.Name, fmt.Sprintf("loading store for group %s, Error: %v", groupName, err), http.StatusInternalServerError)
+		return
+	}
+	// the operations change copies, saved only when all of them apply
+	original := group
+	group.Domains = append([]string{}, group.Domains...)
+	group.Forwarders = append([]net2.UDPAddr{}, group.Forwarders...)
+	for idx, op := range req.Operations {
+		if err = applyBatchOperation(&group, &gsd, op); err != nil {
+			writeBatchErrorResponse(w, r, s.Log, group.Name, fmt.Sprintf("operation %d (%s %s) rejected, no operation applied, Error: %v", idx, op.Action, op.Field, err), http.StatusBadRequest)
+			return
+		}
+	}
+	if err = s.Store.SaveGroupAndStore(requestActor(r), group, &gsd); err != nil {
+		writeBatchErrorResponse(w, r, s.Log, group.Name, fmt.Sprintf("unable to save group data, no operation applied, Error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	group, _ = s.Store.GetGroup(group.Name)
+	// load reads the records only, the domains and forwarders are in the groups index
+	var propagation *model.Propagation
+	if sameGroupTargets(original, group) {
+		propagation = propagateGroup(s.Pipe, s.Log, group.Name)
+	} else {
+		propagation = propagateAll(s.Pipe, s.Log)
+	}
+	w.WriteHeader(http.StatusOK)
+	response := model.Response{
+		Status:      http.StatusOK,
+		Message:     fmt.Sprintf("APPLIED %d operations", len(req.Operations)),
+		Data:        rest.DnsGroupsResponse{Groups: []data.Group{group}},
+		Propagation: propagation,
+	}
+	err = utils.RestParseResponse(w, r, &response)
+	if err != nil {
+		s.Log.Errorf("Error encoding group batch response, Error: %v", err)
+	}
+}
+
+// Read is HTTP handler of GET model.Request.
+// Use for reading the templates of the batch requests.
+func (s *DnsGroupBatchService) Read(w http.ResponseWriter, r *http.Request) {
+	var templates = make([]rest.DnsTemplateDataType, 0)
+	templates = append(templates, rest.DnsTemplateDataType{
+		Method:  "POST",
+		Header:  []string{},
+		Query:   []string{},
+		Request: rest.DnsBatchRequest{Operations: []rest.BatchOperation{rest.BatchOperation{}}},
+	})
+	templates = append(templates, rest.DnsTemplateDataType{
+		Method:  "GET",
+		Header:  []string{},
+		Query:   []string{"action=template"},
+		Request: nil,
+	})
+	tErr := utils.RestParseResponse(w, r, &rest.DnsTemplateResponse{
+		Templates: templates,
+	})
+	if tErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		s.Log.Errorf("Error encoding template(s) summary response, Error: %v", tErr)
+	}
+}
+
+// Update is HTTP handler of PUT model.Request.
+// Same as Create.
+func (s *DnsGroupBatchService) Update(w http.ResponseWriter, r *http.Request) {
+	s.Create(w, r)
+}
+
+// Delete is HTTP handler of DELETE model.Request.
+// Not allowed, use a batch of delete operations.
+func (s *DnsGroupBatchService) Delete(w http.ResponseWriter, r *http.Request) {
+	groupName := getParentGroup(r)
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	response := model.Response{
+		Status:  http.StatusMethodNotAllowed,
+		Message: fmt.Sprintf("Not allowed on dns group %s batch", groupName),
+		Data:    nil,
+	}
+	err := utils.RestParseResponse(w, r, &response)
+	if err != nil {
+		s.Log.Errorf("Error encoding group %s batch response: %v", groupName, err)
+	}
+}
+
+func writeBatchErrorResponse(w http.ResponseWriter, r *http.Request, logger log.Logger, groupName string, messageSuffix string, httpStatus int) {
+	w.WriteHeader(httpStatus)
+	response := model.Response{
+		Status:  httpStatus,
+		Message: fmt.Sprintf("Group %s Batch request : %s", groupName, messageSuffix),
+		Data:    nil,
+	}
+	logger.Errorf("Group %s Batch request : %s", groupName, messageSuffix)
+	err := utils.RestParseResponse(w, r, &response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		logger.Errorf("Error encoding group %s batch response, Error: %v", groupName, err)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	net2 "net"
 	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
 )
 
@@ -39,7 +40,7 @@ func getGroup(r *http.Request) string {
 func (s *DnsGroupService) Create(w http.ResponseWriter, r *http.Request) {
 	s.Store.Load()
 	groupName := getGroup(r)
-	group, err := s.Store.GetGroupBucket().GetGroupById(groupName)
+	group, err := s.Store.GetGroup(groupName)
 	if err == nil {
 		writeUpdateErrorResponse(w, r, s.Log, group.Name, "create-group", "group already exists", http.StatusConflict)
 		return
@@ -56,7 +57,7 @@ func (s *DnsGroupService) Create(w http.ResponseWriter, r *http.Request) {
 	if req.Forwarders == nil {
 		req.Forwarders = []net2.UDPAddr{}
 	}
-	group, _, err = s.Store.GetGroupBucket().CreateAndPersistGroupAndStore(groupName, req.Domains, req.Forwarders)
+	group, err = s.Store.CreateGroup(groupName, req.Domains, req.Forwarders)
 	if err == nil {
 		s.Store.Save()
 	}
@@ -66,9 +67,10 @@ func (s *DnsGroupService) Create(w http.ResponseWriter, r *http.Request) {
 	}
 
 	response := model.Response{
-		Status:  http.StatusOK,
-		Message: "OK",
-		Data:    rest.DnsGroupsResponse{Groups: []data.Group{group}},
+		Status:      http.StatusOK,
+		Message:     "OK",
+		Data:        rest.DnsGroupsResponse{Groups: []data.Group{group}},
+		Propagation: propagateGroup(s.Pipe, s.Log, group.Name),
 	}
 	w.WriteHeader(http.StatusCreated)
 	err = utils.RestParseResponse(w, r, &response)
@@ -118,12 +120,12 @@ func (s *DnsGroupService) Read(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	groupName := getGroup(r)
-	group, err := s.Store.GetGroupBucket().GetGroupById(groupName)
+	group, err := s.Store.GetGroup(groupName)
 	if err != nil {
 		writeUpdateErrorResponse(w, r, s.Log, group.Name, "get-group", "group doesn't exists", http.StatusNotFound)
 		return
 	}
-	gsd, err := s.Store.GetGroupBucket().GetGroupStore(group)
+	gsd, err := s.Store.GetGroupStore(group)
 	if err != nil {
 		writeUpdateErrorResponse(w, r, s.Log, group.Name, "get-group", fmt.Sprintf("recovering group store, Error:", err), http.StatusInternalServerError)
 		return
@@ -156,7 +158,7 @@ func (s *DnsGroupService) Read(w http.ResponseWriter, r *http.Request) {
 func (s *DnsGroupService) Update(w http.ResponseWriter, r *http.Request) {
 	groupName := getGroup(r)
 	s.Log.Infof("Update Request for Group: %s", groupName)
-	group, err := s.Store.GetGroupBucket().GetGroupById(groupName)
+	group, err := s.Store.GetGroup(groupName)
 	if err != nil {
 		writeUpdateErrorResponse(w, r, s.Log, group.Name, "update-group", "group doesn't exists", http.StatusNotFound)
 		return
@@ -217,12 +219,10 @@ func (s *DnsGroupService) Update(w http.ResponseWriter, r *http.Request) {
 					group.Domains = []string{}
 				}
 			}
-			s.Store.GetGroupBucket().UpdateExistingGroup(group)
-			err = s.Store.GetGroupBucket().SaveMeta()
+			err = s.Store.UpdateGroup(group)
 		} else if field.Equals(rest.Field("domains")) {
 			group.Domains = []string{}
-			s.Store.GetGroupBucket().UpdateExistingGroup(group)
-			err = s.Store.GetGroupBucket().SaveMeta()
+			err = s.Store.UpdateGroup(group)
 		} else if field.Equals(rest.Field("forwarder")) {
 			value := req.Data.ListData.Value
 			index := req.Data.ListData.Index
@@ -262,21 +262,33 @@ func (s *DnsGroupService) Update(w http.ResponseWriter, r *http.Request) {
 					group.Forwarders = []net2.UDPAddr{}
 				}
 			}
-			s.Store.GetGroupBucket().UpdateExistingGroup(group)
-			err = s.Store.GetGroupBucket().SaveMeta()
+			err = s.Store.UpdateGroup(group)
 		} else if field.Equals(rest.Field("forwarders")) {
 			group.Forwarders = []net2.UDPAddr{}
-			s.Store.GetGroupBucket().UpdateExistingGroup(group)
-			err = s.Store.GetGroupBucket().SaveMeta()
+			err = s.Store.UpdateGroup(group)
+		} else if field.Equals(rest.Field("policy")) {
+			group.Policy = data.SequentialPolicy
+			err = s.Store.UpdateGroup(group)
+		} else if field.Equals(rest.Field("serve-stale")) ||
+			field.Equals(rest.Field("prefetch")) {
+			// group falls back to the server setting
+			if field.Equals(rest.Field("prefetch")) {
+				group.Prefetch = nil
+			} else {
+				group.ServeStale = nil
+			}
+			err = s.Store.UpdateGroup(group)
 		} else if field.Equals(rest.Field("data")) ||
 			field.Equals(rest.Field("resources")) {
-			gsd, err := s.Store.GetGroupBucket().GetGroupStore(group)
+			var gsd store.GroupStoreData
+			gsd, err = s.Store.GetGroupStore(group)
 			if err == nil {
 				gsd.ClearData()
-				_, err = s.Store.GetGroupBucket().SaveGroup(gsd, group)
+				err = s.Store.SaveGroupStoreAs(requestActor(r), group, &gsd)
 			}
 		} else if field.Equals(rest.Field("resource")) {
-			gsd, err := s.Store.GetGroupBucket().GetGroupStore(group)
+			var gsd store.GroupStoreData
+			gsd, err = s.Store.GetGroupStore(group)
 			if err == nil {
 				if req.Data.ListData.Value == "" {
 					writeUpdateErrorResponse(w, r, s.Log, group.Name, "update-group", "Request.Data.ListData.Value cannot be empty to delete a record", http.StatusBadRequest)
@@ -287,6 +299,7 @@ func (s *DnsGroupService) Update(w http.ResponseWriter, r *http.Request) {
 					writeUpdateErrorResponse(w, r, s.Log, group.Name, "update-group", fmt.Sprintf("unable to delete record names %s, Error: %v", req.Data.ListData.Value, rErr.Error()), http.StatusInternalServerError)
 					return
 				}
+				err = s.Store.SaveGroupStoreAs(requestActor(r), group, &gsd, req.Data.ListData.Value)
 			}
 		} else {
 			writeUpdateErrorResponse(w, r, s.Log, group.Name, "update-group", fmt.Sprintf("Cannot delete field type: %v", field), http.StatusNotImplemented)
@@ -322,8 +335,7 @@ func (s *DnsGroupService) Update(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 			group.Domains[index] = fmt.Sprintf("%v", req.Data.NewValue)
-			s.Store.GetGroupBucket().UpdateExistingGroup(group)
-			err = s.Store.GetGroupBucket().SaveMeta()
+			err = s.Store.UpdateGroup(group)
 		} else if field.Equals(rest.Field("forwarder")) ||
 			field.Equals(rest.Field("forwarders")) {
 			if req.Data.NewValue == nil ||
@@ -357,8 +369,28 @@ func (s *DnsGroupService) Update(w http.ResponseWriter, r *http.Request) {
 				writeUpdateErrorResponse(w, r, s.Log, group.Name, "update-group", "Request.Data.NewValue is not type of net.UDPAddr, as update value", http.StatusBadRequest)
 				return
 			}
-			s.Store.GetGroupBucket().UpdateExistingGroup(group)
-			err = s.Store.GetGroupBucket().SaveMeta()
+			err = s.Store.UpdateGroup(group)
+		} else if field.Equals(rest.Field("policy")) {
+			policy, ok := data.ParseForwardPolicy(fmt.Sprintf("%v", req.Data.NewValue))
+			if req.Data.NewValue == nil || !ok {
+				writeUpdateErrorResponse(w, r, s.Log, group.Name, "update-group", fmt.Sprintf("Request.Data.NewValue must be one of: %s, %s, %s, %s", data.SequentialPolicy, data.RoundRobinPolicy, data.RandomPolicy, data.LowestLatencyPolicy), http.StatusBadRequest)
+				return
+			}
+			group.Policy = policy
+			err = s.Store.UpdateGroup(group)
+		} else if field.Equals(rest.Field("serve-stale")) ||
+			field.Equals(rest.Field("prefetch")) {
+			value, pErr := strconv.ParseBool(fmt.Sprintf("%v", req.Data.NewValue))
+			if req.Data.NewValue == nil || pErr != nil {
+				writeUpdateErrorResponse(w, r, s.Log, group.Name, "update-group", "Request.Data.NewValue must be true or false", http.StatusBadRequest)
+				return
+			}
+			if field.Equals(rest.Field("prefetch")) {
+				group.Prefetch = &value
+			} else {
+				group.ServeStale = &value
+			}
+			err = s.Store.UpdateGroup(group)
 		} else if field.Equals(rest.Field("data")) ||
 			field.Equals(rest.Field("resources")) {
 			writeUpdateErrorResponse(w, r, s.Log, group.Name, "update-group", fmt.Sprintf("Cannot update field type: %v", field), http.StatusNotImplemented)
@@ -380,8 +412,7 @@ func (s *DnsGroupService) Update(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			group.Domains = append(group.Domains, fmt.Sprintf("%v", req.Data.NewValue))
-			s.Store.GetGroupBucket().UpdateExistingGroup(group)
-			err = s.Store.GetGroupBucket().SaveMeta()
+			err = s.Store.UpdateGroup(group)
 		} else if field.Equals(rest.Field("forwarder")) ||
 			field.Equals(rest.Field("forwarders")) {
 			if req.Data.NewValue == nil ||
@@ -395,8 +426,7 @@ func (s *DnsGroupService) Update(w http.ResponseWriter, r *http.Request) {
 				writeUpdateErrorResponse(w, r, s.Log, group.Name, "update-group", "Request.Data.NewValue is not type of net.UDPAddr, as update value", http.StatusBadRequest)
 				return
 			}
-			s.Store.GetGroupBucket().UpdateExistingGroup(group)
-			err = s.Store.GetGroupBucket().SaveMeta()
+			err = s.Store.UpdateGroup(group)
 		} else if field.Equals(rest.Field("data")) ||
 			field.Equals(rest.Field("resources")) {
 			writeUpdateErrorResponse(w, r, s.Log, group.Name, "update-group", fmt.Sprintf("Cannot update field type: %v", field), http.StatusNotImplemented)
@@ -416,7 +446,18 @@ func (s *DnsGroupService) Update(w http.ResponseWriter, r *http.Request) {
 		writeUpdateErrorResponse(w, r, s.Log, group.Name, "update-group", fmt.Sprintf("unable to save group data, Error:", err), http.StatusInternalServerError)
 		return
 	}
-	http.Error(w, "", http.StatusNotFound)
+	w.WriteHeader(http.StatusOK)
+	response := model.Response{
+		Status:      http.StatusOK,
+		Message:     "UPDATED",
+		Data:        rest.DnsGroupsResponse{Groups: []data.Group{group}},
+		// load reads the records only, the group changes are in the groups index
+		Propagation: propagateAll(s.Pipe, s.Log),
+	}
+	err = utils.RestParseResponse(w, r, &response)
+	if err != nil {
+		s.Log.Errorf("Error encoding group update response, Error: %v", err)
+	}
 }
 
 func writeUpdateErrorResponse(w http.ResponseWriter, r *http.Request, logger log.Logger, groupName string, requestType string, messageSuffix string, httpStatus int) {
@@ -449,19 +490,19 @@ func (s *DnsGroupService) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	group, err := s.Store.GetGroupBucket().GetGroupById(groupName)
+	group, err := s.Store.GetGroup(groupName)
 	if err != nil {
 		writeUpdateErrorResponse(w, r, s.Log, groupName, "delete-group", "requested group doesn't exist", http.StatusNotFound)
 		return
 	}
-	gsd, err := s.Store.GetGroupBucket().GetGroupStore(group)
+	gsd, err := s.Store.GetGroupStore(group)
 	if err != nil {
 		writeUpdateErrorResponse(w, r, s.Log, groupName, "delete-group", fmt.Sprintf("recovering group store, Error: %v", err), http.StatusInternalServerError)
 		return
 	}
-	state := s.Store.GetGroupBucket().Delete(group.Name)
-	if !state {
-		writeUpdateErrorResponse(w, r, s.Log, groupName, "delete-group", "requested group couldn't be deleted", http.StatusInternalServerError)
+	err = s.Store.DeleteGroup(group.Name)
+	if err != nil {
+		writeUpdateErrorResponse(w, r, s.Log, groupName, "delete-group", fmt.Sprintf("requested group couldn't be deleted, Error: %v", err), http.StatusInternalServerError)
 		return
 	}
 	s.Log.Infof("Group: %s has been deleted!!", group.Name)
@@ -480,6 +521,7 @@ func (s *DnsGroupService) Delete(w http.ResponseWriter, r *http.Request) {
 			Group:     group,
 			Resources: recs,
 		},
+		Propagation: propagateAll(s.Pipe, s.Log),
 	}
 	err = utils.RestParseResponse(w, r, &response)
 	if err != nil {
@@ -0,0 +1,386 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package v1
+
+import (
+	"fmt"
+	"github.com/hellgate75/rebind/data"
+	"github.com/hellgate75/rebind/log"
+	"github.com/hellgate75/rebind/model"
+	"github.com/hellgate75/rebind/model/rest"
+	"github.com/hellgate75/rebind/net"
+	"github.com/hellgate75/rebind/registry"
+	"github.com/hellgate75/rebind/store"
+	"github.com/hellgate75/rebind/utils"
+	net2 "net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header naming the actor of a change, when the request carries no basic auth user
+const ActorHeader = "X-Rebind-Actor"
+
+// DnsGroupHistoryService is an implementation of RestService interface.
+type DnsGroupHistoryService struct {
+	Pipe    net.NetPipe
+	Store   registry.Store
+	Log     log.Logger
+	BaseUrl string
+}
+
+// DnsGroupVersionService is an implementation of RestService interface.
+type DnsGroupVersionService struct {
+	Pipe    net.NetPipe
+	Store   registry.Store
+	Log     log.Logger
+	BaseUrl string
+}
+
+type DnsRecordChangeType struct {
+	Name   string                 `yaml:"hostname" json:"hostname" xml:"hostname"`
+	Before []DnsGroupResourceType `yaml:"before,omitempty" json:"before,omitempty" xml:"before,omitempty"`
+	After  []DnsGroupResourceType `yaml:"after,omitempty" json:"after,omitempty" xml:"after,omitempty"`
+}
+
+type DnsGroupVersionType struct {
+	Version uint64                `yaml:"version" json:"version" xml:"version"`
+	Time    time.Time             `yaml:"time" json:"time" xml:"time"`
+	Actor   string                `yaml:"actor" json:"actor" xml:"actor"`
+	Op      data.HistoryOp        `yaml:"operation" json:"operation" xml:"operation"`
+	Changes []DnsRecordChangeType `yaml:"changes" json:"changes" xml:"changes"`
+}
+
+type DnsGroupHistoryBucket struct {
+	Versions []DnsGroupVersionType `yaml:"versions" json:"versions" xml:"versions"`
+}
+
+type DnsGroupDiffBucket struct {
+	From    uint64                `yaml:"from" json:"from" xml:"from"`
+	To      uint64                `yaml:"to" json:"to" xml:"to"`
+	Changes []DnsRecordChangeType `yaml:"changes" json:"changes" xml:"changes"`
+}
+
+func getVersionGroup(r *http.Request) string {
+	arr := strings.Split(r.URL.Path, "/")
+	return arr[len(arr)-3]
+}
+
+func getVersion(r *http.Request) (uint64, error) {
+	arr := strings.Split(r.URL.Path, "/")
+	return strconv.ParseUint(arr[len(arr)-1], 10, 64)
+}
+
+// requestActor returns who requested a change: the client address, preceded by
+// the name claimed with the basic auth user or the actor header. The name is not
+// verified, the client address records where the request came from.
+func requestActor(r *http.Request) string {
+	address := r.RemoteAddr
+	if host, _, err := net2.SplitHostPort(r.RemoteAddr); err == nil {
+		address = host
+	}
+	if user, _, ok := r.BasicAuth(); ok && strings.TrimSpace(user) != "" {
+		return fmt.Sprintf("%s@%s", strings.TrimSpace(user), address)
+	}
+	if actor := strings.TrimSpace(r.Header.Get(ActorHeader)); actor != "" {
+		return fmt.Sprintf("%s@%s", actor, address)
+	}
+	return address
+}
+
+func toResourceTypes(recs []store.DNSRecord) []DnsGroupResourceType {
+	var resources = make([]DnsGroupResourceType, 0)
+	for _, rec := range recs {
+		var record string
+		if rec.Resource.Body != nil {
+			record = rec.Resource.Body.GoString()
+		}
+		resources = append(resources, DnsGroupResourceType{
+			Name:    rec.NodeName,
+			Type:    rec.Resource.Header.Type.String(),
+			Addr:    rec.Addr,
+			RecData: rec.Data,
+			Record:  record,
+		})
+	}
+	return resources
+}
+
+func toChangeTypes(changes []data.RecordChange) []DnsRecordChangeType {
+	var list = make([]DnsRecordChangeType, 0)
+	for _, change := range changes {
+		list = append(list, DnsRecordChangeType{
+			Name:   change.Key,
+			Before: toResourceTypes(change.Before),
+			After:  toResourceTypes(change.After),
+		})
+	}
+	return list
+}
+
+func toVersionType(entry data.HistoryEntry) DnsGroupVersionType {
+	return DnsGroupVersionType{
+		Version: entry.Version,
+		Time:    entry.Time,
+		Actor:   entry.Actor,
+		Op:      entry.Op,
+		Changes: toChangeTypes(entry.Changes),
+	}
+}
+
+func writeHistoryErrorResponse(w http.ResponseWriter, r *http.Request, logger log.Logger, groupName string, requestType string, messageSuffix string, httpStatus int) {
+	w.WriteHeader(httpStatus)
+	response := model.Response{
+		Status:  httpStatus,
+		Message: fmt.Sprintf("Group %s History request %s : %s", groupName, requestType, messageSuffix),
+		Data:    nil,
+	}
+	logger.Errorf("Group %s History %s request : %s", groupName, requestType, messageSuffix)
+	err := utils.RestParseResponse(w, r, &response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		logger.Errorf("Error encoding group %s history response, Error: %v", groupName, err)
+	}
+}
+
+func writeHistoryNotAllowedResponse(w http.ResponseWriter, r *http.Request, logger log.Logger, groupName string) {
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	response := model.Response{
+		Status:  http.StatusMethodNotAllowed,
+		Message: fmt.Sprintf("Not allowed on dns group %s history", groupName),
+		Data:    nil,
+	}
+	err := utils.RestParseResponse(w, r, &response)
+	if err != nil {
+		logger.Errorf("Error encoding group %s history response: %v", groupName, err)
+	}
+}
+
+// Create is HTTP handler of POST model.Request.
+// Not allowed, use the version to roll back to.
+func (s *DnsGroupHistoryService) Create(w http.ResponseWriter, r *http.Request) {
+	writeHistoryNotAllowedResponse(w, r, s.Log, getParentGroup(r))
+}
+
+// Read is HTTP handler of GET model.Request.
+// Use for listing the versions of the group records, or the differences
+// between two versions with the from and to query parameters.
+func (s *DnsGroupHistoryService) Read(w http.ResponseWriter, r *http.Request) {
+	var action = r.URL.Query().Get("action")
+	if strings.ToLower(action) == "template" {
+		var templates = make([]rest.DnsTemplateDataType, 0)
+		templates = append(templates, rest.DnsTemplateDataType{
+			Method:  "GET",
+			Header:  []string{},
+			Query:   []string{},
+			Request: nil,
+		})
+		templates = append(templates, rest.DnsTemplateDataType{
+			Method:  "GET",
+			Header:  []string{},
+			Query:   []string{"from=<version>", "to=<version>"},
+			Request: nil,
+		})
+		templates = append(templates, rest.DnsTemplateDataType{
+			Method:  "GET",
+			Header:  []string{},
+			Query:   []string{"action=template"},
+			Request: nil,
+		})
+		tErr := utils.RestParseResponse(w, r, &rest.DnsTemplateResponse{
+			Templates: templates,
+		})
+		if tErr != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			s.Log.Errorf("Error encoding template(s) summary response, Error: %v", tErr)
+		}
+		return
+	}
+	s.Store.Load()
+	groupName := getParentGroup(r)
+	group, err := s.Store.GetGroup(groupName)
+	if err != nil {
+		writeHistoryErrorResponse(w, r, s.Log, groupName, "get-history", "group doesn't exists", http.StatusNotFound)
+		return
+	}
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	if from != "" || to != "" {
+		s.diff(w, r, group, from, to)
+		return
+	}
+	history, err := s.Store.GroupHistory(group.Name)
+	if err != nil {
+		writeHistoryErrorResponse(w, r, s.Log, group.Name, "get-history", fmt.Sprintf("recovering group history, Error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	var versions = make([]DnsGroupVersionType, 0)
+	for _, entry := range history {
+		versions = append(versions, toVersionType(entry))
+	}
+	w.WriteHeader(http.StatusOK)
+	response := model.Response{
+		Status:  http.StatusOK,
+		Message: "OK",
+		Data: DnsGroupHistoryBucket{
+			Versions: versions,
+		},
+	}
+	err = utils.RestParseResponse(w, r, &response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		s.Log.Errorf("Error encoding group history response, Error: %v", err)
+	}
+}
+
+// diff writes the differences of the group records between two versions, the
+// missing one is the last version
+func (s *DnsGroupHistoryService) diff(w http.ResponseWriter, r *http.Request, group data.Group, from string, to string) {
+	history, err := s.Store.GroupHistory(group.Name)
+	if err != nil {
+		writeHistoryErrorResponse(w, r, s.Log, group.Name, "diff-versions", fmt.Sprintf("recovering group history, Error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	var versions = []uint64{0, 0}
+	if len(history) > 0 {
+		versions[0] = history[len(history)-1].Version
+		versions[1] = versions[0]
+	}
+	for idx, value := range []string{from, to} {
+		if value == "" {
+			continue
+		}
+		if versions[idx], err = strconv.ParseUint(value, 10, 64); err != nil {
+			writeHistoryErrorResponse(w, r, s.Log, group.Name, "diff-versions", fmt.Sprintf("invalid version: %s", value), http.StatusBadRequest)
+			return
+		}
+	}
+	changes, err := s.Store.DiffGroupVersions(group.Name, versions[0], versions[1])
+	if err != nil {
+		writeHistoryErrorResponse(w, r, s.Log, group.Name, "diff-versions", err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	response := model.Response{
+		Status:  http.StatusOK,
+		Message: "OK",
+		Data: DnsGroupDiffBucket{
+			From:    versions[0],
+			To:      versions[1],
+			Changes: toChangeTypes(changes),
+		},
+	}
+	err = utils.RestParseResponse(w, r, &response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		s.Log.Errorf("Error encoding group versions diff response, Error: %v", err)
+	}
+}
+
+// Update is HTTP handler of PUT model.Request.
+// Not allowed, use the version to roll back to.
+func (s *DnsGroupHistoryService) Update(w http.ResponseWriter, r *http.Request) {
+	writeHistoryNotAllowedResponse(w, r, s.Log, getParentGroup(r))
+}
+
+// Delete is HTTP handler of DELETE model.Request.
+// Not allowed, the history is kept as audit trail.
+func (s *DnsGroupHistoryService) Delete(w http.ResponseWriter, r *http.Request) {
+	writeHistoryNotAllowedResponse(w, r, s.Log, getParentGroup(r))
+}
+
+// Create is HTTP handler of POST model.Request.
+// Use for rolling the group records back to the version, recorded as a new version.
+func (s *DnsGroupVersionService) Create(w http.ResponseWriter, r *http.Request) {
+	s.Store.Load()
+	groupName := getVersionGroup(r)
+	group, err := s.Store.GetGroup(groupName)
+	if err != nil {
+		writeHistoryErrorResponse(w, r, s.Log, groupName, "rollback", "group doesn't exists", http.StatusNotFound)
+		return
+	}
+	version, err := getVersion(r)
+	if err != nil {
+		writeHistoryErrorResponse(w, r, s.Log, group.Name, "rollback", fmt.Sprintf("invalid version, Error: %v", err), http.StatusBadRequest)
+		return
+	}
+	entry, err := s.Store.RollbackGroup(requestActor(r), group.Name, version)
+	if err != nil {
+		writeHistoryErrorResponse(w, r, s.Log, group.Name, "rollback", fmt.Sprintf("rolling back to version %d, Error: %v", version, err), http.StatusConflict)
+		return
+	}
+	var response = model.Response{
+		Status:  http.StatusOK,
+		Message: fmt.Sprintf("Group records already at version %d", version),
+	}
+	if entry.Version > 0 {
+		response.Message = fmt.Sprintf("Group records rolled back to version %d", version)
+		response.Data = DnsGroupHistoryBucket{Versions: []DnsGroupVersionType{toVersionType(entry)}}
+		response.Propagation = propagateGroup(s.Pipe, s.Log, group.Name)
+	}
+	w.WriteHeader(http.StatusOK)
+	err = utils.RestParseResponse(w, r, &response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		s.Log.Errorf("Error encoding group rollback response, Error: %v", err)
+	}
+}
+
+// Read is HTTP handler of GET model.Request.
+// Use for reading the group records at the version.
+func (s *DnsGroupVersionService) Read(w http.ResponseWriter, r *http.Request) {
+	s.Store.Load()
+	groupName := getVersionGroup(r)
+	group, err := s.Store.GetGroup(groupName)
+	if err != nil {
+		writeHistoryErrorResponse(w, r, s.Log, groupName, "get-version", "group doesn't exists", http.StatusNotFound)
+		return
+	}
+	version, err := getVersion(r)
+	if err != nil {
+		writeHistoryErrorResponse(w, r, s.Log, group.Name, "get-version", fmt.Sprintf("invalid version, Error: %v", err), http.StatusBadRequest)
+		return
+	}
+	persistent, err := s.Store.GetGroupVersion(group.Name, version)
+	if err != nil {
+		writeHistoryErrorResponse(w, r, s.Log, group.Name, "get-version", err.Error(), http.StatusNotFound)
+		return
+	}
+	var keys = make([]string, 0)
+	for key := range persistent.Store {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var resources = make([]DnsGroupResourceType, 0)
+	for _, key := range keys {
+		resources = append(resources, toResourceTypes(persistent.Store[key])...)
+	}
+	w.WriteHeader(http.StatusOK)
+	response := model.Response{
+		Status:  http.StatusOK,
+		Message: "OK",
+		Data: DnsGroupResourcesBucket{
+			Resources: resources,
+		},
+	}
+	err = utils.RestParseResponse(w, r, &response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		s.Log.Errorf("Error encoding group version response, Error: %v", err)
+	}
+}
+
+// Update is HTTP handler of PUT model.Request.
+// Not allowed, use POST to roll back to the version.
+func (s *DnsGroupVersionService) Update(w http.ResponseWriter, r *http.Request) {
+	writeHistoryNotAllowedResponse(w, r, s.Log, getVersionGroup(r))
+}
+
+// Delete is HTTP handler of DELETE model.Request.
+// Not allowed, the history is kept as audit trail.
+func (s *DnsGroupVersionService) Delete(w http.ResponseWriter, r *http.Request) {
+	writeHistoryNotAllowedResponse(w, r, s.Log, getVersionGroup(r))
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/hellgate75/rebind/registry"
 	"github.com/hellgate75/rebind/store"
 	"github.com/hellgate75/rebind/utils"
+	"golang.org/x/net/dns/dnsmessage"
 	"net/http"
 	"strings"
 	"time"
@@ -40,7 +41,7 @@ func (s *DnsGroupResourceDetailsService) Create(w http.ResponseWriter, r *http.R
 	s.Store.Load()
 	groupName := getResourceGroup(r)
 	hostname := getResourceHost(r)
-	group, err := s.Store.GetGroupBucket().GetGroupById(groupName)
+	group, err := s.Store.GetGroup(groupName)
 	if err != nil {
 		writeResourceDetailsErrorResponse(w, r, s.Log, group.Name, "create-resource-data", "group doesn't exists", http.StatusConflict)
 		return
@@ -51,7 +52,7 @@ func (s *DnsGroupResourceDetailsService) Create(w http.ResponseWriter, r *http.R
 		writeResourceDetailsErrorResponse(w, r, s.Log, group.Name, "create-resource-data", fmt.Sprintf("decoding group resource creation request, Error: %v", err), http.StatusBadRequest)
 		return
 	}
-	gsd, err := s.Store.GetGroupBucket().GetGroupStore(group)
+	gsd, err := s.Store.GetGroupStore(group)
 	if err != nil {
 		writeResourceDetailsErrorResponse(w, r, s.Log, group.Name, "create-resource-data", fmt.Sprintf("loading store for group %s resource host %s, Error: %v", groupName, hostname, err), http.StatusInternalServerError)
 		return
@@ -81,7 +82,7 @@ func (s *DnsGroupResourceDetailsService) Create(w http.ResponseWriter, r *http.R
 		err = sErr.Error()
 	}
 	if err == nil {
-		s.Store.Save()
+		err = s.Store.SaveGroupStoreAs(requestActor(r), group, &gsd, host)
 	}
 	if err != nil {
 		writeResourceDetailsErrorResponse(w, r, s.Log, group.Name, "create-resource-data", fmt.Sprintf("creating new group resource, Error: %v", err), http.StatusLocked)
@@ -96,9 +97,10 @@ func (s *DnsGroupResourceDetailsService) Create(w http.ResponseWriter, r *http.R
 		Record:  resource.Body.GoString(),
 	}
 	response := model.Response{
-		Status:  http.StatusOK,
-		Message: "OK",
-		Data:    DnsGroupResourcesBucket{Resources: []DnsGroupResourceType{resourceAnswer}},
+		Status:      http.StatusOK,
+		Message:     "OK",
+		Data:        DnsGroupResourcesBucket{Resources: []DnsGroupResourceType{resourceAnswer}},
+		Propagation: propagateGroup(s.Pipe, s.Log, group.Name),
 	}
 	w.WriteHeader(http.StatusCreated)
 	err = utils.RestParseResponse(w, r, &response)
@@ -149,12 +151,12 @@ func (s *DnsGroupResourceDetailsService) Read(w http.ResponseWriter, r *http.Req
 	}
 	groupName := getResourceGroup(r)
 	hostname := getResourceHost(r)
-	group, err := s.Store.GetGroupBucket().GetGroupById(groupName)
+	group, err := s.Store.GetGroup(groupName)
 	if err != nil {
 		writeResourceDetailsErrorResponse(w, r, s.Log, group.Name, "get-resource-datas", "group doesn't exists", http.StatusNotFound)
 		return
 	}
-	gsd, err := s.Store.GetGroupBucket().GetGroupStore(group)
+	gsd, err := s.Store.GetGroupStore(group)
 	if err != nil {
 		writeResourceDetailsErrorResponse(w, r, s.Log, group.Name, "get-resource-datas", fmt.Sprintf("recovering group store, Error:", err), http.StatusInternalServerError)
 		return
@@ -195,6 +197,29 @@ func (s *DnsGroupResourceDetailsService) Update(w http.ResponseWriter, r *http.R
 	s.Create(w, r)
 }
 
+// toRemovedResource returns the resource matching the records to remove, of a
+// type or, when data is given, of a type and a value
+func toRemovedResource(hostname string, recType string, recData string) (*dnsmessage.Resource, error) {
+	if recData == "" {
+		rType := utils.ToRType(strings.ToUpper(recType))
+		if rType == 0 {
+			return nil, utils.ErrTypeNotSupport
+		}
+		return &dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Type: rType},
+		}, nil
+	}
+	resource, err := utils.ToResource(model.Request{
+		Host: hostname,
+		Type: strings.ToUpper(recType),
+		Data: recData,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resource, nil
+}
+
 func writeResourceDetailsErrorResponse(w http.ResponseWriter, r *http.Request, logger log.Logger, groupName string, requestType string, messageSuffix string, httpStatus int) {
 	w.WriteHeader(httpStatus)
 	response := model.Response{
@@ -215,30 +240,41 @@ func writeResourceDetailsErrorResponse(w http.ResponseWriter, r *http.Request, l
 func (s *DnsGroupResourceDetailsService) Delete(w http.ResponseWriter, r *http.Request) {
 	groupName := getResourceGroup(r)
 	hostname := getResourceHost(r)
-	group, err := s.Store.GetGroupBucket().GetGroupById(groupName)
+	group, err := s.Store.GetGroup(groupName)
 	if err != nil {
-		writeResourceDetailsErrorResponse(w, r, s.Log, group.Name, "get-resource-datas", "group doesn't exists", http.StatusNotFound)
+		writeResourceDetailsErrorResponse(w, r, s.Log, groupName, "delete-resource-datas", "group doesn't exists", http.StatusNotFound)
 		return
 	}
-	gsd, err := s.Store.GetGroupBucket().GetGroupStore(group)
+	gsd, err := s.Store.GetGroupStore(group)
 	if err != nil {
-		writeResourceDetailsErrorResponse(w, r, s.Log, group.Name, "get-resource-datas", fmt.Sprintf("recovering group store, Error:", err), http.StatusInternalServerError)
+		writeResourceDetailsErrorResponse(w, r, s.Log, group.Name, "delete-resource-datas", fmt.Sprintf("recovering group store, Error: %v", err), http.StatusInternalServerError)
 		return
 	}
-	dErr := gsd.Remove(hostname)
-	if dErr != nil {
-		err = dErr.Error()
+	// query params type and data select the records to remove, all records by default
+	var resource *dnsmessage.Resource
+	if recType := r.URL.Query().Get("type"); recType != "" {
+		resource, err = toRemovedResource(hostname, recType, r.URL.Query().Get("data"))
+		if err != nil {
+			writeResourceDetailsErrorResponse(w, r, s.Log, group.Name, "delete-resource-datas", fmt.Sprintf("invalid record type %s or data, Error: %v", recType, err), http.StatusBadRequest)
+			return
+		}
 	}
+	if gsd.RemoveResource(hostname, resource) == 0 {
+		writeResourceDetailsErrorResponse(w, r, s.Log, group.Name, "delete-resource-datas", fmt.Sprintf("no matching records for host: %s", hostname), http.StatusNotFound)
+		return
+	}
+	err = s.Store.SaveGroupStoreAs(requestActor(r), group, &gsd, hostname)
 	if err != nil {
-		writeResourceDetailsErrorResponse(w, r, s.Log, group.Name, "get-resource-datas", fmt.Sprintf("deleting dns record for host: %s, Error:", hostname, err), http.StatusInternalServerError)
+		writeResourceDetailsErrorResponse(w, r, s.Log, group.Name, "delete-resource-datas", fmt.Sprintf("deleting dns record for host: %s, Error: %v", hostname, err), http.StatusInternalServerError)
 		return
 	}
 	s.Log.Infof("Group: %v -> Resource: %s has been deleted!!", group.Name, hostname)
 	w.WriteHeader(http.StatusOK)
 	response := model.Response{
-		Status:  http.StatusOK,
-		Message: fmt.Sprintf("Removed on dns group %s the resource: %s", groupName, hostname),
-		Data:    nil,
+		Status:      http.StatusOK,
+		Message:     fmt.Sprintf("Removed on dns group %s the resource: %s", groupName, hostname),
+		Data:        nil,
+		Propagation: propagateGroup(s.Pipe, s.Log, group.Name),
 	}
 	err = utils.RestParseResponse(w, r, &response)
 	if err != nil {
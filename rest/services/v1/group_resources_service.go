@@ -47,7 +47,7 @@ func getParentGroup(r *http.Request) string {
 func (s *DnsGroupResourcesService) Create(w http.ResponseWriter, r *http.Request) {
 	s.Store.Load()
 	groupName := getParentGroup(r)
-	group, err := s.Store.GetGroupBucket().GetGroupById(groupName)
+	group, err := s.Store.GetGroup(groupName)
 	if err != nil {
 		writeResourcesErrorResponse(w, r, s.Log, group.Name, "create-resource", "group doesn't exists", http.StatusConflict)
 		return
@@ -58,7 +58,7 @@ func (s *DnsGroupResourcesService) Create(w http.ResponseWriter, r *http.Request
 		writeResourcesErrorResponse(w, r, s.Log, group.Name, "create-resource", fmt.Sprintf("decoding group creation request, Error: %v", err), http.StatusBadRequest)
 		return
 	}
-	gsd, err := s.Store.GetGroupBucket().GetGroupStore(group)
+	gsd, err := s.Store.GetGroupStore(group)
 	if err != nil {
 		writeResourcesErrorResponse(w, r, s.Log, group.Name, "create-resource", fmt.Sprintf("loading store for group %s, Error: %v", groupName, err), http.StatusInternalServerError)
 		return
@@ -84,7 +84,7 @@ func (s *DnsGroupResourcesService) Create(w http.ResponseWriter, r *http.Request
 		err = sErr.Error()
 	}
 	if err == nil {
-		s.Store.Save()
+		err = s.Store.SaveGroupStoreAs(requestActor(r), group, &gsd, host)
 	}
 	if err != nil {
 		writeResourcesErrorResponse(w, r, s.Log, group.Name, "create-resource", fmt.Sprintf("creating new group, Error: %v", err), http.StatusLocked)
@@ -99,9 +99,10 @@ func (s *DnsGroupResourcesService) Create(w http.ResponseWriter, r *http.Request
 		Record:  resource.Body.GoString(),
 	}
 	response := model.Response{
-		Status:  http.StatusOK,
-		Message: "OK",
-		Data:    DnsGroupResourcesBucket{Resources: []DnsGroupResourceType{resourceAnswer}},
+		Status:      http.StatusOK,
+		Message:     "OK",
+		Data:        DnsGroupResourcesBucket{Resources: []DnsGroupResourceType{resourceAnswer}},
+		Propagation: propagateGroup(s.Pipe, s.Log, group.Name),
 	}
 	w.WriteHeader(http.StatusCreated)
 	err = utils.RestParseResponse(w, r, &response)
@@ -151,12 +152,12 @@ func (s *DnsGroupResourcesService) Read(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	groupName := getParentGroup(r)
-	group, err := s.Store.GetGroupBucket().GetGroupById(groupName)
+	group, err := s.Store.GetGroup(groupName)
 	if err != nil {
 		writeResourcesErrorResponse(w, r, s.Log, group.Name, "get-resources", "group doesn't exists", http.StatusNotFound)
 		return
 	}
-	gsd, err := s.Store.GetGroupBucket().GetGroupStore(group)
+	gsd, err := s.Store.GetGroupStore(group)
 	if err != nil {
 		writeResourcesErrorResponse(w, r, s.Log, group.Name, "get-resources", fmt.Sprintf("recovering group store, Error:", err), http.StatusInternalServerError)
 		return
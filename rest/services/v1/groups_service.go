@@ -58,7 +58,7 @@ func (s *DnsGroupsService) Create(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	if s.Store.GetGroupBucket().Contains(req.Name) {
+	if _, gErr := s.Store.GetGroup(req.Name); gErr == nil {
 		w.WriteHeader(http.StatusConflict)
 		response := model.Response{
 			Status:  http.StatusConflict,
@@ -79,7 +79,7 @@ func (s *DnsGroupsService) Create(w http.ResponseWriter, r *http.Request) {
 	if req.Forwarders == nil {
 		req.Forwarders = []net2.UDPAddr{}
 	}
-	group, _, err := s.Store.GetGroupBucket().CreateAndPersistGroupAndStore(req.Name, req.Domains, req.Forwarders)
+	group, err := s.Store.CreateGroup(req.Name, req.Domains, req.Forwarders)
 	if err == nil {
 		s.Store.Save()
 	}
@@ -100,9 +100,10 @@ func (s *DnsGroupsService) Create(w http.ResponseWriter, r *http.Request) {
 	}
 
 	response := model.Response{
-		Status:  http.StatusOK,
-		Message: "OK",
-		Data:    rest.DnsGroupsResponse{Groups: []data.Group{group}},
+		Status:      http.StatusOK,
+		Message:     "OK",
+		Data:        rest.DnsGroupsResponse{Groups: []data.Group{group}},
+		Propagation: propagateGroup(s.Pipe, s.Log, group.Name),
 	}
 	w.WriteHeader(http.StatusCreated)
 	err = utils.RestParseResponse(w, r, &response)
@@ -166,7 +167,7 @@ func (s *DnsGroupsService) Read(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	groups := s.Store.GetGroupBucket().ListGroups()
+	groups := s.Store.ListGroups()
 	name := r.URL.Query().Get("name")
 	if name == "" {
 		name = r.Header.Get("Name")
@@ -0,0 +1,48 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package v1
+
+import (
+	"context"
+	"github.com/hellgate75/rebind/log"
+	"github.com/hellgate75/rebind/model"
+	"github.com/hellgate75/rebind/net"
+)
+
+// propagateGroup asks the DNS server to load again a group store
+func propagateGroup(pipe net.NetPipe, logger log.Logger, groupName string) *model.Propagation {
+	return propagate(pipe, logger, net.LoadCommand, net.LoadPayload{Group: groupName})
+}
+
+// propagateAll asks the DNS server to reload all the groups
+func propagateAll(pipe net.NetPipe, logger log.Logger) *model.Propagation {
+	return propagate(pipe, logger, net.ReloadCommand, nil)
+}
+
+// propagate sends a command to the DNS server. A nil pipe means the store is
+// shared with the DNS server, which sees the change already: nothing is reported.
+func propagate(pipe net.NetPipe, logger log.Logger, command net.Command, payload interface{}) *model.Propagation {
+	if pipe == nil {
+		return nil
+	}
+	propagation := model.Propagation{
+		Command: string(command),
+	}
+	request, err := net.NewRequest(command, payload)
+	if err != nil {
+		propagation.Status = string(net.CommandNotSent)
+		propagation.Error = err.Error()
+		return &propagation
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), net.DEFAULT_COMMAND_TIMEOUT)
+	defer cancel()
+	reply, err := pipe.Call(ctx, request)
+	propagation.Status = string(reply.Status)
+	if err != nil {
+		propagation.Error = err.Error()
+		logger.Warnf("Change propagation to dns server, command: %s, status: %s, Error: %v", command, reply.Status, err)
+	}
+	return &propagation
+}
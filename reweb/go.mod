@@ -6,6 +6,7 @@ require (
 	github.com/gookit/color v1.2.4 // indirect
 	github.com/gorilla/mux v1.7.4 // indirect
 	github.com/hellgate75/rebind v0.0.0-20200414231631-0094948f2b8f // indirect
+	go.etcd.io/bbolt v1.3.5 // indirect
 	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e // indirect
 	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
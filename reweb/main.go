@@ -6,8 +6,7 @@ package main
 
 import (
 	"flag"
-	"fmt"
-	"github.com/gorilla/mux"
+	"github.com/hellgate75/rebind/data"
 	"github.com/hellgate75/rebind/log"
 	"github.com/hellgate75/rebind/model"
 	"github.com/hellgate75/rebind/model/rest"
@@ -16,11 +15,11 @@ import (
 	"github.com/hellgate75/rebind/rest/services"
 	"github.com/hellgate75/rebind/utils"
 	"net"
-	"net/http"
 	"os"
 )
 
 var rwDirPath string
+var dataBackend string
 var configDirPath string
 var initializeAndExit bool
 var useConfigFile bool
@@ -35,6 +34,12 @@ var listenPort int
 var dnsPipeIP string
 var dnsPipePort int
 var dnsPipeResponsePort int
+var dnsPipeSocket string
+var dnsPipeSecretFile string
+var dnsPipeTlsCert string
+var dnsPipeTlsKey string
+var dnsPipeTlsCA string
+var remoteStore bool
 var tlsCert string
 var tlsKey string
 
@@ -46,6 +51,7 @@ var defaultForwarders = make([]net.UDPAddr, 0)
 func init() {
 	logger.Info("Initializing Re-Web Rest Server ....")
 	flag.StringVar(&rwDirPath, "data-dir", rest.DefaultStorageFolder, "dns storage dir")
+	flag.StringVar(&dataBackend, "data-backend", string(data.FileBackend), "dns storage backend (file, bolt, memory), when not using the remote store")
 	flag.StringVar(&configDirPath, "config-dir", rest.DefaultConfigFolder, "dns config dir")
 	flag.BoolVar(&initializeAndExit, "init-and-exit", false, "initialize config in the config dir and exit")
 	flag.BoolVar(&useConfigFile, "use-config-file", false, "use config file instead parameters")
@@ -60,6 +66,12 @@ func init() {
 	flag.StringVar(&dnsPipeIP, "dns-pipe-ip", rest.DefaultDnsPipeAddress, "tcp dns pipe ip")
 	flag.IntVar(&dnsPipePort, "dns-pipe-port", rest.DefaultDnsAnswerPipePort, "tcp dns pipe port")
 	flag.IntVar(&dnsPipeResponsePort, "dns-pipe-response-port", rest.DefaultDnsPipePort, "tcp dns pipe responses port")
+	flag.StringVar(&dnsPipeSocket, "dns-pipe-socket", "", "unix socket dns pipe path (e.g. /run/rebind/control.sock), replaces the tcp dns pipe")
+	flag.StringVar(&dnsPipeSecretFile, "dns-pipe-secret-file", "", "file with the dns pipe shared secret, signing and authenticating messages")
+	flag.StringVar(&dnsPipeTlsCert, "dns-pipe-tls-cert", "", "dns pipe mutual tls certificate file path")
+	flag.StringVar(&dnsPipeTlsKey, "dns-pipe-tls-key", "", "dns pipe mutual tls certificate key file path")
+	flag.StringVar(&dnsPipeTlsCA, "dns-pipe-tls-ca", "", "dns pipe mutual tls certification authority file path")
+	flag.BoolVar(&remoteStore, "remote-store", false, "forward the store calls to the dns server over the dns pipe, the dns server is the single writer of the data dir")
 	flag.StringVar(&tlsCert, "tsl-cert", "", "tls certificate file path")
 	flag.StringVar(&tlsKey, "tsl-key", "", "tls certificate key file path")
 }
@@ -75,12 +87,19 @@ func main() {
 		logger.Info("Initialize Re-Web Rest Server and Exit!!")
 		config := model.ReWebConfig{
 			DataDirPath:         rwDirPath,
+			DataBackend:         dataBackend,
 			ConfigDirPath:       configDirPath,
 			ListenIP:            listenIP,
 			ListenPort:          listenPort,
 			DnsPipeIP:           dnsPipeIP,
 			DnsPipePort:         dnsPipePort,
 			DnsPipeResponsePort: dnsPipeResponsePort,
+			DnsPipeSocket:       dnsPipeSocket,
+			DnsPipeSecretFile:   dnsPipeSecretFile,
+			DnsPipeTlsCert:      dnsPipeTlsCert,
+			DnsPipeTlsKey:       dnsPipeTlsKey,
+			DnsPipeTlsCA:        dnsPipeTlsCA,
+			RemoteStore:         remoteStore,
 			TlsCert:             tlsCert,
 			TlsKey:              tlsKey,
 			EnableFileLogging:   enableFileLogging,
@@ -107,12 +126,19 @@ func main() {
 			logger.Warnf("Loading configuration from file complete!!", config)
 			logger.Debugf("Configuration: %v", config)
 			rwDirPath = config.DataDirPath
+			dataBackend = config.DataBackend
 			configDirPath = config.ConfigDirPath
 			listenIP = config.ListenIP
 			listenPort = config.ListenPort
 			dnsPipeIP = config.DnsPipeIP
 			dnsPipePort = config.DnsPipePort
 			dnsPipeResponsePort = config.DnsPipeResponsePort
+			dnsPipeSocket = config.DnsPipeSocket
+			dnsPipeSecretFile = config.DnsPipeSecretFile
+			dnsPipeTlsCert = config.DnsPipeTlsCert
+			dnsPipeTlsKey = config.DnsPipeTlsKey
+			dnsPipeTlsCA = config.DnsPipeTlsCA
+			remoteStore = config.RemoteStore
 			enableFileLogging = config.EnableFileLogging
 			logVerbosity = config.LogVerbosity
 			logFilePath = config.LogFilePath
@@ -170,59 +196,52 @@ func main() {
 	defaultForwarders = append(defaultForwarders, rest.DefaultGroupForwarders...)
 
 	// Create network Pipe Stream with the dns server
-	pipe, err := pnet.NewInputOutputPipeWith(dnsPipeIP, dnsPipePort, dnsPipeIP, dnsPipeResponsePort, nil, logger)
+	var pipe pnet.NetPipe
+	var err error
+	if dnsPipeSocket != "" {
+		pipe, err = pnet.NewSocketPipe(dnsPipeSocket, false, nil, logger)
+	} else {
+		pipe, err = pnet.NewInputOutputPipeWith(dnsPipeIP, dnsPipePort, dnsPipeIP, dnsPipeResponsePort, nil, logger)
+	}
 	if err != nil {
 		logger.Fatalf("Unable to create NetPipe in listen: %v and bind: %v/%v\n", dnsPipePort, dnsPipeResponsePort)
+		os.Exit(1)
+	}
+	pipeSecurity, err := pnet.LoadPipeSecurity(dnsPipeSecretFile, dnsPipeTlsCert, dnsPipeTlsKey, dnsPipeTlsCA)
+	if err != nil {
+		logger.Errorf("Unable to load dns pipe security settings, Error: %v\n", err)
+		os.Exit(1)
+	}
+	pipe.Secure(pipeSecurity)
+	// Listen for dns server replies, changes are applied on restart if it fails
+	if err = pipe.Start(); err != nil {
+		logger.Errorf("Unable to start NetPipe in listen: %v -> Error: %v\n", dnsPipePort, err)
 	}
+	defer pipe.Stop()
 	// Create Data Store
-	store := registry.NewStore(logger, rwDirPath, defaultForwarders)
-	store.Load()
-
-	// Handler stuf for the API service groups
-	dnsHandler := func(serv services.RestService) http.HandlerFunc {
-		return func(w http.ResponseWriter, r *http.Request) {
-			switch r.Method {
-			case http.MethodPost:
-				serv.Create(w, r)
-			case http.MethodGet:
-				serv.Read(w, r)
-			case http.MethodPut:
-				serv.Update(w, r)
-			case http.MethodDelete:
-				serv.Delete(w, r)
-			}
+	var store registry.Store
+	if remoteStore {
+		logger.Info("Using the dns server store over the dns pipe")
+		store = registry.NewRemoteStore(pipe, logger)
+	} else {
+		backendType, ok := data.ParseBackendType(dataBackend)
+		if !ok {
+			logger.Errorf("Unknown dns storage backend: %s\n", dataBackend)
+			os.Exit(1)
 		}
-	}
-
-	withAuth := func(h http.HandlerFunc) http.HandlerFunc {
-		// authentication intercepting
-		var _ = "intercept"
-		return func(w http.ResponseWriter, r *http.Request) {
-			h(w, r)
+		backend, err := data.NewBackend(backendType, rwDirPath, logger)
+		if err != nil {
+			logger.Errorf("Unable to open dns storage backend %s, Error: %v\n", backendType, err)
+			os.Exit(1)
 		}
+		defer backend.Close()
+		store = registry.NewStoreWith(logger, rwDirPath, backend, defaultForwarders)
 	}
+	store.Load()
 
-	rtr := mux.NewRouter()
-	var proto string = "http"
-	if tlsCert != "" && tlsKey != "" {
-		proto = "https"
-	}
 	// Creates/Sets API endpoints handlers
-	services.CreateApiEndpoints(rtr, withAuth, dnsHandler,
-		pipe, store, logger, fmt.Sprintf("%s://%s:%v", proto, listenIP, listenPort))
-
-	//Adding entry point for generic queries (GET)
-	http.Handle("/", rtr)
-
-	// Adding TLS certificates if required
-	if tlsCert == "" || tlsKey == "" {
-		logger.Infof("RestService start-up:: Starting server in simple mode on ip: %s and port: %v\n", listenIP, listenPort)
-		err = http.ListenAndServe(fmt.Sprintf("%s:%v", listenIP, listenPort), nil)
-	} else {
-		logger.Infof("RestService start-up:: Starting server in simple mode on ip: %s and port: %v\n", listenIP, listenPort)
-		logger.Infof("RestService start-up:: Using certificate file: %s and certticate key file: %v..\n", tlsCert, tlsKey)
-		err = http.ListenAndServeTLS(fmt.Sprintf("%s:%v", listenIP, listenPort), tlsCert, tlsKey, nil)
-	}
+	rtr := services.NewApiRouter(pipe, store, logger, services.BaseUrl(listenIP, listenPort, tlsCert, tlsKey))
+	err = services.ListenAndServe(rtr, listenIP, listenPort, tlsCert, tlsKey, logger)
 	if err != nil {
 		logger.Fatalf("RestService start-up:: Error listening on s:%v - Error: %v\n", listenIP, listenPort, err)
 		os.Exit(1)
@@ -5,118 +5,360 @@
 package store
 
 import (
+	"container/list"
 	"errors"
 	"fmt"
 	"github.com/hellgate75/rebind/model"
 	rErrrors "github.com/hellgate75/rebind/rerrors"
 	"github.com/hellgate75/rebind/utils"
 	"golang.org/x/net/dns/dnsmessage"
+	"hash/fnv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var DEFAULT_ANSWER_TIME_TO_LIVE time.Duration = 5 * time.Minute
 
+// Answers cache default bounds
+const DEFAULT_ANSWER_CACHE_MAX_ENTRIES int = 100000
+const DEFAULT_ANSWER_CACHE_MAX_MEMORY int64 = 64 * 1024 * 1024
+
+const (
+	// Number of answers cache shards, as power of 2
+	answersCacheShards int = 32
+	// Estimated memory of a record, excluding name and data
+	answerRecordOverhead int64 = 64
+	// Estimated memory of a cache entry, excluding key and records
+	answerEntryOverhead int64 = 128
+)
+
 type AnswersCacheStore interface {
 	Get(key string) ([]dnsmessage.Resource, rErrrors.Error)
+	GetBlock(key string) (model.AnswerBlock, rErrrors.Error)
+	GetStale(key string, ttl uint32) (model.AnswerBlock, rErrrors.Error)
 	Set(key string, log ...dnsmessage.Resource) rErrrors.Error
+	SetNegative(key string, rCode dnsmessage.RCode, answer []dnsmessage.Resource, authority []dnsmessage.Resource) rErrrors.Error
 	Remove(key string) rErrrors.Error
+	RemoveName(name string) int
+	Flush()
 	Trim() rErrrors.Error
+	Stats() AnswersCacheStats
+	// Keeps the expired answers for the stale window, only when serve-stale is enabled
+	SetServeStale(enabled bool)
 }
 
+// AnswersCacheStats reports the answers cache usage
+type AnswersCacheStats struct {
+	Hits      int64 `yaml:"hits" json:"hits" xml:"hits"`
+	Misses    int64 `yaml:"misses" json:"misses" xml:"misses"`
+	Evictions int64 `yaml:"evictions" json:"evictions" xml:"evictions"`
+	StaleHits int64 `yaml:"staleHits" json:"staleHits" xml:"stale-hits"`
+	Entries   int64 `yaml:"entries" json:"entries" xml:"entries"`
+	Memory    int64 `yaml:"memory" json:"memory" xml:"memory"`
+}
+
+// AnswersCacheStoreData keeps answers for the smallest TTL of their records,
+// bound between MinTTL and MaxTTL. Records are returned with the TTL left.
+// Negative answers are kept for the SOA minimum TTL, up to NegativeMaxTTL.
+// Expired answers are kept for StaleWindow, to be served when forwarders fail,
+// only while serve-stale is enabled.
+// Answers are spread in shards, each one bound in entries and memory and
+// evicting the least recently used answers.
 type AnswersCacheStoreData struct {
-	sync.RWMutex
-	store map[string][]model.AnswerBlock
-	path  string
+	hits           int64
+	misses         int64
+	evictions      int64
+	staleHits      int64
+	serveStale     int32
+	shards         []*answersCacheShard
+	MinTTL         time.Duration
+	MaxTTL         time.Duration
+	NegativeMaxTTL time.Duration
+	StaleWindow    time.Duration
+	MaxEntries     int
+	MaxMemory      int64
+}
+
+type answersCacheEntry struct {
+	key   string
+	block model.AnswerBlock
+	size  int64
+}
+
+type answersCacheShard struct {
+	sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List
+	memory     int64
+	maxEntries int
+	maxMemory  int64
 }
 
+// Get returns the records of a positive answer, with the TTL left
 func (b *AnswersCacheStoreData) Get(key string) ([]dnsmessage.Resource, rErrrors.Error) {
+	block, err := b.GetBlock(key)
+	if err != nil {
+		return make([]dnsmessage.Resource, 0), err
+	}
+	if block.Negative {
+		return make([]dnsmessage.Resource, 0), rErrrors.New(errors.New("Key "+key+" has a negative answer"), int64(20), rErrrors.StoreProcessErrorType)
+	}
+	return block.Answer, nil
+}
+
+// GetBlock returns a positive or negative answer, with the TTL left in every record
+func (b *AnswersCacheStoreData) GetBlock(key string) (model.AnswerBlock, rErrrors.Error) {
 	internalErr := rErrrors.New(errors.New("Key "+key+" doesn't exist"), int64(20), rErrrors.StoreProcessErrorType)
+	shard := b.shardOf(key)
 	defer func() {
 		if r := recover(); r != nil {
 			internalErr = rErrrors.New(errors.New(fmt.Sprintf("Runtime error: %s", r)), int64(21), rErrrors.StoreProcessErrorType)
 		}
-		b.Unlock()
+		shard.Unlock()
 	}()
-	b.RLock()
-	val, ok := b.store[key]
-	if ok {
-		internalErr = nil
+	shard.Lock()
+	elem, ok := shard.entries[key]
+	if !ok {
+		atomic.AddInt64(&b.misses, 1)
+		return model.AnswerBlock{}, internalErr
 	}
-	var out = make([]dnsmessage.Resource, 0)
-	for _, v := range val {
-		if v.IsValid() {
-			out = append(out, v.Answer...)
+	entry := elem.Value.(*answersCacheEntry)
+	if !entry.block.IsValid() {
+		if b.isExpired(entry.block) {
+			shard.remove(elem)
+		}
+		atomic.AddInt64(&b.misses, 1)
+		return model.AnswerBlock{}, internalErr
+	}
+	shard.lru.MoveToFront(elem)
+	atomic.AddInt64(&b.hits, 1)
+	entry.block.Hits++
+	return served(entry.block, uint32(entry.block.Remaining()/time.Second)), nil
+}
+
+// GetStale returns an answer, even if expired since no longer than the stale
+// window, with the given TTL in every record (RFC 8767 - 4)
+func (b *AnswersCacheStoreData) GetStale(key string, ttl uint32) (model.AnswerBlock, rErrrors.Error) {
+	internalErr := rErrrors.New(errors.New("Key "+key+" doesn't exist"), int64(20), rErrrors.StoreProcessErrorType)
+	shard := b.shardOf(key)
+	defer func() {
+		if r := recover(); r != nil {
+			internalErr = rErrrors.New(errors.New(fmt.Sprintf("Runtime error: %s", r)), int64(21), rErrrors.StoreProcessErrorType)
 		}
+		shard.Unlock()
+	}()
+	shard.Lock()
+	elem, ok := shard.entries[key]
+	if !ok {
+		return model.AnswerBlock{}, internalErr
+	}
+	entry := elem.Value.(*answersCacheEntry)
+	if b.isExpired(entry.block) {
+		shard.remove(elem)
+		return model.AnswerBlock{}, internalErr
+	}
+	atomic.AddInt64(&b.staleHits, 1)
+	return served(entry.block, ttl), nil
+}
+
+// isExpired checks the answer is expired since longer than the stale window
+func (b *AnswersCacheStoreData) isExpired(block model.AnswerBlock) bool {
+	if atomic.LoadInt32(&b.serveStale) == 0 {
+		return time.Now().After(block.Expires())
+	}
+	return time.Now().After(block.Expires().Add(b.StaleWindow))
+}
+
+func (b *AnswersCacheStoreData) SetServeStale(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
 	}
-	out = utils.RemoveDuplicatesInResourceList(out)
-	return out, internalErr
+	atomic.StoreInt32(&b.serveStale, value)
+}
+
+// served returns a copy of the answer, with the given TTL in every record
+func served(block model.AnswerBlock, ttl uint32) model.AnswerBlock {
+	block.Answer = withTTL(block.Answer, ttl)
+	block.Authority = withTTL(block.Authority, ttl)
+	return block
+}
+
+// withTTL returns a copy of the records with the given TTL
+func withTTL(records []dnsmessage.Resource, ttl uint32) []dnsmessage.Resource {
+	var out = make([]dnsmessage.Resource, 0)
+	for _, r := range records {
+		r.Header.TTL = ttl
+		out = append(out, r)
+	}
+	return out
 }
 
 func (b *AnswersCacheStoreData) Set(key string, log ...dnsmessage.Resource) rErrrors.Error {
+	answer := utils.RemoveDuplicatesInResourceList(log)
+	return b.store(key, model.AnswerBlock{
+		Created: time.Now(),
+		TTL:     b.ttlOf(answer),
+		Answer:  answer,
+	})
+}
+
+// SetNegative keeps a NXDOMAIN or NODATA answer for the TTL of the SOA record in
+// the authority section (RFC 2308 - 5), answers with no SOA record are not kept
+func (b *AnswersCacheStoreData) SetNegative(key string, rCode dnsmessage.RCode, answer []dnsmessage.Resource, authority []dnsmessage.Resource) rErrrors.Error {
+	var soa *dnsmessage.Resource
+	for i, r := range authority {
+		if r.Header.Type == dnsmessage.TypeSOA {
+			soa = &authority[i]
+			break
+		}
+	}
+	if soa == nil {
+		return rErrrors.New(errors.New("Key "+key+" negative answer has no SOA record"), int64(22), rErrrors.StoreProcessErrorType)
+	}
+	ttl := soa.Header.TTL
+	if body, ok := soa.Body.(*dnsmessage.SOAResource); ok && body.MinTTL < ttl {
+		ttl = body.MinTTL
+	}
+	negativeTTL := time.Duration(ttl) * time.Second
+	if b.NegativeMaxTTL > 0 && negativeTTL > b.NegativeMaxTTL {
+		negativeTTL = b.NegativeMaxTTL
+	}
+	return b.store(key, model.AnswerBlock{
+		Created:   time.Now(),
+		TTL:       negativeTTL,
+		Answer:    answer,
+		Negative:  true,
+		RCode:     rCode,
+		Authority: []dnsmessage.Resource{*soa},
+	})
+}
+
+// store keeps the answer, evicting the least recently used ones over the shard bounds
+func (b *AnswersCacheStoreData) store(key string, block model.AnswerBlock) rErrrors.Error {
 	var internalErr rErrrors.Error
+	shard := b.shardOf(key)
 	defer func() {
 		if r := recover(); r != nil {
 			internalErr = rErrrors.New(errors.New(fmt.Sprintf("Runtime error: %s", r)), int64(23), rErrrors.StoreProcessErrorType)
 		}
-		b.Unlock()
+		shard.Unlock()
 	}()
-	b.Lock()
-	if _, ok := b.store[key]; ok {
-		b.store[key] = append(b.store[key], model.AnswerBlock{
-			Created: time.Now(),
-			TTL:     DEFAULT_ANSWER_TIME_TO_LIVE,
-			Answer:  log,
-		})
-	} else {
-		b.store[key] = []model.AnswerBlock{model.AnswerBlock{
-			Created: time.Now(),
-			TTL:     DEFAULT_ANSWER_TIME_TO_LIVE,
-			Answer:  log,
-		}}
+	entry := &answersCacheEntry{
+		key:   key,
+		block: block,
+		size:  entrySize(key, block.Answer) + entrySize("", block.Authority) - answerEntryOverhead,
+	}
+	shard.Lock()
+	if elem, ok := shard.entries[key]; ok {
+		shard.remove(elem)
+	}
+	shard.entries[key] = shard.lru.PushFront(entry)
+	shard.memory += entry.size
+	for shard.lru.Len() > 1 && (shard.lru.Len() > shard.maxEntries || shard.memory > shard.maxMemory) {
+		shard.remove(shard.lru.Back())
+		atomic.AddInt64(&b.evictions, 1)
 	}
 	return internalErr
 }
 
+// ttlOf returns the smallest TTL of the records, bound to the cache limits
+func (b *AnswersCacheStoreData) ttlOf(answer []dnsmessage.Resource) time.Duration {
+	var ttl = DEFAULT_ANSWER_TIME_TO_LIVE
+	for idx, r := range answer {
+		recTTL := time.Duration(r.Header.TTL) * time.Second
+		if idx == 0 || recTTL < ttl {
+			ttl = recTTL
+		}
+	}
+	if ttl < b.MinTTL {
+		ttl = b.MinTTL
+	}
+	if b.MaxTTL > 0 && ttl > b.MaxTTL {
+		ttl = b.MaxTTL
+	}
+	return ttl
+}
+
 func (b *AnswersCacheStoreData) Remove(key string) rErrrors.Error {
 	internalErr := rErrrors.New(errors.New("Key "+key+" doesn't exist"), int64(24), rErrrors.StoreProcessErrorType)
+	shard := b.shardOf(key)
 	defer func() {
 		if r := recover(); r != nil {
 			internalErr = rErrrors.New(errors.New(fmt.Sprintf("Runtime error: %s", r)), int64(25), rErrrors.StoreProcessErrorType)
 		}
-		b.Unlock()
+		shard.Unlock()
 	}()
-	b.Lock()
-	_, ok := b.store[key]
+	shard.Lock()
+	elem, ok := shard.entries[key]
 	if ok {
-		delete(b.store, key)
+		shard.remove(elem)
 		internalErr = nil
 	}
 	return internalErr
 }
 
-func (b *AnswersCacheStoreData) Trim() rErrrors.Error {
-	var err error
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.New(fmt.Sprintf("%v", r))
-		}
-	}()
-	for key, value := range b.store {
-		newVal := make([]model.AnswerBlock, 0)
-		for _, t := range value {
-			if t.IsValid() {
-				newVal = append(newVal, t)
+// RemoveName evicts the answers to questions for a name, with keys starting
+// with the name followed by '|', and the answers with records of the name.
+// The name is compared case insensitive and without the trailing dot.
+// It returns the number of evicted answers.
+func (b *AnswersCacheStoreData) RemoveName(name string) int {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	removed := 0
+	for _, shard := range b.shards {
+		shard.Lock()
+		for key, elem := range shard.entries {
+			if strings.HasPrefix(key, name+"|") || hasRecordsOf(elem.Value.(*answersCacheEntry).block, name) {
+				shard.remove(elem)
+				removed++
 			}
 		}
-		value = newVal
+		shard.Unlock()
+	}
+	return removed
+}
 
-		if len(value) == 0 {
-			delete(b.store, key)
-		} else {
-			b.store[key] = value
+// hasRecordsOf checks if any record of the answer belongs to the name
+func hasRecordsOf(block model.AnswerBlock, name string) bool {
+	for _, r := range block.Answer {
+		if strings.TrimSuffix(strings.ToLower(r.Header.Name.String()), ".") == name {
+			return true
 		}
 	}
+	return false
+}
+
+// Flush evicts all the answers
+func (b *AnswersCacheStoreData) Flush() {
+	for _, shard := range b.shards {
+		shard.Lock()
+		shard.entries = make(map[string]*list.Element)
+		shard.lru.Init()
+		shard.memory = 0
+		shard.Unlock()
+	}
+}
+
+func (b *AnswersCacheStoreData) Trim() rErrrors.Error {
+	var err error
+	for _, shard := range b.shards {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					err = errors.New(fmt.Sprintf("%v", r))
+				}
+				shard.Unlock()
+			}()
+			shard.Lock()
+			for _, elem := range shard.entries {
+				if b.isExpired(elem.Value.(*answersCacheEntry).block) {
+					shard.remove(elem)
+				}
+			}
+		}()
+	}
 	if err != nil {
 		return rErrrors.New(err, 55,
 			rErrrors.StoreProcessErrorType)
@@ -124,8 +366,103 @@ func (b *AnswersCacheStoreData) Trim() rErrrors.Error {
 	return nil
 }
 
+// Stats returns the cache counters and usage
+func (b *AnswersCacheStoreData) Stats() AnswersCacheStats {
+	stats := AnswersCacheStats{
+		Hits:      atomic.LoadInt64(&b.hits),
+		Misses:    atomic.LoadInt64(&b.misses),
+		Evictions: atomic.LoadInt64(&b.evictions),
+		StaleHits: atomic.LoadInt64(&b.staleHits),
+	}
+	for _, shard := range b.shards {
+		shard.Lock()
+		stats.Entries += int64(shard.lru.Len())
+		stats.Memory += shard.memory
+		shard.Unlock()
+	}
+	return stats
+}
+
+func (b *AnswersCacheStoreData) shardOf(key string) *answersCacheShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return b.shards[int(h.Sum32())&(len(b.shards)-1)]
+}
+
+// remove drops an entry from the shard, the shard must be locked
+func (s *answersCacheShard) remove(elem *list.Element) {
+	entry := elem.Value.(*answersCacheEntry)
+	s.lru.Remove(elem)
+	delete(s.entries, entry.key)
+	s.memory -= entry.size
+}
+
+// entrySize estimates the memory used by a cache entry
+func entrySize(key string, answer []dnsmessage.Resource) int64 {
+	size := answerEntryOverhead + int64(len(key))
+	for _, r := range answer {
+		size += answerRecordOverhead + int64(r.Header.Name.Length)
+		switch body := r.Body.(type) {
+		case *dnsmessage.AResource:
+			size += 4
+		case *dnsmessage.AAAAResource:
+			size += 16
+		case *dnsmessage.CNAMEResource:
+			size += int64(body.CNAME.Length)
+		case *dnsmessage.NSResource:
+			size += int64(body.NS.Length)
+		case *dnsmessage.PTRResource:
+			size += int64(body.PTR.Length)
+		case *dnsmessage.MXResource:
+			size += 2 + int64(body.MX.Length)
+		case *dnsmessage.SRVResource:
+			size += 6 + int64(body.Target.Length)
+		case *dnsmessage.SOAResource:
+			size += 20 + int64(body.NS.Length) + int64(body.MBox.Length)
+		case *dnsmessage.TXTResource:
+			for _, txt := range body.TXT {
+				size += int64(len(txt))
+			}
+		default:
+			size += answerRecordOverhead
+		}
+	}
+	return size
+}
+
 func NewAnswersCacheStore() AnswersCacheStore {
-	return &AnswersCacheStoreData{
-		store: make(map[string][]model.AnswerBlock),
+	return NewAnswersCacheStoreWith(model.CacheConfig{})
+}
+
+// NewAnswersCacheStoreWith creates an answers cache with the given TTL bounds, zero
+// max TTLs mean unbound, and size bounds, zero or negative values use the defaults
+func NewAnswersCacheStoreWith(config model.CacheConfig) AnswersCacheStore {
+	maxEntries := config.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = DEFAULT_ANSWER_CACHE_MAX_ENTRIES
+	}
+	maxMemory := config.MaxMemory
+	if maxMemory <= 0 {
+		maxMemory = DEFAULT_ANSWER_CACHE_MAX_MEMORY
+	}
+	var shards = make([]*answersCacheShard, answersCacheShards)
+	for i := range shards {
+		shards[i] = &answersCacheShard{
+			entries:    make(map[string]*list.Element),
+			lru:        list.New(),
+			maxEntries: (maxEntries + answersCacheShards - 1) / answersCacheShards,
+			maxMemory:  (maxMemory + int64(answersCacheShards) - 1) / int64(answersCacheShards),
+		}
+	}
+	cache := &AnswersCacheStoreData{
+		shards:         shards,
+		MinTTL:         time.Duration(config.MinTTL) * time.Second,
+		MaxTTL:         time.Duration(config.MaxTTL) * time.Second,
+		NegativeMaxTTL: time.Duration(config.NegativeMaxTTL) * time.Second,
+		StaleWindow:    time.Duration(config.StaleWindow) * time.Second,
+		MaxEntries:     maxEntries,
+		MaxMemory:      maxMemory,
 	}
+	cache.SetServeStale(config.ServeStale)
+	return cache
 }
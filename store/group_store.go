@@ -35,6 +35,8 @@ type GroupStore interface {
 	Set(key string, record DNSRecord) rErrrors.Error
 	// Remove Records for a key
 	Remove(key string) rErrrors.Error
+	// Remove the records of a key matching a resource, returns the number of removed records
+	RemoveResource(key string, r *dnsmessage.Resource) int
 	// Retrieve group name
 	GetGroup() string
 	// Retrieve references domains
@@ -50,6 +52,8 @@ type GroupStorePersistent struct {
 	GroupName  string
 	Domains    []string
 	Forwarders []net.UDPAddr
+	// Sequence of the last journal entry included in the records
+	JournalSeq uint64
 }
 
 type GroupStoreData struct {
@@ -80,6 +84,20 @@ func (b *GroupStoreData) FromPersistentData(persistent GroupStorePersistent) {
 	b.Forwarders = persistent.Forwarders
 }
 
+// NewGroupStoreData creates a group store from its persistent data
+func NewGroupStoreData(persistent GroupStorePersistent) GroupStoreData {
+	var records = persistent.Store
+	if records == nil {
+		records = make(map[string][]DNSRecord)
+	}
+	return GroupStoreData{
+		store:      records,
+		GroupName:  persistent.GroupName,
+		Domains:    persistent.Domains,
+		Forwarders: persistent.Forwarders,
+	}
+}
+
 func (b *GroupStoreData) Keys() []string {
 	var keys []string = make([]string, 0)
 	for k, _ := range b.store {
@@ -106,7 +124,7 @@ func (b *GroupStoreData) Get(key string) ([]DNSRecord, rErrrors.Error) {
 		if r := recover(); r != nil {
 			internalErr = rErrrors.New(errors.New(fmt.Sprintf("Runtime error: %s", r)), int64(21), rErrrors.StoreProcessErrorType)
 		}
-		b.Unlock()
+		b.RUnlock()
 	}()
 	b.RLock()
 	val, ok := b.store[key]
@@ -166,6 +184,44 @@ func (b *GroupStoreData) Remove(key string) rErrrors.Error {
 	return internalErr
 }
 
+// RemoveResource removes the records of a key matching a resource: all records
+// when the resource is nil or has no type, the records of its type when it has
+// no body, otherwise the records of its type with the same body
+func (b *GroupStoreData) RemoveResource(key string, r *dnsmessage.Resource) int {
+	b.Lock()
+	defer b.Unlock()
+	recs, ok := b.store[key]
+	if !ok {
+		return 0
+	}
+	var kept = make([]DNSRecord, 0)
+	for _, rec := range recs {
+		if !rec.Matches(r) {
+			kept = append(kept, rec)
+		}
+	}
+	if len(kept) == 0 {
+		delete(b.store, key)
+	} else {
+		b.store[key] = kept
+	}
+	return len(recs) - len(kept)
+}
+
+// Matches reports whether the record matches a resource, see RemoveResource
+func (r DNSRecord) Matches(resource *dnsmessage.Resource) bool {
+	if resource == nil || resource.Header.Type == 0 {
+		return true
+	}
+	if r.Resource.Header.Type != resource.Header.Type {
+		return false
+	}
+	if resource.Body == nil {
+		return true
+	}
+	return r.Resource.Body != nil && r.Resource.Body.GoString() == resource.Body.GoString()
+}
+
 // Generate New _zone Records Store
 func NewGroupStore(groupName string, domains []string, forwarders []net.UDPAddr) GroupStore {
 	return &GroupStoreData{
@@ -64,7 +64,7 @@ func (b *GroupsStoreData) Get(key string) (GroupStore, rErrrors.Error) {
 		if r := recover(); r != nil {
 			internalErr = rErrrors.New(errors.New(fmt.Sprintf("Runtime error: %s", r)), int64(21), rErrrors.StoreProcessErrorType)
 		}
-		b.Unlock()
+		b.RUnlock()
 	}()
 	b.RLock()
 	val, ok := b.store[key]
@@ -82,7 +82,7 @@ func (b *GroupsStoreData) GetByGroup(group string) (GroupStore, string, rErrrors
 		if r := recover(); r != nil {
 			internalErr = rErrrors.New(errors.New(fmt.Sprintf("Runtime error: %s", r)), int64(30), rErrrors.StoreProcessErrorType)
 		}
-		b.Unlock()
+		b.RUnlock()
 	}()
 	b.RLock()
 	var key string
@@ -104,7 +104,7 @@ func (b *GroupsStoreData) GetFirstByDomain(domain string) (GroupStore, string, r
 		if r := recover(); r != nil {
 			internalErr = rErrrors.New(errors.New(fmt.Sprintf("Runtime error: %s", r)), int64(30), rErrrors.StoreProcessErrorType)
 		}
-		b.Unlock()
+		b.RUnlock()
 	}()
 	b.RLock()
 	var key string
@@ -132,7 +132,7 @@ func (b *GroupsStoreData) GetAllByDomain(domain string) ([]GroupStore, rErrrors.
 		if r := recover(); r != nil {
 			internalErr = rErrrors.New(errors.New(fmt.Sprintf("Runtime error: %s", r)), int64(30), rErrrors.StoreProcessErrorType)
 		}
-		b.Unlock()
+		b.RUnlock()
 	}()
 	b.RLock()
 	var val []GroupStore = make([]GroupStore, 0)
@@ -179,6 +179,7 @@ func (b *GroupsStoreData) Remove(key string) rErrrors.Error {
 		}
 		b.Unlock()
 	}()
+	b.Lock()
 	_, ok := b.store[key]
 	if ok {
 		internalErr = nil
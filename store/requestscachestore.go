@@ -29,7 +29,7 @@ func (b *RequestsCacheStoreData) Get(key string) ([]net.UDPAddr, rErrrors.Error)
 		if r := recover(); r != nil {
 			internalErr = rErrrors.New(errors.New(fmt.Sprintf("Runtime error: %s", r)), int64(21), rErrrors.StoreProcessErrorType)
 		}
-		b.Unlock()
+		b.RUnlock()
 	}()
 	b.RLock()
 	val, ok := b.store[key]
@@ -0,0 +1,58 @@
+// Copyright 2020 Re-Bind Author (Fabrizio Torelli). All rights reserved.
+// Use of this source code is governed by a LGPL-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"github.com/hellgate75/rebind/model"
+	"github.com/hellgate75/rebind/store"
+	"golang.org/x/net/dns/dnsmessage"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+)
+
+const keysCount = 10000
+
+// Answers cache throughput under parallel load, for a mostly read and a mostly write workload
+func main() {
+	keys := make([]string, keysCount)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("host-%v.example.com|1|1", i)
+	}
+	answer := []dnsmessage.Resource{
+		{
+			Header: dnsmessage.ResourceHeader{
+				Name:  dnsmessage.MustNewName("host.example.com."),
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+				TTL:   300,
+			},
+			Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}},
+		},
+	}
+	for _, readPercent := range []int{90, 50} {
+		cache := store.NewAnswersCacheStoreWith(model.CacheConfig{MaxEntries: keysCount / 2})
+		var seed int64
+		result := testing.Benchmark(func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+				for pb.Next() {
+					key := keys[r.Intn(keysCount)]
+					if r.Intn(100) < readPercent {
+						_, _ = cache.Get(key)
+					} else {
+						_ = cache.Set(key, answer...)
+					}
+				}
+			})
+		})
+		stats := cache.Stats()
+		fmt.Printf("AnswersCache %v%% reads: %s %s\n", readPercent, result.String(), result.MemString())
+		fmt.Printf("AnswersCache %v%% reads: hits=%v misses=%v evictions=%v entries=%v memory=%v\n",
+			readPercent, stats.Hits, stats.Misses, stats.Evictions, stats.Entries, stats.Memory)
+	}
+}